@@ -0,0 +1,41 @@
+package common
+
+import (
+	"net"
+	"sync"
+
+	"github.com/ido2021/light-proxy/common"
+)
+
+// FakeAddrs maps the real addresses of the UDP destinations restored from
+// fake IPs back to the fake addresses, the client expects the replies from
+// the address it sent to. The zero value is ready to use
+type FakeAddrs struct {
+	mu    sync.Mutex
+	addrs map[string]*common.AddrSpec
+}
+
+// Add records the fake address of a destination once its IP is resolved
+func (f *FakeAddrs) Add(metadata *common.Metadata) {
+	if metadata.FakeAddr == nil || metadata.DestAddr == nil || metadata.DestAddr.IP == nil {
+		return
+	}
+	dest := &net.UDPAddr{IP: metadata.DestAddr.IP, Port: metadata.DestAddr.Port}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.addrs == nil {
+		f.addrs = map[string]*common.AddrSpec{}
+	}
+	// 多个假地址解析到同一地址时使用最近的
+	f.addrs[dest.String()] = metadata.FakeAddr
+}
+
+// ReplyAddr returns the source address of a reply received from from
+func (f *FakeAddrs) ReplyAddr(from *net.UDPAddr) *common.AddrSpec {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if fake, ok := f.addrs[from.String()]; ok {
+		return fake
+	}
+	return &common.AddrSpec{IP: from.IP, Port: from.Port}
+}
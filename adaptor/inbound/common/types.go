@@ -1,5 +1,7 @@
 package common
 
+import "time"
+
 type BaseConfig struct {
 	IP   string `json:"ip"`
 	Port uint16 `json:"port"`
@@ -9,3 +11,16 @@ type User struct {
 	UserName string `json:"user_name"`
 	Password string `json:"password,omitempty"`
 }
+
+// SniffConfig 协议嗅探配置，从TLS SNI、HTTP Host、QUIC Initial中获取域名用于路由
+type SniffConfig struct {
+	Sniff bool `json:"sniff,omitempty"`
+	// SniffOverrideDestination 使用嗅探到的域名替换连接目标
+	SniffOverrideDestination bool `json:"sniffOverrideDestination,omitempty"`
+	// SniffTimeout 等待客户端首个数据包的超时时间，单位毫秒
+	SniffTimeout int `json:"sniffTimeout,omitempty"`
+}
+
+func (c SniffConfig) Timeout() time.Duration {
+	return time.Duration(c.SniffTimeout) * time.Millisecond
+}
@@ -0,0 +1,293 @@
+// Package dns is an inbound answering DNS queries over UDP and TCP, so that
+// LAN clients can use the proxy as their resolver.
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/ido2021/light-proxy/adaptor/inbound"
+	"github.com/ido2021/light-proxy/adaptor/outbound"
+	"github.com/ido2021/light-proxy/common"
+	dns2 "github.com/ido2021/light-proxy/dns"
+	"github.com/ido2021/light-proxy/route"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAddress = ":53"
+	// maxMessageSize is the maximum size of a DNS message
+	maxMessageSize = 65535
+	// minUDPSize is the size of a UDP response a client without EDNS accepts
+	minUDPSize = 512
+	// blockTTL is the TTL of the answers for blocked domains
+	blockTTL = 60
+	// queryTimeout bounds answering a single query
+	queryTimeout = 10 * time.Second
+	// idleTimeout closes TCP connections without queries
+	idleTimeout = 2 * time.Minute
+)
+
+const (
+	// BlockNXDomain answers blocked domains with NXDOMAIN
+	BlockNXDomain = "nxdomain"
+	// BlockZero answers blocked domains with 0.0.0.0 and ::
+	BlockZero = "zero"
+)
+
+func init() {
+	inbound.RegisterInAdaptorFactory(inbound.DNS, NewDNSAdaptor)
+}
+
+type DNSConfig struct {
+	// Address 同时监听UDP和TCP，默认为:53
+	Address string `json:"address,omitempty"`
+	// BlockResponse 路由到block的域名的应答方式，nxdomain（默认）或zero
+	BlockResponse string `json:"blockResponse,omitempty"`
+}
+
+// DNSAdaptor routes every queried domain by the domain rules, domains routed
+// to the block outbound are refused and the others are answered by the
+// resolver of the server. Addresses pinned in the hosts of the dns config are
+// answered even if the domain is blocked
+type DNSAdaptor struct {
+	tag      string
+	conf     *DNSConfig
+	resolver *dns2.Resolver
+
+	mu         sync.Mutex
+	packetConn net.PacketConn
+	listener   net.Listener
+}
+
+func NewDNSAdaptor(tag string, config json.RawMessage) (inbound.InAdaptor, error) {
+	conf := &DNSConfig{}
+	err := json.Unmarshal(config, conf)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Address == "" {
+		conf.Address = defaultAddress
+	}
+	switch conf.BlockResponse {
+	case "":
+		conf.BlockResponse = BlockNXDomain
+	case BlockNXDomain, BlockZero:
+	default:
+		return nil, errors.New("不支持的blockResponse: " + conf.BlockResponse)
+	}
+	return &DNSAdaptor{tag: tag, conf: conf}, nil
+}
+
+// SetResolver sets the resolver answering the queries which are not blocked
+func (d *DNSAdaptor) SetResolver(resolver *dns2.Resolver) {
+	d.resolver = resolver
+}
+
+func (d *DNSAdaptor) Start(router *route.Router) error {
+	if d.resolver == nil {
+		return errors.New("dns inbound has no resolver")
+	}
+	packetConn, err := net.ListenPacket("udp", d.conf.Address)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", d.conf.Address)
+	if err != nil {
+		packetConn.Close()
+		return err
+	}
+	d.mu.Lock()
+	d.packetConn = packetConn
+	d.listener = l
+	d.mu.Unlock()
+
+	go d.serveUDP(packetConn, router)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			// 监听关闭了，退出
+			if errors.Is(err, net.ErrClosed) {
+				break
+			}
+			log.Println("获取连接异常：", err)
+			continue
+		}
+		go d.serveConn(conn, router)
+	}
+	return nil
+}
+
+func (d *DNSAdaptor) Stop() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.listener == nil {
+		return nil
+	}
+	d.packetConn.Close()
+	return d.listener.Close()
+}
+
+func (d *DNSAdaptor) serveUDP(packetConn net.PacketConn, router *route.Router) {
+	for {
+		buf := make([]byte, maxMessageSize)
+		n, from, err := packetConn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Println("读取DNS查询异常：", err)
+			continue
+		}
+		go func() {
+			resp := d.handle(buf[:n], addrSpec(from), router, true)
+			if resp == nil {
+				return
+			}
+			if _, err := packetConn.WriteTo(resp, from); err != nil {
+				log.Println(err)
+			}
+		}()
+	}
+}
+
+// serveConn answers the length prefixed queries on a TCP connection in order
+func (d *DNSAdaptor) serveConn(conn net.Conn, router *route.Router) {
+	defer conn.Close()
+	client := addrSpec(conn.RemoteAddr())
+	header := make([]byte, 2)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		b := make([]byte, binary.BigEndian.Uint16(header))
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return
+		}
+		resp := d.handle(b, client, router, false)
+		if resp == nil {
+			return
+		}
+		msg := make([]byte, 2+len(resp))
+		binary.BigEndian.PutUint16(msg, uint16(len(resp)))
+		copy(msg[2:], resp)
+		if _, err := conn.Write(msg); err != nil {
+			return
+		}
+	}
+}
+
+func addrSpec(addr net.Addr) *common.AddrSpec {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return &common.AddrSpec{IP: a.IP, Port: a.Port}
+	case *net.TCPAddr:
+		return &common.AddrSpec{IP: a.IP, Port: a.Port}
+	}
+	return nil
+}
+
+// handle answers the packed query b, nil is returned for a malformed query
+func (d *DNSAdaptor) handle(b []byte, client *common.AddrSpec, router *route.Router, udp bool) []byte {
+	query := &dnsmessage.Message{}
+	if err := query.Unpack(b); err != nil || query.Response {
+		return nil
+	}
+	resp := d.answer(query, client, router)
+	resp.ID = query.ID
+	resp.Response = true
+	resp.RecursionDesired = query.RecursionDesired
+	resp.RecursionAvailable = true
+	out, err := resp.Pack()
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+
+	// 超过客户端接受的大小时截断，客户端会改用TCP重试
+	if udp && len(out) > udpSize(query) {
+		resp.Truncated = true
+		resp.Answers, resp.Authorities, resp.Additionals = nil, nil, nil
+		if out, err = resp.Pack(); err != nil {
+			return nil
+		}
+	}
+	return out
+}
+
+// udpSize returns the response size the client advertised with EDNS
+func udpSize(query *dnsmessage.Message) int {
+	for _, additional := range query.Additionals {
+		if additional.Header.Type == dnsmessage.TypeOPT && int(additional.Header.Class) > minUDPSize {
+			return int(additional.Header.Class)
+		}
+	}
+	return minUDPSize
+}
+
+func (d *DNSAdaptor) answer(query *dnsmessage.Message, client *common.AddrSpec, router *route.Router) *dnsmessage.Message {
+	resp := &dnsmessage.Message{Questions: query.Questions}
+	if len(query.Questions) != 1 {
+		resp.RCode = dnsmessage.RCodeFormatError
+		return resp
+	}
+	q := query.Questions[0]
+	domain := strings.TrimSuffix(strings.ToLower(q.Name.String()), ".")
+
+	metadata := &common.Metadata{
+		Inbound:    d.tag,
+		RemoteAddr: client,
+		DestAddr:   &common.AddrSpec{FQDN: domain},
+	}
+	// hosts中固定的地址优先于block规则，只按域名规则判断，不为IP规则解析域名
+	if _, blocked := router.RouteDomain(metadata).OutAdaptor.(*outbound.BlockOutAdaptor); blocked && !d.pinned(q) {
+		if d.conf.BlockResponse == BlockZero {
+			resp.Answers = addressAnswers(q, []netip.Addr{netip.IPv4Unspecified(), netip.IPv6Unspecified()})
+		} else {
+			resp.RCode = dnsmessage.RCodeNameError
+		}
+		return resp
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	answered, err := d.resolver.Exchange(ctx, query)
+	if err != nil {
+		log.Println(err)
+		resp.RCode = dnsmessage.RCodeServerFailure
+		return resp
+	}
+	return answered
+}
+
+// pinned reports whether the address query q is answered by the hosts
+func (d *DNSAdaptor) pinned(q dnsmessage.Question) bool {
+	if q.Type != dnsmessage.TypeA && q.Type != dnsmessage.TypeAAAA {
+		return false
+	}
+	_, _, ok := d.resolver.Hosts().Lookup(q.Name.String())
+	return ok
+}
+
+// addressAnswers returns the addresses matching the type of q
+func addressAnswers(q dnsmessage.Question, addrs []netip.Addr) []dnsmessage.Resource {
+	var answers []dnsmessage.Resource
+	header := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET, TTL: blockTTL}
+	for _, addr := range addrs {
+		if q.Type == dnsmessage.TypeA && addr.Is4() {
+			answers = append(answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AResource{A: addr.As4()}})
+		} else if q.Type == dnsmessage.TypeAAAA && addr.Is6() {
+			answers = append(answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AAAAResource{AAAA: addr.As16()}})
+		}
+	}
+	return answers
+}
@@ -0,0 +1,165 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/ido2021/light-proxy/adaptor/outbound"
+	"github.com/ido2021/light-proxy/common"
+	dns2 "github.com/ido2021/light-proxy/dns"
+	"github.com/ido2021/light-proxy/route"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// staticOutAdaptor resolves every domain to 192.0.2.1
+type staticOutAdaptor struct {
+	outbound.DirectOutAdaptor
+}
+
+func (s *staticOutAdaptor) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return []string{"192.0.2.1"}, nil
+}
+
+func newTestAdaptor(t *testing.T, config string) (*DNSAdaptor, *route.Router) {
+	adaptor, err := NewDNSAdaptor("dns-in", json.RawMessage(config))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	outAdaptors := map[string]*outbound.WrapperOutAdaptor{
+		outbound.Direct: outbound.NewWrapperOutAdaptor(&staticOutAdaptor{}),
+		outbound.Block:  outbound.NewWrapperOutAdaptor(&outbound.BlockOutAdaptor{}),
+	}
+	router, err := route.NewRouter(common.Route{Rules: []common.Rule{
+		{DomainSuffix: []string{"ads.example.com"}, Outbound: outbound.Block},
+		{Inbound: []string{"dns-in"}, DomainSuffix: []string{"tracker.example.com"}, Outbound: outbound.Block},
+		// 查询不解析域名匹配IP规则
+		{IPCidr: []string{"192.0.2.0/24"}, Outbound: outbound.Block},
+	}}, outAdaptors)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	hosts, err := dns2.NewHosts(map[string][]string{
+		"NAS.lan":                {"192.168.1.2", "fd00::2"},
+		"pinned.ads.example.com": {"192.168.1.3"},
+	}, "")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resolver := dns2.NewLocalResolver(outAdaptors[outbound.Direct], common.DNSCache{})
+	resolver.SetHosts(hosts)
+	d := adaptor.(*DNSAdaptor)
+	d.SetResolver(resolver)
+	return d, router
+}
+
+func packQuery(t *testing.T, name string, qtype dnsmessage.Type) []byte {
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 0x1234, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	b, err := query.Pack()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return b
+}
+
+func unpackResponse(t *testing.T, b []byte) *dnsmessage.Message {
+	resp := &dnsmessage.Message{}
+	if err := resp.Unpack(b); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp.ID != 0x1234 || !resp.Response {
+		t.Fatalf("bad header: %+v", resp.Header)
+	}
+	return resp
+}
+
+func answerIPs(resp *dnsmessage.Message) []string {
+	var ips []string
+	for _, answer := range resp.Answers {
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(body.A[:]).String())
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(body.AAAA[:]).String())
+		}
+	}
+	return ips
+}
+
+func TestDNSAdaptor(t *testing.T) {
+	d, router := newTestAdaptor(t, `{}`)
+
+	cases := []struct {
+		name     string
+		qtype    dnsmessage.Type
+		rcode    dnsmessage.RCode
+		expected []string
+	}{
+		{"nas.lan.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"192.168.1.2"}},
+		{"nas.lan.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, []string{"fd00::2"}},
+		{"www.example.com.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"192.0.2.1"}},
+		{"x.ads.example.com.", dnsmessage.TypeA, dnsmessage.RCodeNameError, nil},
+		// hosts优先于block规则
+		{"pinned.ads.example.com.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"192.168.1.3"}},
+		{"tracker.example.com.", dnsmessage.TypeAAAA, dnsmessage.RCodeNameError, nil},
+	}
+	for _, c := range cases {
+		resp := unpackResponse(t, d.handle(packQuery(t, c.name, c.qtype), nil, router, true))
+		ips := answerIPs(resp)
+		if resp.RCode != c.rcode || len(ips) != len(c.expected) || (len(ips) > 0 && ips[0] != c.expected[0]) {
+			t.Fatalf("%s: bad: %v %v", c.name, resp.RCode, ips)
+		}
+	}
+
+	if d.handle([]byte{1, 2, 3}, nil, router, true) != nil {
+		t.Fatal("expect malformed query to be dropped")
+	}
+}
+
+func TestDNSAdaptor_BlockZero(t *testing.T) {
+	d, router := newTestAdaptor(t, `{"blockResponse": "zero"}`)
+	resp := unpackResponse(t, d.handle(packQuery(t, "ads.example.com.", dnsmessage.TypeA), nil, router, true))
+	if ips := answerIPs(resp); resp.RCode != dnsmessage.RCodeSuccess || len(ips) != 1 || ips[0] != "0.0.0.0" {
+		t.Fatalf("bad: %v %v", resp.RCode, ips)
+	}
+	resp = unpackResponse(t, d.handle(packQuery(t, "ads.example.com.", dnsmessage.TypeAAAA), nil, router, true))
+	if ips := answerIPs(resp); len(ips) != 1 || ips[0] != "::" {
+		t.Fatalf("bad: %v", ips)
+	}
+
+	if _, err := NewDNSAdaptor("dns-in", json.RawMessage(`{"blockResponse": "refused"}`)); err == nil {
+		t.Fatal("expect error")
+	}
+}
+
+func TestDNSAdaptor_TCP(t *testing.T) {
+	d, router := newTestAdaptor(t, `{}`)
+	client, server := net.Pipe()
+	defer client.Close()
+	go d.serveConn(server, router)
+
+	// 同一连接上的多个查询
+	for i := 0; i < 2; i++ {
+		b := packQuery(t, "www.example.com.", dnsmessage.TypeA)
+		if _, err := client.Write(append([]byte{byte(len(b) >> 8), byte(len(b))}, b...)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(client, header); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		b = make([]byte, binary.BigEndian.Uint16(header))
+		if _, err := io.ReadFull(client, b); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if ips := answerIPs(unpackResponse(t, b)); len(ips) != 1 || ips[0] != "192.0.2.1" {
+			t.Fatalf("bad: %v", ips)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package http
+
+import (
+	"log"
+	"net/http"
+	"sync"
+)
+
+// maxAuthCacheSize bounds the verified-credential cache, the cache is reset
+// when it grows beyond this size
+const maxAuthCacheSize = 1024
+
+type authResult struct {
+	user   string
+	authed bool
+}
+
+// authCache caches the result of verifying a base64-encoded credential
+type authCache struct {
+	mu      sync.RWMutex
+	results map[string]authResult
+}
+
+func newAuthCache() *authCache {
+	return &authCache{results: map[string]authResult{}}
+}
+
+func (c *authCache) Get(credential string) (authResult, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	result, exist := c.results[credential]
+	return result, exist
+}
+
+func (c *authCache) Set(credential string, result authResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.results) >= maxAuthCacheSize {
+		c.results = map[string]authResult{}
+	}
+	c.results[credential] = result
+}
+
+// authenticate checks the Proxy-Authorization header, returns the user if the
+// request is authenticated or the response to send back otherwise
+func (h *HttpAdaptor) authenticate(request *http.Request) (string, *http.Response) {
+	credential := parseBasicProxyAuthorization(request)
+	if credential == "" {
+		resp := responseWith(request, http.StatusProxyAuthRequired)
+		resp.Header.Set("Proxy-Authenticate", "Basic")
+		return "", resp
+	}
+
+	result, exist := h.authCache.Get(credential)
+	if !exist {
+		user, pass, err := decodeBasicProxyAuthorization(credential)
+		result = authResult{user: user, authed: err == nil && h.verify(user, pass)}
+		h.authCache.Set(credential, result)
+	}
+	if !result.authed {
+		log.Printf("Auth failed from %s\n", request.RemoteAddr)
+
+		return "", responseWith(request, http.StatusForbidden)
+	}
+
+	return result.user, nil
+}
+
+// verify checks the user and password against the configured users
+func (h *HttpAdaptor) verify(user, pass string) bool {
+	expected, exist := h.credentials[user]
+	return exist && expected == pass
+}
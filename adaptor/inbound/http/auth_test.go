@@ -0,0 +1,93 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ido2021/light-proxy/adaptor/outbound"
+	"github.com/ido2021/light-proxy/common"
+	"github.com/ido2021/light-proxy/route"
+)
+
+func startTestServer(t *testing.T, config string) string {
+	router, err := route.NewRouter(common.Route{Final: outbound.Direct}, map[string]*outbound.WrapperOutAdaptor{
+		outbound.Direct: outbound.NewWrapperOutAdaptor(&outbound.DirectOutAdaptor{}),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	adaptor, err := NewHttpAdaptor("test", json.RawMessage(config))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	h := adaptor.(*HttpAdaptor)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		h.HandleConn(context.Background(), conn, router)
+	}()
+	return l.Addr().String()
+}
+
+func connect(t *testing.T, conn net.Conn, r *bufio.Reader, target, auth string) *http.Response {
+	req := "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\nProxy-Connection: keep-alive\r\n"
+	if auth != "" {
+		req += "Proxy-Authorization: Basic " + auth + "\r\n"
+	}
+	if _, err := io.WriteString(conn, req+"\r\n"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return resp
+}
+
+func TestProxyAuth(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer target.Close()
+
+	conn, err := net.Dial("tcp", startTestServer(t, `{"users": [{"user_name": "foo", "password": "bar"}]}`))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	r := bufio.NewReader(conn)
+
+	resp := connect(t, conn, r, target.Addr().String(), "")
+	if resp.StatusCode != http.StatusProxyAuthRequired || resp.Header.Get("Proxy-Authenticate") != "Basic" {
+		t.Fatalf("bad: %v %v", resp.StatusCode, resp.Header)
+	}
+
+	// foo:baz
+	resp = connect(t, conn, r, target.Addr().String(), "Zm9vOmJheg==")
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("bad: %v", resp.StatusCode)
+	}
+
+	// foo:bar on the same keep-alive connection
+	resp = connect(t, conn, r, target.Addr().String(), "Zm9vOmJhcg==")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("bad: %v", resp.StatusCode)
+	}
+}
@@ -8,7 +8,9 @@ import (
 	"github.com/ido2021/light-proxy/adaptor/inbound"
 	common2 "github.com/ido2021/light-proxy/adaptor/inbound/common"
 	"github.com/ido2021/light-proxy/common"
+	"github.com/ido2021/light-proxy/common/sniff"
 	"github.com/ido2021/light-proxy/route"
+	"io"
 	"log"
 	"net"
 	"net/http"
@@ -22,21 +24,32 @@ func init() {
 type HttpConfig struct {
 	Address string          `json:"address"`
 	Users   []*common2.User `json:"users,omitempty"`
+	common2.SniffConfig
 }
 
 type HttpAdaptor struct {
-	conf     *HttpConfig
-	listener net.Listener
+	tag         string
+	conf        *HttpConfig
+	listener    net.Listener
+	credentials map[string]string
+	authCache   *authCache
 }
 
-func NewHttpAdaptor(config json.RawMessage) (inbound.InAdaptor, error) {
+func NewHttpAdaptor(tag string, config json.RawMessage) (inbound.InAdaptor, error) {
 	conf := &HttpConfig{}
 	err := json.Unmarshal(config, conf)
 	if err != nil {
 		return nil, err
 	}
+	credentials := map[string]string{}
+	for _, user := range conf.Users {
+		credentials[user.UserName] = user.Password
+	}
 	return &HttpAdaptor{
-		conf: conf,
+		tag:         tag,
+		conf:        conf,
+		credentials: credentials,
+		authCache:   newAuthCache(),
 	}, nil
 }
 
@@ -75,7 +88,8 @@ func (h *HttpAdaptor) HandleConn(ctx context.Context, conn net.Conn, router *rou
 	}()
 
 	keepAlive := true
-	trusted := true // disable authenticate if cache is nil
+	trusted := len(h.credentials) == 0 // disable authenticate if no users configured
+	var user string
 
 	bufConn := common.NewBufferedConn(conn)
 	for keepAlive {
@@ -92,30 +106,41 @@ func (h *HttpAdaptor) HandleConn(ctx context.Context, conn net.Conn, router *rou
 		var resp *http.Response
 
 		if !trusted {
-			resp = authenticate(request)
+			user, resp = h.authenticate(request)
 
 			trusted = resp == nil
 		}
 
-		remoteAddr := conn.RemoteAddr().(*net.TCPAddr)
-		metadata := &common.Metadata{
-			RemoteAddr: &common.AddrSpec{IP: remoteAddr.IP, Port: remoteAddr.Port},
-			DestAddr:   parseHTTPAddr(request),
-		}
+		if trusted {
+			remoteAddr := conn.RemoteAddr().(*net.TCPAddr)
+			metadata := &common.Metadata{
+				Inbound:    h.tag,
+				User:       user,
+				RemoteAddr: &common.AddrSpec{IP: remoteAddr.IP, Port: remoteAddr.Port},
+				DestAddr:   parseHTTPAddr(request),
+			}
 
-		outAdaptor := router.Route(metadata)
-		if metadata.DestAddr.IP == nil {
-			ip, err := outAdaptor.Resolve(ctx, metadata.DestAddr.FQDN)
-			if err != nil {
+			// 嗅探需要客户端先发送数据，先回复隧道已建立
+			replied := false
+			if request.Method == http.MethodConnect && h.conf.Sniff {
+				if err := writeConnectEstablished(bufConn, request); err != nil {
+					log.Println(err)
+					break // close connection
+				}
+				replied = true
+				sniff.Conn(bufConn, metadata, h.conf.SniffOverrideDestination, h.conf.Timeout())
+			}
+
+			outAdaptor := router.Route(metadata)
+			if err := outAdaptor.ResolveDest(ctx, metadata.DestAddr); err != nil {
 				log.Println(err)
-				resp = responseWith(request, http.StatusBadGateway)
-				err = resp.Write(bufConn)
+				if !replied {
+					resp = responseWith(request, http.StatusBadGateway)
+					err = resp.Write(bufConn)
+				}
 				return
 			}
-			metadata.DestAddr.IP = ip
-		}
 
-		if trusted {
 			// Attempt to connect
 			target, err := outAdaptor.Dial(ctx, "tcp", metadata.DestAddr.Address())
 			if err != nil {
@@ -125,14 +150,15 @@ func (h *HttpAdaptor) HandleConn(ctx context.Context, conn net.Conn, router *rou
 
 			// 隧道代理
 			if request.Method == http.MethodConnect {
-				// Manual writing to support CONNECT for http 1.0 (workaround for uplay client)
-				if _, err = fmt.Fprintf(bufConn, "HTTP/%d.%d %03d %s\r\n\r\n", request.ProtoMajor, request.ProtoMinor, http.StatusOK, "Connection established"); err != nil {
-					log.Println(err)
-					break // close connection
+				if !replied {
+					if err := writeConnectEstablished(bufConn, request); err != nil {
+						log.Println(err)
+						break // close connection
+					}
 				}
 
-				// 无脑转发
-				common.Relay(target, conn)
+				// 无脑转发，客户端已发送的数据可能在缓冲区中
+				common.Relay(target, bufConn)
 				return
 			}
 
@@ -183,30 +209,11 @@ func (h *HttpAdaptor) HandleConn(ctx context.Context, conn net.Conn, router *rou
 	}
 }
 
-func authenticate(request *http.Request) *http.Response {
-	/*	authenticator := authStore.Authenticator()
-		if authenticator != nil {
-			credential := parseBasicProxyAuthorization(request)
-			if credential == "" {
-				resp := responseWith(request, http.StatusProxyAuthRequired)
-				resp.Header.Set("Outbound-Authenticate", "Basic")
-				return resp
-			}
-
-			authed, exist := cache.Get(credential)
-			if !exist {
-				user, pass, err := decodeBasicProxyAuthorization(credential)
-				authed = err == nil && authenticator.Verify(user, pass)
-				cache.Set(credential, authed)
-			}
-			if !authed.(bool) {
-				log.Infoln("Auth failed from %s", request.RemoteAddr)
-
-				return responseWith(request, http.StatusForbidden)
-			}
-		}*/
-
-	return nil
+// writeConnectEstablished writes the response of a CONNECT request manually
+// to support CONNECT for http 1.0 (workaround for uplay client)
+func writeConnectEstablished(w io.Writer, request *http.Request) error {
+	_, err := fmt.Fprintf(w, "HTTP/%d.%d %03d %s\r\n\r\n", request.ProtoMajor, request.ProtoMinor, http.StatusOK, "Connection established")
+	return err
 }
 
 func responseWith(request *http.Request, statusCode int) *http.Response {
@@ -2,16 +2,20 @@ package inbound
 
 import (
 	"encoding/json"
+	"github.com/ido2021/light-proxy/dns"
 	"github.com/ido2021/light-proxy/route"
 )
 
 type Protocol string
 
 const (
-	HTTP   Protocol = "http"
-	SOCKS4 Protocol = "socks4"
-	SOCKS5 Protocol = "socks5"
-	MIXED  Protocol = "mixed"
+	HTTP        Protocol = "http"
+	SOCKS4      Protocol = "socks4"
+	SOCKS5      Protocol = "socks5"
+	MIXED       Protocol = "mixed"
+	DNS         Protocol = "dns"
+	SHADOWSOCKS Protocol = "shadowsocks"
+	TROJAN      Protocol = "trojan"
 )
 
 type InAdaptor interface {
@@ -19,7 +23,15 @@ type InAdaptor interface {
 	Stop() error
 }
 
-type Factory func(config json.RawMessage) (InAdaptor, error)
+// DNSInAdaptor is an inbound answering DNS queries, the server sets its resolver
+// before starting it
+type DNSInAdaptor interface {
+	InAdaptor
+	SetResolver(resolver *dns.Resolver)
+}
+
+// Factory creates an inbound, tag identifies the inbound in routing rules
+type Factory func(tag string, config json.RawMessage) (InAdaptor, error)
 
 var inAdaptorFactories = map[Protocol]Factory{}
 
@@ -22,31 +22,38 @@ func init() {
 type MixedConfig struct {
 	Address string          `json:"address"`
 	Users   []*common2.User `json:"users,omitempty"`
+	common2.SniffConfig
 }
 
 type MixedAdaptor struct {
 	conf     *MixedConfig
 	listener net.Listener
+	socks4   *socks.Socks4InAdaptor
 	socks5   *socks.Socks5InAdaptor
 	http     *http.HttpAdaptor
 }
 
-func NewMixedAdaptor(config json.RawMessage) (inbound.InAdaptor, error) {
+func NewMixedAdaptor(tag string, config json.RawMessage) (inbound.InAdaptor, error) {
 	conf := &MixedConfig{}
 	err := json.Unmarshal(config, conf)
 	if err != nil {
 		return nil, err
 	}
-	socks5, err := socks.NewSocks5Adaptor(config)
+	socks4, err := socks.NewSocks4Adaptor(tag, config)
 	if err != nil {
 		return nil, err
 	}
-	h, err := http.NewHttpAdaptor(config)
+	socks5, err := socks.NewSocks5Adaptor(tag, config)
+	if err != nil {
+		return nil, err
+	}
+	h, err := http.NewHttpAdaptor(tag, config)
 	if err != nil {
 		return nil, err
 	}
 	return &MixedAdaptor{
 		conf:   conf,
+		socks4: socks4.(*socks.Socks4InAdaptor),
 		socks5: socks5.(*socks.Socks5InAdaptor),
 		http:   h.(*http.HttpAdaptor),
 	}, nil
@@ -100,7 +107,7 @@ func (mixed *MixedAdaptor) handleConn(ctx context.Context, conn net.Conn, router
 
 	switch version[0] {
 	case socks.Socks4Version:
-		mixed.socks5.HandleConn(ctx, bufConn, router)
+		mixed.socks4.HandleConn(ctx, bufConn, router)
 	case socks.Socks5Version:
 		mixed.socks5.HandleConn(ctx, bufConn, router)
 	default:
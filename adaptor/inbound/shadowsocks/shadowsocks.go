@@ -0,0 +1,173 @@
+// Package shadowsocks is an inbound serving Shadowsocks clients with the AEAD
+// or the 2022 ciphers, TCP and UDP on the same address. Every user has its
+// own key, the user of a session is found by trial decryption.
+package shadowsocks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ido2021/light-proxy/adaptor/inbound"
+	common2 "github.com/ido2021/light-proxy/adaptor/inbound/common"
+	"github.com/ido2021/light-proxy/common"
+	"github.com/ido2021/light-proxy/common/shadowsocks"
+	"github.com/ido2021/light-proxy/common/sniff"
+	"github.com/ido2021/light-proxy/route"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// handshakeTimeout bounds reading the request header
+const handshakeTimeout = 10 * time.Second
+
+func init() {
+	inbound.RegisterInAdaptorFactory(inbound.SHADOWSOCKS, NewShadowsocksAdaptor)
+}
+
+type ShadowsocksConfig struct {
+	Address string `json:"address"`
+	// Method 加密方式，所有用户相同
+	Method string `json:"method"`
+	// Password 未配置users时的密码，2022加密方式为base64编码的密钥
+	Password string `json:"password,omitempty"`
+	// Users 多用户，每个用户使用自己的密码
+	Users []*common2.User `json:"users,omitempty"`
+	common2.SniffConfig
+}
+
+type ShadowsocksAdaptor struct {
+	tag     string
+	conf    *ShadowsocksConfig
+	methods []*shadowsocks.Method
+	// users 与methods一一对应，匿名时为空字符串
+	users  []string
+	filter *shadowsocks.SaltFilter
+
+	mu         sync.Mutex
+	listener   net.Listener
+	packetConn net.PacketConn
+}
+
+func NewShadowsocksAdaptor(tag string, config json.RawMessage) (inbound.InAdaptor, error) {
+	conf := &ShadowsocksConfig{}
+	err := json.Unmarshal(config, conf)
+	if err != nil {
+		return nil, err
+	}
+	users := conf.Users
+	if len(users) == 0 {
+		users = []*common2.User{{Password: conf.Password}}
+	}
+
+	adaptor := &ShadowsocksAdaptor{tag: tag, conf: conf}
+	for _, user := range users {
+		method, err := shadowsocks.NewMethod(conf.Method, user.Password)
+		if err != nil {
+			return nil, fmt.Errorf("shadowsocks user %q: %w", user.UserName, err)
+		}
+		adaptor.methods = append(adaptor.methods, method)
+		adaptor.users = append(adaptor.users, user.UserName)
+	}
+	adaptor.filter = shadowsocks.NewSaltFilter(adaptor.methods[0])
+	return adaptor, nil
+}
+
+func (s *ShadowsocksAdaptor) Start(router *route.Router) error {
+	l, err := net.Listen("tcp", s.conf.Address)
+	if err != nil {
+		return err
+	}
+	packetConn, err := net.ListenPacket("udp", s.conf.Address)
+	if err != nil {
+		l.Close()
+		return err
+	}
+	s.mu.Lock()
+	s.listener = l
+	s.packetConn = packetConn
+	s.mu.Unlock()
+
+	go newUDPServer(s, packetConn, router).serve()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			// 监听关闭了，退出
+			if errors.Is(err, net.ErrClosed) {
+				break
+			}
+			log.Println("获取连接异常：", err)
+			continue
+		}
+		go s.HandleConn(context.Background(), conn, router)
+	}
+	return nil
+}
+
+func (s *ShadowsocksAdaptor) Stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	s.packetConn.Close()
+	return s.listener.Close()
+}
+
+// authContext returns the authentication state of the user of method i
+func (s *ShadowsocksAdaptor) authContext(i int) *common.AuthContext {
+	if s.users[i] == "" {
+		return nil
+	}
+	return &common.AuthContext{Payload: map[string]string{"Username": s.users[i]}}
+}
+
+func (s *ShadowsocksAdaptor) HandleConn(ctx context.Context, conn net.Conn, router *route.Router) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	ssConn, i, err := shadowsocks.Accept(conn, s.methods, s.filter)
+	if err != nil {
+		// 认证失败时读到对端关闭，不暴露服务器的行为
+		log.Println("shadowsocks:", conn.RemoteAddr(), err)
+		_, _ = io.Copy(io.Discard, conn)
+		return
+	}
+	dest, err := common.ReadAddrSpec(ssConn)
+	if err == nil {
+		err = ssConn.SkipPadding()
+	}
+	if err != nil {
+		log.Println("Failed to read destination address:", err)
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	metadata := &common.Metadata{
+		Inbound:  s.tag,
+		User:     s.authContext(i).Username(),
+		DestAddr: dest,
+	}
+	if client, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		metadata.RemoteAddr = &common.AddrSpec{IP: client.IP, Port: client.Port}
+	}
+	bufConn := common.NewBufferedConn(ssConn)
+	if s.conf.Sniff {
+		sniff.Conn(bufConn, metadata, s.conf.SniffOverrideDestination, s.conf.Timeout())
+	}
+
+	outAdaptor := router.Route(metadata)
+	if err := outAdaptor.ResolveDest(ctx, metadata.DestAddr); err != nil {
+		log.Printf("Failed to resolve destination %v: %v\n", metadata.DestAddr.FQDN, err)
+		return
+	}
+	target, err := outAdaptor.Dial(ctx, "tcp", metadata.DestAddr.Address())
+	if err != nil {
+		log.Printf("Connect to %v failed: %v\n", metadata.DestAddr, err)
+		return
+	}
+	defer target.Close()
+	common.Relay(target, bufConn)
+}
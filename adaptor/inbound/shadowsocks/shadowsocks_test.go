@@ -0,0 +1,187 @@
+package shadowsocks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/ido2021/light-proxy/adaptor/internal/testutil"
+	"github.com/ido2021/light-proxy/adaptor/outbound"
+	ssout "github.com/ido2021/light-proxy/adaptor/outbound/shadowsocks"
+	"github.com/ido2021/light-proxy/common/shadowsocks"
+)
+
+const (
+	aliceKey  = "AAECAwQFBgcICQoLDA0ODw=="
+	bobKey    = "DwAODQwLCgkIBwYFBAMCAQ=="
+	carolKey  = "AQEBAQEBAQEBAQEBAQEBAQ=="
+	aliceKey2 = "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8="
+)
+
+func newTestAdaptor(t *testing.T, config string) *ShadowsocksAdaptor {
+	adaptor, err := NewShadowsocksAdaptor("test", json.RawMessage(config))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return adaptor.(*ShadowsocksAdaptor)
+}
+
+// startServer serves the inbound on a TCP listener and a UDP socket of the
+// same address
+func startServer(t *testing.T, config string) string {
+	router := testutil.NewRouter(t)
+	ss := newTestAdaptor(t, config)
+
+	l := testutil.Serve(t, func(conn net.Conn) {
+		ss.HandleConn(context.Background(), conn, router)
+	})
+	packetConn, err := net.ListenPacket("udp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { packetConn.Close() })
+	go newUDPServer(ss, packetConn, router).serve()
+	return l.Addr().String()
+}
+
+func newOutAdaptor(t *testing.T, addr, method, password string) outbound.OutAdaptor {
+	config := &ssout.ShadowsocksConfig{Address: addr, Method: method, Password: password}
+	return testutil.NewOutAdaptor(t, ssout.NewShadowsocksOutAdaptor, config)
+}
+
+func TestShadowsocksAdaptor_TCP(t *testing.T) {
+	echo := testutil.EchoTCP(t)
+	for _, c := range []struct {
+		method, alice, bob, carol string
+	}{
+		{"aes-256-gcm", "alice", "bob", "carol"},
+		{"chacha20-ietf-poly1305", "alice", "bob", "carol"},
+		{"2022-blake3-aes-128-gcm", aliceKey, bobKey, carolKey},
+	} {
+		addr := startServer(t, `{"method": "`+c.method+`", "users": [
+			{"user_name": "alice", "password": "`+c.alice+`"},
+			{"user_name": "bob", "password": "`+c.bob+`"}]}`)
+
+		conn, err := newOutAdaptor(t, addr, c.method, c.alice).Dial(context.Background(), "tcp", echo.Addr().String())
+		if err != nil {
+			t.Fatalf("%s: err: %v", c.method, err)
+		}
+		if err := testutil.Ping(conn); err != nil {
+			t.Fatalf("%s: err: %v", c.method, err)
+		}
+		conn.Close()
+
+		// bob被路由到block，未知用户认证失败
+		for _, password := range []string{c.bob, c.carol} {
+			conn, err := newOutAdaptor(t, addr, c.method, password).Dial(context.Background(), "tcp", echo.Addr().String())
+			if err != nil {
+				t.Fatalf("%s: err: %v", c.method, err)
+			}
+			if err := testutil.Ping(conn); err == nil {
+				t.Fatalf("%s: expect error", c.method)
+			}
+			conn.Close()
+		}
+	}
+}
+
+func TestShadowsocksAdaptor_UDP(t *testing.T) {
+	echo := testutil.EchoUDP(t)
+	for _, c := range []struct {
+		method, password string
+	}{
+		{"aes-128-gcm", "foo"},
+		{"2022-blake3-aes-128-gcm", aliceKey},
+		{"2022-blake3-chacha20-poly1305", aliceKey2},
+	} {
+		addr := startServer(t, `{"method": "`+c.method+`", "password": "`+c.password+`"}`)
+		conn, err := newOutAdaptor(t, addr, c.method, c.password).ListenPacket(context.Background(), "udp4", "")
+		if err != nil {
+			t.Fatalf("%s: err: %v", c.method, err)
+		}
+		for i := 0; i < 2; i++ {
+			if err := testutil.PingPacket(conn, echo.LocalAddr()); err != nil {
+				t.Fatalf("%s: err: %v", c.method, err)
+			}
+		}
+		conn.Close()
+	}
+}
+
+func TestNewShadowsocksAdaptor(t *testing.T) {
+	for _, config := range []string{
+		`{"method": "rc4-md5", "password": "foo"}`,
+		`{"method": "2022-blake3-aes-128-gcm", "password": "foo"}`,
+		`{"method": "2022-blake3-aes-128-gcm", "users": [{"user_name": "alice", "password": "foo"}]}`,
+	} {
+		if _, err := NewShadowsocksAdaptor("test", json.RawMessage(config)); err == nil {
+			t.Fatalf("%s: expect error", config)
+		}
+	}
+}
+
+// TestUDPServer_Register checks that clients whose first packet is not relayed
+// are not kept
+func TestUDPServer_Register(t *testing.T) {
+	ss := newTestAdaptor(t, `{"method": "aes-128-gcm", "users": [
+		{"user_name": "alice", "password": "alice"},
+		{"user_name": "bob", "password": "bob"}]}`)
+	u := newUDPServer(ss, nil, testutil.NewRouter(t))
+	from := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10000}
+	addr := []byte{1, 127, 0, 0, 1, 0, 53}
+
+	for _, c := range []struct {
+		method  *shadowsocks.Method
+		address []byte
+	}{
+		// bob被路由到block
+		{ss.methods[1], addr},
+		// 错误的地址类型
+		{ss.methods[0], []byte{9, 127, 0, 0, 1, 0, 53}},
+	} {
+		session, _ := shadowsocks.NewUDPSession(c.method, true)
+		packet, _ := session.Pack(c.address, []byte("query"))
+		if err := u.handlePacket(packet, from); err == nil {
+			t.Fatal("expect error")
+		}
+		if len(u.clients) != 0 {
+			t.Fatalf("bad: %v", u.clients)
+		}
+	}
+}
+
+// TestUDPServer_Replay checks that a replayed packet is dropped
+func TestUDPServer_Replay(t *testing.T) {
+	// 不回复的目标，数据包只需发出
+	dest, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer dest.Close()
+	port := dest.LocalAddr().(*net.UDPAddr).Port
+	addr := []byte{1, 127, 0, 0, 1, byte(port >> 8), byte(port)}
+
+	for _, config := range []string{
+		`{"method": "aes-128-gcm", "password": "foo"}`,
+		`{"method": "2022-blake3-aes-128-gcm", "password": "` + aliceKey + `"}`,
+	} {
+		ss := newTestAdaptor(t, config)
+		u := newUDPServer(ss, nil, testutil.NewRouter(t))
+		from := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10000}
+		session, _ := shadowsocks.NewUDPSession(ss.methods[0], true)
+		packet, _ := session.Pack(addr, []byte("query"))
+		if err := u.handlePacket(packet, from); err != nil {
+			t.Fatalf("%s: err: %v", config, err)
+		}
+		if err := u.handlePacket(packet, from); !errors.Is(err, shadowsocks.ErrReplay) {
+			t.Fatalf("%s: bad: %v", config, err)
+		}
+		// 新客户端重放同样被拒绝
+		if err := u.handlePacket(packet, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10001}); err == nil {
+			t.Fatalf("%s: expect error", config)
+		}
+		u.closeAll()
+	}
+}
@@ -0,0 +1,230 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	common2 "github.com/ido2021/light-proxy/adaptor/inbound/common"
+	"github.com/ido2021/light-proxy/adaptor/outbound"
+	"github.com/ido2021/light-proxy/common"
+	"github.com/ido2021/light-proxy/common/shadowsocks"
+	"github.com/ido2021/light-proxy/common/sniff"
+	"github.com/ido2021/light-proxy/route"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// maxUDPPacketSize is the maximum size of a UDP datagram
+	maxUDPPacketSize = 64 * 1024
+	// udpTimeout closes the outbound packet conns idle for this long
+	udpTimeout = 2 * time.Minute
+)
+
+// outConnKey identifies an outbound packet conn of a client
+type outConnKey struct {
+	outAdaptor *outbound.WrapperOutAdaptor
+	network    string
+}
+
+// udpClient is the association of a client address, its packets are
+// decrypted with the key of the user found by the first one
+type udpClient struct {
+	addr     net.Addr
+	session  *shadowsocks.UDPSession
+	user     string
+	outConns map[outConnKey]net.PacketConn
+	// fakeAddrs 回复的来源使用客户端发送时的假地址
+	fakeAddrs common2.FakeAddrs
+}
+
+// udpServer relays the packets of the clients through the outbounds chosen
+// by the router
+type udpServer struct {
+	adaptor    *ShadowsocksAdaptor
+	packetConn net.PacketConn
+	router     *route.Router
+
+	mu      sync.Mutex
+	clients map[string]*udpClient
+}
+
+func newUDPServer(adaptor *ShadowsocksAdaptor, packetConn net.PacketConn, router *route.Router) *udpServer {
+	return &udpServer{
+		adaptor:    adaptor,
+		packetConn: packetConn,
+		router:     router,
+		clients:    map[string]*udpClient{},
+	}
+}
+
+func (u *udpServer) serve() {
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		n, from, err := u.packetConn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				u.closeAll()
+				return
+			}
+			log.Println(err)
+			continue
+		}
+		if err := u.handlePacket(buf[:n], from); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// client returns the association of from and the decrypted packet, a new
+// client tries the key of every user. A new client is registered with its
+// first outbound packet conn
+func (u *udpServer) client(packet []byte, from net.Addr) (*udpClient, []byte, error) {
+	u.mu.Lock()
+	client, exist := u.clients[from.String()]
+	u.mu.Unlock()
+	if exist {
+		plaintext, err := client.session.Unpack(packet)
+		return client, plaintext, err
+	}
+
+	for i, method := range u.adaptor.methods {
+		session, err := shadowsocks.NewUDPSession(method, false)
+		if err != nil {
+			return nil, nil, err
+		}
+		session.SetFilter(u.adaptor.filter)
+		plaintext, err := session.Unpack(packet)
+		if errors.Is(err, shadowsocks.ErrReplay) {
+			return nil, nil, err
+		}
+		if err != nil {
+			continue
+		}
+		client = &udpClient{
+			addr:     from,
+			session:  session,
+			user:     u.adaptor.authContext(i).Username(),
+			outConns: map[outConnKey]net.PacketConn{},
+		}
+		return client, plaintext, nil
+	}
+	return nil, nil, fmt.Errorf("shadowsocks: bad udp packet from %v", from)
+}
+
+func (u *udpServer) handlePacket(packet []byte, from net.Addr) error {
+	client, plaintext, err := u.client(packet, from)
+	if err != nil {
+		return err
+	}
+	r := bytes.NewReader(plaintext)
+	dest, err := common.ReadAddrSpec(r)
+	if err != nil {
+		return fmt.Errorf("Failed to read udp destination address: %v", err)
+	}
+	payload := plaintext[len(plaintext)-r.Len():]
+
+	metadata := &common.Metadata{
+		Inbound:  u.adaptor.tag,
+		User:     client.user,
+		DestAddr: dest,
+	}
+	if udpAddr, ok := from.(*net.UDPAddr); ok {
+		metadata.RemoteAddr = &common.AddrSpec{IP: udpAddr.IP, Port: udpAddr.Port}
+	}
+	if u.adaptor.conf.Sniff {
+		sniff.PacketMetadata(payload, metadata, u.adaptor.conf.SniffOverrideDestination)
+	}
+	outAdaptor := u.router.Route(metadata)
+	// 数据包需要目标IP，as_is时也在本地解析
+	if dest.FQDN != "" && dest.IP == nil {
+		ip, err := outAdaptor.Resolve(context.Background(), dest.FQDN)
+		if err != nil {
+			return fmt.Errorf("Failed to resolve udp destination %v: %v", dest.FQDN, err)
+		}
+		dest.IP = ip
+	}
+	client.fakeAddrs.Add(metadata)
+
+	network := "udp6"
+	if dest.IP.To4() != nil {
+		network = "udp4"
+	}
+	outConn, err := u.outConn(client, outAdaptor, network)
+	if err != nil {
+		return fmt.Errorf("Failed to listen packet on outbound: %v", err)
+	}
+	_, err = outConn.WriteTo(payload, &net.UDPAddr{IP: dest.IP, Port: dest.Port})
+	return err
+}
+
+// outConn returns the packet conn of the outbound for client, creating it on
+// first use
+func (u *udpServer) outConn(client *udpClient, outAdaptor *outbound.WrapperOutAdaptor, network string) (net.PacketConn, error) {
+	key := outConnKey{outAdaptor: outAdaptor, network: network}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if outConn, ok := client.outConns[key]; ok {
+		return outConn, nil
+	}
+	outConn, err := outAdaptor.ListenPacket(context.Background(), network, "")
+	if err != nil {
+		return nil, err
+	}
+	client.outConns[key] = outConn
+	u.clients[client.addr.String()] = client
+	go u.replyLoop(client, key, outConn)
+	return outConn, nil
+}
+
+// replyLoop sends the packets received by an outbound back to the client
+// until it is idle, the client is removed with its last outbound
+func (u *udpServer) replyLoop(client *udpClient, key outConnKey, outConn net.PacketConn) {
+	defer func() {
+		outConn.Close()
+		u.mu.Lock()
+		delete(client.outConns, key)
+		if len(client.outConns) == 0 && u.clients[client.addr.String()] == client {
+			delete(u.clients, client.addr.String())
+		}
+		u.mu.Unlock()
+	}()
+
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		_ = outConn.SetReadDeadline(time.Now().Add(udpTimeout))
+		n, from, err := outConn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		udpAddr, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		header, err := common.AppendAddrSpec(nil, client.fakeAddrs.ReplyAddr(udpAddr))
+		if err != nil {
+			continue
+		}
+		packet, err := client.session.Pack(header, buf[:n])
+		if err != nil {
+			continue
+		}
+		if _, err := u.packetConn.WriteTo(packet, client.addr); err != nil {
+			return
+		}
+	}
+}
+
+// closeAll closes the outbound packet conns of all clients
+func (u *udpServer) closeAll() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, client := range u.clients {
+		for _, outConn := range client.outConns {
+			_ = outConn.Close()
+		}
+	}
+}
@@ -39,7 +39,7 @@ func (a NoAuthAuthenticator) GetCode() uint8 {
 
 func (a NoAuthAuthenticator) Authenticate(conn net.Conn) (*common.AuthContext, error) {
 	_, err := conn.Write([]byte{Socks5Version, NoAuth})
-	return &common.AuthContext{NoAuth, nil}, err
+	return &common.AuthContext{Method: NoAuth}, err
 }
 
 // UserPassAuthenticator is used to handle username/password based
@@ -108,7 +108,7 @@ func (a UserPassAuthenticator) Authenticate(conn net.Conn) (*common.AuthContext,
 	}
 
 	// Done
-	return &common.AuthContext{UserPassAuth, map[string]string{"Username": user}}, nil
+	return &common.AuthContext{Method: UserPassAuth, Payload: map[string]string{"Username": user}}, nil
 }
 
 // noAcceptableAuth is used to handle when we have no eligible
@@ -1,116 +1,129 @@
 package socks
 
 import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
 	"testing"
+
+	"github.com/ido2021/light-proxy/common"
 )
 
+func newTestSocks5(t *testing.T, config string) *Socks5InAdaptor {
+	adaptor, err := NewSocks5Adaptor("test", json.RawMessage(config))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return adaptor.(*Socks5InAdaptor)
+}
+
+// authenticate runs the negotiation of s5 against the client bytes in req,
+// returns the auth context and everything the server sent back
+func authenticate(s5 *Socks5InAdaptor, req []byte) (*common.AuthContext, []byte, error) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	type result struct {
+		ctx *common.AuthContext
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		ctx, err := s5.authenticate(server)
+		server.Close()
+		done <- result{ctx, err}
+	}()
+
+	go client.Write(req)
+	out, _ := io.ReadAll(client)
+	r := <-done
+	return r.ctx, out, r.err
+}
+
 func TestNoAuth(t *testing.T) {
-	/*	req, resp := net.Pipe()
-		s := mixedproxy.New()
-		resp.Write([]byte{1, NoAuth})
-		ctx, err := s.socks5.authenticate(req)
-		if err != nil {
-			t.Fatalf("err: %v", err)
-		}
-
-		if ctx.Method != NoAuth {
-			t.Fatal("Invalid Context Method")
-		}
-		var out = []byte{0}
-		_, _ = resp.Read(out)
-		if !bytes.Equal(out, []byte{socks5Version, NoAuth}) {
-			t.Fatalf("bad: %v", out)
-		}*/
+	s5 := newTestSocks5(t, `{}`)
+
+	ctx, out, err := authenticate(s5, []byte{Socks5Version, 1, NoAuth})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if ctx.Method != NoAuth {
+		t.Fatal("Invalid Context Method")
+	}
+	if !bytes.Equal(out, []byte{Socks5Version, NoAuth}) {
+		t.Fatalf("bad: %v", out)
+	}
 }
 
 func TestPasswordAuth_Valid(t *testing.T) {
-	//req := bytes.NewBuffer(nil)
-	//req.Write([]byte{2, NoAuth, UserPassAuth})
-	//req.Write([]byte{1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r'})
-	//var resp bytes.Buffer
-	//
-	//cred := StaticCredentials{
-	//	"foo": "bar",
-	//}
-	//
-	//cator := UserPassAuthenticator{Credentials: cred}
-	//
-	//s := New(WithAuthMethods([]Authenticator{cator}))
-	//
-	//ctx, err := s.socks5.authenticate(&resp, req)
-	//if err != nil {
-	//	t.Fatalf("err: %v", err)
-	//}
-	//
-	//if ctx.Method != UserPassAuth {
-	//	t.Fatal("Invalid Context Method")
-	//}
-	//
-	//val, ok := ctx.Payload["Username"]
-	//if !ok {
-	//	t.Fatal("Missing key Username in auth context's payload")
-	//}
-	//
-	//if val != "foo" {
-	//	t.Fatal("Invalid Username in auth context's payload")
-	//}
-	//
-	//out := resp.Bytes()
-	//if !bytes.Equal(out, []byte{socks5Version, UserPassAuth, 1, authSuccess}) {
-	//	t.Fatalf("bad: %v", out)
-	//}
+	s5 := newTestSocks5(t, `{"users": [{"user_name": "foo", "password": "bar"}]}`)
+
+	req := []byte{Socks5Version, 2, NoAuth, UserPassAuth}
+	req = append(req, 1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r')
+	ctx, out, err := authenticate(s5, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if ctx.Method != UserPassAuth {
+		t.Fatal("Invalid Context Method")
+	}
+	if ctx.Username() != "foo" {
+		t.Fatal("Invalid Username in auth context's payload")
+	}
+	if !bytes.Equal(out, []byte{Socks5Version, UserPassAuth, 1, authSuccess}) {
+		t.Fatalf("bad: %v", out)
+	}
 }
 
 func TestPasswordAuth_Invalid(t *testing.T) {
-	//req := bytes.NewBuffer(nil)
-	//req.Write([]byte{2, NoAuth, UserPassAuth})
-	//req.Write([]byte{1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'z'})
-	//var resp bytes.Buffer
-	//
-	//cred := StaticCredentials{
-	//	"foo": "bar",
-	//}
-	//cator := UserPassAuthenticator{Credentials: cred}
-	//s := New(WithAuthMethods([]Authenticator{cator}))
-	//
-	//ctx, err := s.authenticate(&resp, req)
-	//if err != UserAuthFailed {
-	//	t.Fatalf("err: %v", err)
-	//}
-	//
-	//if ctx != nil {
-	//	t.Fatal("Invalid Context Method")
-	//}
-	//
-	//out := resp.Bytes()
-	//if !bytes.Equal(out, []byte{socks5Version, UserPassAuth, 1, authFailure}) {
-	//	t.Fatalf("bad: %v", out)
-	//}
+	s5 := newTestSocks5(t, `{"users": [{"user_name": "foo", "password": "bar"}]}`)
+
+	req := []byte{Socks5Version, 2, NoAuth, UserPassAuth}
+	req = append(req, 1, 3, 'f', 'o', 'o', 3, 'b', 'a', 'z')
+	ctx, out, err := authenticate(s5, req)
+	if err != UserAuthFailed {
+		t.Fatalf("err: %v", err)
+	}
+
+	if ctx != nil {
+		t.Fatal("Invalid Context Method")
+	}
+	if !bytes.Equal(out, []byte{Socks5Version, UserPassAuth, 1, authFailure}) {
+		t.Fatalf("bad: %v", out)
+	}
 }
 
 func TestNoSupportedAuth(t *testing.T) {
-	//req := bytes.NewBuffer(nil)
-	//req.Write([]byte{1, NoAuth})
-	//var resp bytes.Buffer
-	//
-	//cred := StaticCredentials{
-	//	"foo": "bar",
-	//}
-	//cator := UserPassAuthenticator{Credentials: cred}
-	//
-	//s := New(WithAuthMethods([]Authenticator{cator}))
-	//
-	//ctx, err := s.socks5.authenticate(&resp, req)
-	//if err != NoSupportedAuth {
-	//	t.Fatalf("err: %v", err)
-	//}
-	//
-	//if ctx != nil {
-	//	t.Fatal("Invalid Context Method")
-	//}
-	//
-	//out := resp.Bytes()
-	//if !bytes.Equal(out, []byte{socks5Version, noAcceptable}) {
-	//	t.Fatalf("bad: %v", out)
-	//}
+	s5 := newTestSocks5(t, `{"users": [{"user_name": "foo", "password": "bar"}]}`)
+
+	ctx, out, err := authenticate(s5, []byte{Socks5Version, 1, NoAuth})
+	if err != NoSupportedAuth {
+		t.Fatalf("err: %v", err)
+	}
+
+	if ctx != nil {
+		t.Fatal("Invalid Context Method")
+	}
+	if !bytes.Equal(out, []byte{Socks5Version, noAcceptable}) {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestAllowAnonymous(t *testing.T) {
+	s5 := newTestSocks5(t, `{"users": [{"user_name": "foo", "password": "bar"}], "allowAnonymous": true}`)
+
+	ctx, out, err := authenticate(s5, []byte{Socks5Version, 1, NoAuth})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if ctx.Method != NoAuth || ctx.Username() != "" {
+		t.Fatal("Invalid Context Method")
+	}
+	if !bytes.Equal(out, []byte{Socks5Version, NoAuth}) {
+		t.Fatalf("bad: %v", out)
+	}
 }
@@ -0,0 +1,115 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ido2021/light-proxy/adaptor/outbound"
+	"github.com/ido2021/light-proxy/common"
+	"github.com/ido2021/light-proxy/route"
+	"net"
+	"time"
+)
+
+// defaultBindTimeout is used when no bind timeout is configured
+const defaultBindTimeout = 60 * time.Second
+
+// handleBind is used to handle a bind command
+func (s5 *Socks5InAdaptor) handleBind(ctx context.Context, conn net.Conn, req *socksRequest, router *route.Router) error {
+	if !bindAllowed(s5.conf.BindUsers, req.auth) {
+		if err := sendReply(conn, ruleFailure, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return fmt.Errorf("Bind to %v blocked by rules", req.metadata.DestAddr)
+	}
+
+	outAdaptor := router.Route(req.metadata)
+	listener, err := outAdaptor.Listen(ctx, "tcp", "")
+	if err != nil {
+		resp := serverFailure
+		if errors.Is(err, outbound.ErrListenNotSupported) {
+			resp = commandNotSupported
+		}
+		if err := sendReply(conn, resp, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return fmt.Errorf("Bind for %v failed: %v", req.metadata.DestAddr, err)
+	}
+	defer listener.Close()
+
+	// First reply carries the address the peer should connect to
+	bind := tcpAddrSpec(listener.Addr())
+	if bind.IP.IsUnspecified() {
+		bind.IP = conn.LocalAddr().(*net.TCPAddr).IP
+	}
+	if err := sendReply(conn, successReply, bind); err != nil {
+		return fmt.Errorf("Failed to send reply: %v", err)
+	}
+
+	peer, err := acceptPeer(listener, req.metadata.DestAddr, bindTimeout(s5.conf.BindTimeout))
+	if err != nil {
+		if err := sendReply(conn, ttlExpired, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return fmt.Errorf("Bind for %v failed: %v", req.metadata.DestAddr, err)
+	}
+	defer peer.Close()
+	// 只接受一个对端连接
+	_ = listener.Close()
+
+	// Second reply carries the address of the connected peer
+	if err := sendReply(conn, successReply, tcpAddrSpec(peer.RemoteAddr())); err != nil {
+		return fmt.Errorf("Failed to send reply: %v", err)
+	}
+
+	common.Relay(peer, conn)
+	return nil
+}
+
+// bindAllowed checks the authenticated user against the bind allow-list
+func bindAllowed(bindUsers []string, auth *common.AuthContext) bool {
+	user := auth.Username()
+	for _, allowed := range bindUsers {
+		if allowed == "*" || (user != "" && allowed == user) {
+			return true
+		}
+	}
+	return false
+}
+
+// bindTimeout converts the configured bind timeout in seconds
+func bindTimeout(seconds int) time.Duration {
+	if seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultBindTimeout
+}
+
+// acceptPeer waits for the first connection coming from the expected peer
+func acceptPeer(listener net.Listener, expected *common.AddrSpec, timeout time.Duration) (net.Conn, error) {
+	timer := time.AfterFunc(timeout, func() {
+		_ = listener.Close()
+	})
+	defer timer.Stop()
+
+	for {
+		peer, err := listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		// DST.ADDR is the address of the expected peer, unspecified means any
+		if expected == nil || len(expected.IP) == 0 || expected.IP.IsUnspecified() ||
+			expected.IP.Equal(tcpAddrSpec(peer.RemoteAddr()).IP) {
+			return peer, nil
+		}
+		_ = peer.Close()
+	}
+}
+
+// tcpAddrSpec converts a net.Addr into an AddrSpec
+func tcpAddrSpec(addr net.Addr) *common.AddrSpec {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return &common.AddrSpec{IP: tcpAddr.IP, Port: tcpAddr.Port}
+	}
+	return &common.AddrSpec{IP: net.IPv4zero}
+}
@@ -0,0 +1,91 @@
+package socks
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ido2021/light-proxy/common"
+)
+
+func readReply(t *testing.T, conn net.Conn) (uint8, *net.TCPAddr) {
+	reply := make([]byte, 3)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	addr, err := common.ReadAddrSpec(conn)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return reply[1], &net.TCPAddr{IP: addr.IP, Port: addr.Port}
+}
+
+func TestSOCKS5_Bind(t *testing.T) {
+	addr := startTestServer(t, `{"bindUsers": ["*"], "bindTimeout": 1}`)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	conn.Write([]byte{Socks5Version, 1, NoAuth})
+	conn.Write([]byte{Socks5Version, BindCommand, 0, common.AtypIPv4, 0, 0, 0, 0, 0, 0})
+
+	out := make([]byte, 2)
+	if _, err := io.ReadFull(conn, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp, bind := readReply(t, conn)
+	if resp != successReply {
+		t.Fatalf("bad reply: %v", resp)
+	}
+
+	peer, err := net.Dial("tcp", bind.String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer peer.Close()
+
+	resp, remote := readReply(t, conn)
+	if resp != successReply {
+		t.Fatalf("bad reply: %v", resp)
+	}
+	if remote.Port != peer.LocalAddr().(*net.TCPAddr).Port {
+		t.Fatalf("bad peer address: %v", remote)
+	}
+
+	peer.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(buf, []byte("ping")) {
+		t.Fatalf("bad: %v", buf)
+	}
+}
+
+func TestSOCKS5_Bind_NotAllowed(t *testing.T) {
+	addr := startTestServer(t, `{}`)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	conn.Write([]byte{Socks5Version, 1, NoAuth})
+	conn.Write([]byte{Socks5Version, BindCommand, 0, common.AtypIPv4, 0, 0, 0, 0, 0, 0})
+
+	out := make([]byte, 2)
+	if _, err := io.ReadFull(conn, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp, _ := readReply(t, conn); resp != ruleFailure {
+		t.Fatalf("bad reply: %v", resp)
+	}
+}
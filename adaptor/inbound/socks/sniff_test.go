@@ -0,0 +1,88 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ido2021/light-proxy/adaptor/outbound"
+	"github.com/ido2021/light-proxy/common"
+	"github.com/ido2021/light-proxy/route"
+)
+
+// rejectOutAdaptor fails every dial
+type rejectOutAdaptor struct {
+	outbound.BlockOutAdaptor
+}
+
+func (r *rejectOutAdaptor) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	return nil, outbound.ErrBlocked
+}
+
+func TestSOCKS5_Sniff(t *testing.T) {
+	// 目标服务器回显收到的请求
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+	lAddr := l.Addr().(*net.TCPAddr)
+
+	// 只有嗅探到的域名走直连，其余连接失败
+	router, err := route.NewRouter(common.Route{
+		Rules: []common.Rule{{Domain: []string{"sniffed.test"}, Outbound: outbound.Direct}},
+		Final: outbound.Block,
+	}, map[string]*outbound.WrapperOutAdaptor{
+		outbound.Direct: outbound.NewWrapperOutAdaptor(&outbound.DirectOutAdaptor{}),
+		outbound.Block:  outbound.NewWrapperOutAdaptor(&rejectOutAdaptor{}),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	adaptor, err := NewSocks5Adaptor("test", json.RawMessage(`{"sniff": true}`))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	server, client := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		adaptor.(*Socks5InAdaptor).HandleConn(context.Background(), server, router)
+	}()
+	client.SetDeadline(time.Now().Add(time.Second))
+
+	req := []byte{Socks5Version, 1, NoAuth, Socks5Version, ConnectCommand, 0, common.AtypIPv4, 127, 0, 0, 1}
+	req = append(req, byte(lAddr.Port>>8), byte(lAddr.Port))
+	go client.Write(req)
+
+	// 嗅探前先回复成功
+	out := make([]byte, 2+10)
+	if _, err := io.ReadFull(client, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out, []byte{Socks5Version, NoAuth, Socks5Version, successReply, 0, common.AtypIPv4, 0, 0, 0, 0, 0, 0}) {
+		t.Fatalf("bad: %v", out)
+	}
+
+	request := []byte("GET / HTTP/1.1\r\nHost: sniffed.test\r\n\r\n")
+	go client.Write(request)
+	echo := make([]byte, len(request))
+	if _, err := io.ReadFull(client, echo); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(echo, request) {
+		t.Fatalf("bad: %s", echo)
+	}
+}
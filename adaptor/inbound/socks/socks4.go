@@ -1,11 +1,308 @@
 package socks
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/ido2021/light-proxy/adaptor/inbound"
+	common2 "github.com/ido2021/light-proxy/adaptor/inbound/common"
+	"github.com/ido2021/light-proxy/common"
+	"github.com/ido2021/light-proxy/common/sniff"
+	"github.com/ido2021/light-proxy/route"
+	"io"
+	"log"
+	"net"
 )
 
 const Socks4Version = 0x04
 
+// SOCKS4 reply codes, 0x5C is not used since identd is never queried
+const (
+	socks4Granted      uint8 = 0x5A
+	socks4Rejected     uint8 = 0x5B
+	socks4UserMismatch uint8 = 0x5D
+)
+
+// maxSocks4FieldLen is the maximum size of USERID and the SOCKS4a hostname
+const maxSocks4FieldLen = 255
+
+var (
+	socks4FieldTooLong = errors.New("socks4 field too long")
+)
+
 func init() {
-	inbound.RegisterInAdaptorFactory(inbound.SOCKS4, NewSocks5Adaptor)
+	inbound.RegisterInAdaptorFactory(inbound.SOCKS4, NewSocks4Adaptor)
+}
+
+type Socks4Config struct {
+	Address string `json:"address"`
+	// Users SOCKS4不携带密码，只有未设置密码的用户可以通过USERID认证
+	Users []*common2.User `json:"users,omitempty"`
+	// BindUsers 允许使用BIND命令的用户，"*"表示所有用户，为空时禁用BIND
+	BindUsers []string `json:"bindUsers,omitempty"`
+	// BindTimeout 等待对端连接的超时时间，单位秒
+	BindTimeout int `json:"bindTimeout,omitempty"`
+	common2.SniffConfig
+}
+
+type Socks4InAdaptor struct {
+	tag      string
+	conf     *Socks4Config
+	listener net.Listener
+}
+
+func NewSocks4Adaptor(tag string, config json.RawMessage) (inbound.InAdaptor, error) {
+	conf := &Socks4Config{}
+	err := json.Unmarshal(config, conf)
+	if err != nil {
+		return nil, err
+	}
+	return &Socks4InAdaptor{
+		tag:  tag,
+		conf: conf,
+	}, nil
+}
+
+func (s4 *Socks4InAdaptor) Stop() error {
+	return s4.listener.Close()
+}
+
+func (s4 *Socks4InAdaptor) Start(router *route.Router) error {
+	l, err := net.Listen("tcp", s4.conf.Address)
+	if err != nil {
+		return err
+	}
+	s4.listener = l
+	for {
+		conn, err := s4.listener.Accept()
+		if err != nil {
+			// 监听关闭了，退出
+			if errors.Is(err, net.ErrClosed) {
+				break
+			}
+			log.Println("获取连接异常：", err)
+			continue
+		}
+		ctx := context.Background()
+		go func() {
+			defer conn.Close()
+			s4.HandleConn(ctx, conn, router)
+		}()
+	}
+	return nil
+}
+
+func (s4 *Socks4InAdaptor) HandleConn(ctx context.Context, conn net.Conn, router *route.Router) {
+	bufConn := common.NewBufferedConn(conn)
+	request, err := s4.handshake(bufConn)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	switch request.cmd {
+	case ConnectCommand:
+		err = s4.handleConnect(ctx, bufConn, request.metadata, router)
+	case BindCommand:
+		err = s4.handleBind(ctx, bufConn, request, router)
+	default:
+		_ = sendSocks4Reply(bufConn, socks4Rejected, nil)
+		err = fmt.Errorf("unsupported command: %v", request.cmd)
+	}
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// handshake reads a SOCKS4 or SOCKS4a request:
+// VN CD DSTPORT DSTIP USERID NULL [HOSTNAME NULL]
+func (s4 *Socks4InAdaptor) handshake(conn *common.BufferedConn) (*socksRequest, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[0] != Socks4Version {
+		return nil, fmt.Errorf("unsupported socks version: %v", header[0])
+	}
+
+	userID, err := readNullTerminated(conn)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read userid: %v", err)
+	}
+
+	dest := &common.AddrSpec{
+		Port: int(binary.BigEndian.Uint16(header[2:4])),
+	}
+	ip := net.IP(header[4:8])
+	// SOCKS4a: 0.0.0.x with x != 0 means a hostname follows the USERID
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		fqdn, err := readNullTerminated(conn)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read destination hostname: %v", err)
+		}
+		dest.FQDN = fqdn
+	} else {
+		dest.IP = ip
+	}
+
+	auth, err := s4.authenticate(userID)
+	if err != nil {
+		_ = sendSocks4Reply(conn, socks4UserMismatch, nil)
+		return nil, fmt.Errorf("failed to authenticate: %v", err)
+	}
+
+	request := &socksRequest{
+		cmd: header[1],
+		metadata: &common.Metadata{
+			Inbound:  s4.tag,
+			User:     auth.Username(),
+			DestAddr: dest,
+		},
+		auth: auth,
+	}
+	if client, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		request.metadata.RemoteAddr = &common.AddrSpec{IP: client.IP, Port: client.Port}
+	}
+	return request, nil
+}
+
+// authenticate checks the USERID against the configured users
+func (s4 *Socks4InAdaptor) authenticate(userID string) (*common.AuthContext, error) {
+	if len(s4.conf.Users) == 0 {
+		return &common.AuthContext{Method: NoAuth}, nil
+	}
+	for _, user := range s4.conf.Users {
+		if user.UserName == userID && user.Password == "" {
+			return &common.AuthContext{Method: NoAuth, Payload: map[string]string{"Username": userID}}, nil
+		}
+	}
+	return nil, UserAuthFailed
+}
+
+// handleConnect is used to handle a connect command
+func (s4 *Socks4InAdaptor) handleConnect(ctx context.Context, conn *common.BufferedConn, metadata *common.Metadata, router *route.Router) error {
+	// 嗅探需要客户端先发送数据，先回复成功，之后连接失败时直接关闭连接
+	replied := s4.conf.Sniff
+	if replied {
+		if err := sendSocks4Reply(conn, socks4Granted, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		sniff.Conn(conn, metadata, s4.conf.SniffOverrideDestination, s4.conf.Timeout())
+	}
+
+	outAdaptor := router.Route(metadata)
+	// Resolve the address if we have a FQDN, depending on the domain strategy
+	dest := metadata.DestAddr
+	if err := outAdaptor.ResolveDest(ctx, dest); err != nil {
+		if replied {
+			return fmt.Errorf("Failed to resolve destination %v: %v", dest.FQDN, err)
+		}
+		if err := sendSocks4Reply(conn, socks4Rejected, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return fmt.Errorf("Failed to resolve destination %v: %v", dest.FQDN, err)
+	}
+
+	target, err := outAdaptor.Dial(ctx, "tcp", dest.Address())
+	if err != nil {
+		if replied {
+			return fmt.Errorf("Connect to %v failed: %v", metadata.DestAddr, err)
+		}
+		if err := sendSocks4Reply(conn, socks4Rejected, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return fmt.Errorf("Connect to %v failed: %v", metadata.DestAddr, err)
+	}
+	defer target.Close()
+
+	if !replied {
+		if err := sendSocks4Reply(conn, socks4Granted, tcpAddrSpec(target.LocalAddr())); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+	}
+
+	common.Relay(target, conn)
+	return nil
+}
+
+// handleBind is used to handle a bind command
+func (s4 *Socks4InAdaptor) handleBind(ctx context.Context, conn net.Conn, req *socksRequest, router *route.Router) error {
+	if !bindAllowed(s4.conf.BindUsers, req.auth) {
+		if err := sendSocks4Reply(conn, socks4Rejected, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return fmt.Errorf("Bind to %v blocked by rules", req.metadata.DestAddr)
+	}
+
+	outAdaptor := router.Route(req.metadata)
+	listener, err := outAdaptor.Listen(ctx, "tcp4", "")
+	if err != nil {
+		if err := sendSocks4Reply(conn, socks4Rejected, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return fmt.Errorf("Bind for %v failed: %v", req.metadata.DestAddr, err)
+	}
+	defer listener.Close()
+
+	bind := tcpAddrSpec(listener.Addr())
+	if bind.IP.IsUnspecified() {
+		bind.IP = conn.LocalAddr().(*net.TCPAddr).IP
+	}
+	if err := sendSocks4Reply(conn, socks4Granted, bind); err != nil {
+		return fmt.Errorf("Failed to send reply: %v", err)
+	}
+
+	peer, err := acceptPeer(listener, req.metadata.DestAddr, bindTimeout(s4.conf.BindTimeout))
+	if err != nil {
+		if err := sendSocks4Reply(conn, socks4Rejected, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return fmt.Errorf("Bind for %v failed: %v", req.metadata.DestAddr, err)
+	}
+	defer peer.Close()
+	// 只接受一个对端连接
+	_ = listener.Close()
+
+	if err := sendSocks4Reply(conn, socks4Granted, tcpAddrSpec(peer.RemoteAddr())); err != nil {
+		return fmt.Errorf("Failed to send reply: %v", err)
+	}
+
+	common.Relay(peer, conn)
+	return nil
+}
+
+// readNullTerminated reads a NULL terminated string
+func readNullTerminated(conn *common.BufferedConn) (string, error) {
+	var buf bytes.Buffer
+	for {
+		b, err := conn.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b == 0 {
+			return buf.String(), nil
+		}
+		if buf.Len() >= maxSocks4FieldLen {
+			return "", socks4FieldTooLong
+		}
+		buf.WriteByte(b)
+	}
+}
+
+// sendSocks4Reply is used to send a reply message: VN CD DSTPORT DSTIP.
+// Only IPv4 addresses can be carried, anything else is sent as 0.0.0.0:0
+func sendSocks4Reply(w io.Writer, resp uint8, addr *common.AddrSpec) error {
+	msg := make([]byte, 8)
+	msg[1] = resp
+	if addr != nil {
+		if ip := addr.IP.To4(); ip != nil {
+			binary.BigEndian.PutUint16(msg[2:4], uint16(addr.Port))
+			copy(msg[4:], ip)
+		}
+	}
+	_, err := w.Write(msg)
+	return err
 }
@@ -0,0 +1,141 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ido2021/light-proxy/adaptor/outbound"
+	"github.com/ido2021/light-proxy/common"
+	"github.com/ido2021/light-proxy/route"
+)
+
+// startTestSocks4Server serves a single socks4 connection routed to direct
+func startTestSocks4Server(t *testing.T, config string) string {
+	router, err := route.NewRouter(common.Route{Final: outbound.Direct}, map[string]*outbound.WrapperOutAdaptor{
+		outbound.Direct: outbound.NewWrapperOutAdaptor(&outbound.DirectOutAdaptor{}),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	adaptor, err := NewSocks4Adaptor("test", json.RawMessage(config))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	s4 := adaptor.(*Socks4InAdaptor)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		s4.HandleConn(context.Background(), conn, router)
+	}()
+	return l.Addr().String()
+}
+
+func startPongServer(t *testing.T) *net.TCPAddr {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		if bytes.Equal(buf, []byte("ping")) {
+			conn.Write([]byte("pong"))
+		}
+	}()
+	return l.Addr().(*net.TCPAddr)
+}
+
+func TestSOCKS4_Connect(t *testing.T) {
+	target := startPongServer(t)
+	conn, err := net.Dial("tcp", startTestSocks4Server(t, `{}`))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	req := []byte{Socks4Version, ConnectCommand, 0, 0, 127, 0, 0, 1}
+	binary.BigEndian.PutUint16(req[2:], uint16(target.Port))
+	req = append(req, "foo\x00ping"...)
+	conn.Write(req)
+
+	out := make([]byte, 12)
+	if _, err := io.ReadFull(conn, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out[0] != 0 || out[1] != socks4Granted {
+		t.Fatalf("bad reply: %v", out[:8])
+	}
+	if !bytes.Equal(out[8:], []byte("pong")) {
+		t.Fatalf("bad: %v", out[8:])
+	}
+}
+
+func TestSOCKS4a_Connect(t *testing.T) {
+	target := startPongServer(t)
+	conn, err := net.Dial("tcp", startTestSocks4Server(t, `{"users": [{"user_name": "foo"}]}`))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	req := []byte{Socks4Version, ConnectCommand, 0, 0, 0, 0, 0, 1}
+	binary.BigEndian.PutUint16(req[2:], uint16(target.Port))
+	req = append(req, "foo\x00127.0.0.1\x00ping"...)
+	conn.Write(req)
+
+	out := make([]byte, 12)
+	if _, err := io.ReadFull(conn, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out[1] != socks4Granted {
+		t.Fatalf("bad reply: %v", out[:8])
+	}
+	if !bytes.Equal(out[8:], []byte("pong")) {
+		t.Fatalf("bad: %v", out[8:])
+	}
+}
+
+func TestSOCKS4_UserMismatch(t *testing.T) {
+	conn, err := net.Dial("tcp", startTestSocks4Server(t, `{"users": [{"user_name": "foo"}]}`))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	conn.Write(append([]byte{Socks4Version, ConnectCommand, 0, 80, 127, 0, 0, 1}, "bar\x00"...))
+
+	out := make([]byte, 8)
+	if _, err := io.ReadFull(conn, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out[1] != socks4UserMismatch {
+		t.Fatalf("bad reply: %v", out)
+	}
+}
@@ -1,14 +1,15 @@
 package socks
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/ido2021/light-proxy/adaptor/inbound"
 	common2 "github.com/ido2021/light-proxy/adaptor/inbound/common"
-	"github.com/ido2021/light-proxy/adaptor/outbound"
 	"github.com/ido2021/light-proxy/common"
+	"github.com/ido2021/light-proxy/common/sniff"
 	"github.com/ido2021/light-proxy/route"
 	"io"
 	"log"
@@ -18,13 +19,6 @@ import (
 
 const (
 	Socks5Version = 0x05
-	// MaxAddrLen is the maximum size of SOCKS address in bytes.
-	MaxAddrLen = 1 + 1 + 255 + 2
-
-	// SOCKS address types as defined in RFC 1928 section 5.
-	AtypIPv4       = 0x01
-	AtypDomainName = 0x03
-	AtypIPv6       = 0x04
 )
 
 const (
@@ -45,10 +39,6 @@ const (
 	AssociateCommand = uint8(3)
 )
 
-var (
-	unrecognizedAddrType = errors.New("unrecognized address type")
-)
-
 func init() {
 	// 注册mixed factory
 	inbound.RegisterInAdaptorFactory(inbound.SOCKS5, NewSocks5Adaptor)
@@ -63,28 +53,52 @@ type socksRequest struct {
 type Sockcs5Config struct {
 	Address string          `json:"address"`
 	Users   []*common2.User `json:"users,omitempty"`
+	// AllowAnonymous 配置了users时仍允许无认证访问
+	AllowAnonymous bool `json:"allowAnonymous,omitempty"`
+	// BindUsers 允许使用BIND命令的用户，"*"表示所有用户，为空时禁用BIND
+	BindUsers []string `json:"bindUsers,omitempty"`
+	// BindTimeout 等待对端连接的超时时间，单位秒
+	BindTimeout int `json:"bindTimeout,omitempty"`
+	common2.SniffConfig
 }
 
 type Socks5InAdaptor struct {
+	tag         string
 	conf        *Sockcs5Config
 	listener    net.Listener
 	AuthMethods map[uint8]Authenticator
 }
 
-func NewSocks5Adaptor(config json.RawMessage) (inbound.InAdaptor, error) {
+func NewSocks5Adaptor(tag string, config json.RawMessage) (inbound.InAdaptor, error) {
 	conf := &Sockcs5Config{}
 	err := json.Unmarshal(config, conf)
 	if err != nil {
 		return nil, err
 	}
 	return &Socks5InAdaptor{
-		conf: conf,
-		AuthMethods: map[uint8]Authenticator{
-			NoAuth: &NoAuthAuthenticator{},
-		},
+		tag:         tag,
+		conf:        conf,
+		AuthMethods: newAuthMethods(conf),
 	}, nil
 }
 
+// newAuthMethods enables user/pass auth when users are configured, anonymous
+// access stays available only if no users are configured or it is explicitly allowed
+func newAuthMethods(conf *Sockcs5Config) map[uint8]Authenticator {
+	authMethods := map[uint8]Authenticator{}
+	if len(conf.Users) == 0 || conf.AllowAnonymous {
+		authMethods[NoAuth] = &NoAuthAuthenticator{}
+	}
+	if len(conf.Users) > 0 {
+		credentials := StaticCredentials{}
+		for _, user := range conf.Users {
+			credentials[user.UserName] = user.Password
+		}
+		authMethods[UserPassAuth] = &UserPassAuthenticator{Credentials: credentials}
+	}
+	return authMethods
+}
+
 func (s5 *Socks5InAdaptor) Stop() error {
 	return s5.listener.Close()
 }
@@ -112,25 +126,14 @@ func (s5 *Socks5InAdaptor) Start(router *route.Router) error {
 }
 
 func (s5 *Socks5InAdaptor) HandleConn(ctx context.Context, conn net.Conn, router *route.Router) {
-	request, err := s5.handshake(conn)
+	bufConn := common.NewBufferedConn(conn)
+	request, err := s5.handshake(bufConn)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	outAdaptor := router.Route(request.metadata)
-	// Resolve the address if we have a FQDN
-	dest := request.metadata.DestAddr
-	if dest.FQDN != "" && dest.IP == nil {
-		addr, err := outAdaptor.Resolve(ctx, dest.FQDN)
-		if err != nil {
-			_ = sendReply(conn, hostUnreachable, nil)
-			return
-		}
-		dest.IP = addr
-	}
-
-	err = s5.forwardRequest(ctx, conn, request, outAdaptor.Dial)
+	err = s5.forwardRequest(ctx, bufConn, request, router)
 	if err != nil {
 		log.Println(err)
 	}
@@ -152,9 +155,9 @@ func (s5 *Socks5InAdaptor) handshake(conn net.Conn) (*socksRequest, error) {
 	}
 
 	// Read in the destination address
-	dest, err := readAddrSpec(conn)
+	dest, err := common.ReadAddrSpec(conn)
 	if err != nil {
-		if err == unrecognizedAddrType {
+		if err == common.ErrUnrecognizedAddrType {
 			if err := sendReply(conn, addrTypeNotSupported, nil); err != nil {
 				return nil, fmt.Errorf("Failed to send reply: %v", err)
 			}
@@ -174,6 +177,8 @@ func (s5 *Socks5InAdaptor) handshake(conn net.Conn) (*socksRequest, error) {
 	request := &socksRequest{
 		cmd: header[1],
 		metadata: &common.Metadata{
+			Inbound:  s5.tag,
+			User:     auth.Username(),
 			DestAddr: dest,
 		},
 		auth: auth,
@@ -188,7 +193,7 @@ func (s5 *Socks5InAdaptor) handshake(conn net.Conn) (*socksRequest, error) {
 // authenticate is used to handle connection authentication
 func (s5 *Socks5InAdaptor) authenticate(rw net.Conn) (*common.AuthContext, error) {
 	// Read RFC 1928 for request and reply structure and sizes.
-	buf := make([]byte, MaxAddrLen)
+	buf := make([]byte, common.MaxAddrLen)
 	// read VER, NMETHODS, METHODS
 	if _, err := io.ReadFull(rw, buf[:2]); err != nil {
 		return nil, err
@@ -199,10 +204,11 @@ func (s5 *Socks5InAdaptor) authenticate(rw net.Conn) (*common.AuthContext, error
 		return nil, fmt.Errorf("failed to get auth methods: %v", err)
 	}
 
-	// Select a usable method
-	for _, method := range buf {
+	// Select a usable method, prefer user/pass so that the user is known
+	offered := buf[:nmethods]
+	for _, method := range []uint8{UserPassAuth, NoAuth} {
 		cator, found := s5.AuthMethods[method]
-		if found {
+		if found && bytes.IndexByte(offered, method) >= 0 {
 			return cator.Authenticate(rw)
 		}
 	}
@@ -212,15 +218,15 @@ func (s5 *Socks5InAdaptor) authenticate(rw net.Conn) (*common.AuthContext, error
 }
 
 // forwardRequest 转发请求
-func (s5 *Socks5InAdaptor) forwardRequest(ctx context.Context, conn net.Conn, req *socksRequest, dialOut outbound.Dial) error {
+func (s5 *Socks5InAdaptor) forwardRequest(ctx context.Context, conn *common.BufferedConn, req *socksRequest, router *route.Router) error {
 	// Switch on the command
 	switch req.cmd {
 	case ConnectCommand:
-		return s5.handleConnect(ctx, conn, req.metadata, dialOut)
+		return s5.handleConnect(ctx, conn, req.metadata, router)
 	case BindCommand:
-		return s5.handleBind(ctx, conn, req.metadata)
+		return s5.handleBind(ctx, conn, req, router)
 	case AssociateCommand:
-		return s5.handleAssociate(ctx, conn, req.metadata)
+		return s5.handleAssociate(ctx, conn, req.metadata, router)
 	default:
 		if err := sendReply(conn, commandNotSupported, nil); err != nil {
 			return fmt.Errorf("Failed to send reply: %v", err)
@@ -230,10 +236,35 @@ func (s5 *Socks5InAdaptor) forwardRequest(ctx context.Context, conn net.Conn, re
 }
 
 // handleConnect is used to handle a connect command
-func (s5 *Socks5InAdaptor) handleConnect(ctx context.Context, conn net.Conn, metadata *common.Metadata, dialOut outbound.Dial) error {
+func (s5 *Socks5InAdaptor) handleConnect(ctx context.Context, conn *common.BufferedConn, metadata *common.Metadata, router *route.Router) error {
+	// 嗅探需要客户端先发送数据，先回复成功，之后连接失败时直接关闭连接
+	replied := s5.conf.Sniff
+	if replied {
+		if err := sendReply(conn, successReply, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		sniff.Conn(conn, metadata, s5.conf.SniffOverrideDestination, s5.conf.Timeout())
+	}
+
+	outAdaptor := router.Route(metadata)
+	// Resolve the address if we have a FQDN, depending on the domain strategy
+	dest := metadata.DestAddr
+	if err := outAdaptor.ResolveDest(ctx, dest); err != nil {
+		if replied {
+			return fmt.Errorf("Failed to resolve destination %v: %v", dest.FQDN, err)
+		}
+		if err := sendReply(conn, hostUnreachable, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return fmt.Errorf("Failed to resolve destination %v: %v", dest.FQDN, err)
+	}
+
 	// Attempt to connect
-	target, err := dialOut(ctx, "tcp", metadata.DestAddr.Address())
+	target, err := outAdaptor.Dial(ctx, "tcp", dest.Address())
 	if err != nil {
+		if replied {
+			return fmt.Errorf("Connect to %v failed: %v", metadata.DestAddr, err)
+		}
 		msg := err.Error()
 		resp := hostUnreachable
 		if strings.Contains(msg, "refused") {
@@ -249,10 +280,10 @@ func (s5 *Socks5InAdaptor) handleConnect(ctx context.Context, conn net.Conn, met
 	defer target.Close()
 
 	// Send success
-	local := target.LocalAddr().(*net.TCPAddr)
-	bind := common.AddrSpec{IP: local.IP, Port: local.Port}
-	if err := sendReply(conn, successReply, &bind); err != nil {
-		return fmt.Errorf("Failed to send reply: %v", err)
+	if !replied {
+		if err := sendReply(conn, successReply, tcpAddrSpec(target.LocalAddr())); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
 	}
 
 	common.Relay(target, conn)
@@ -273,115 +304,44 @@ func (s5 *Socks5InAdaptor) handleConnect(ctx context.Context, conn net.Conn, met
 	return nil
 }
 
-// handleBind is used to handle a connect command
-func (s5 *Socks5InAdaptor) handleBind(ctx context.Context, conn net.Conn, metadata *common.Metadata) error {
-	// TODO: Support bind
-	if err := sendReply(conn, commandNotSupported, nil); err != nil {
-		return fmt.Errorf("Failed to send reply: %v", err)
-	}
-	return nil
-}
-
-// handleAssociate is used to handle a connect command
-func (s5 *Socks5InAdaptor) handleAssociate(ctx context.Context, conn net.Conn, metadata *common.Metadata) error {
-	// TODO: Support associate
-	if err := sendReply(conn, commandNotSupported, nil); err != nil {
-		return fmt.Errorf("Failed to send reply: %v", err)
+// handleAssociate is used to handle an associate command
+func (s5 *Socks5InAdaptor) handleAssociate(ctx context.Context, conn net.Conn, metadata *common.Metadata, router *route.Router) error {
+	// 在接收控制连接的地址上开启UDP中继端口
+	local := conn.LocalAddr().(*net.TCPAddr)
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		if err := sendReply(conn, serverFailure, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return fmt.Errorf("Failed to listen udp relay: %v", err)
 	}
-	return nil
-}
-
-// readAddrSpec is used to read AddrSpec.
-// Expects an address type byte, follwed by the address and port
-func readAddrSpec(r io.Reader) (*common.AddrSpec, error) {
-	d := &common.AddrSpec{}
 
-	// Get the address type
-	addrType := []byte{0}
-	if _, err := r.Read(addrType); err != nil {
-		return nil, err
-	}
+	assoc := newUDPAssociation(ctx, relay, metadata, router)
+	assoc.sniff = s5.conf.SniffConfig
+	defer assoc.Close()
 
-	// Handle on a per type basis
-	switch addrType[0] {
-	case AtypIPv4:
-		addr := make([]byte, 4)
-		if _, err := io.ReadFull(r, addr); err != nil {
-			return nil, err
-		}
-		d.IP = addr
-	case AtypIPv6:
-		addr := make([]byte, 16)
-		if _, err := io.ReadFull(r, addr); err != nil {
-			return nil, err
-		}
-		d.IP = addr
-	case AtypDomainName:
-		if _, err := r.Read(addrType); err != nil {
-			return nil, err
-		}
-		addrLen := uint16(addrType[0])
-		fqdn := make([]byte, addrLen)
-		if _, err := io.ReadFull(r, fqdn); err != nil {
-			return nil, err
-		}
-		d.FQDN = string(fqdn)
-	default:
-		return nil, unrecognizedAddrType
+	relayAddr := relay.LocalAddr().(*net.UDPAddr)
+	bind := common.AddrSpec{IP: relayAddr.IP, Port: relayAddr.Port}
+	if err := sendReply(conn, successReply, &bind); err != nil {
+		return fmt.Errorf("Failed to send reply: %v", err)
 	}
 
-	// Read the port
-	port := []byte{0, 0}
-	if _, err := io.ReadFull(r, port); err != nil {
-		return nil, err
-	}
-	d.Port = (int(port[0]) << 8) | int(port[1])
+	go assoc.serve()
 
-	return d, nil
+	// 控制连接关闭时结束关联
+	_, _ = io.Copy(io.Discard, conn)
+	return nil
 }
 
 // sendReply is used to send a reply message
 func sendReply(w io.Writer, resp uint8, addr *common.AddrSpec) error {
-	// Format the address
-	var addrType uint8
-	var addrBody []byte
-	var addrPort uint16
-	switch {
-	case addr == nil:
-		addrType = AtypIPv4
-		addrBody = []byte{0, 0, 0, 0}
-		addrPort = 0
-
-	case addr.FQDN != "":
-		addrType = AtypDomainName
-		addrBody = append([]byte{byte(len(addr.FQDN))}, addr.FQDN...)
-		addrPort = uint16(addr.Port)
-
-	case addr.IP.To4() != nil:
-		addrType = AtypIPv4
-		addrBody = []byte(addr.IP.To4())
-		addrPort = uint16(addr.Port)
-
-	case addr.IP.To16() != nil:
-		addrType = AtypIPv6
-		addrBody = []byte(addr.IP.To16())
-		addrPort = uint16(addr.Port)
-
-	default:
-		return fmt.Errorf("Failed to format address: %v", addr)
-	}
-
 	// Format the message
-	msg := make([]byte, 6+len(addrBody))
-	msg[0] = Socks5Version
-	msg[1] = resp
-	msg[2] = 0 // Reserved
-	msg[3] = addrType
-	copy(msg[4:], addrBody)
-	msg[4+len(addrBody)] = byte(addrPort >> 8)
-	msg[4+len(addrBody)+1] = byte(addrPort & 0xff)
+	msg, err := common.AppendAddrSpec([]byte{Socks5Version, resp, 0}, addr)
+	if err != nil {
+		return err
+	}
 
 	// Send the message
-	_, err := w.Write(msg)
+	_, err = w.Write(msg)
 	return err
 }
@@ -0,0 +1,222 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	common2 "github.com/ido2021/light-proxy/adaptor/inbound/common"
+	"github.com/ido2021/light-proxy/adaptor/outbound"
+	"github.com/ido2021/light-proxy/common"
+	"github.com/ido2021/light-proxy/common/sniff"
+	"github.com/ido2021/light-proxy/route"
+	"log"
+	"net"
+	"sync"
+)
+
+// maxUDPPacketSize is the maximum size of a UDP datagram
+const maxUDPPacketSize = 64 * 1024
+
+var (
+	shortUDPHeader = errors.New("short udp request header")
+)
+
+// outConnKey identifies the outbound packet conn of an association
+type outConnKey struct {
+	outAdaptor *outbound.WrapperOutAdaptor
+	network    string
+}
+
+// udpAssociation relays datagrams between a client and the outbounds chosen
+// by the router, as described in RFC 1928 section 7
+type udpAssociation struct {
+	ctx    context.Context
+	relay  net.PacketConn
+	router *route.Router
+	// request is the metadata of the associate request
+	request *common.Metadata
+	sniff   common2.SniffConfig
+	// clientIP is the address of the controlling TCP connection, only
+	// datagrams coming from it are accepted
+	clientIP net.IP
+
+	// fakeAddrs 回复的来源使用客户端发送时的假地址
+	fakeAddrs common2.FakeAddrs
+
+	mu       sync.Mutex
+	client   net.Addr
+	outConns map[outConnKey]net.PacketConn
+	closed   bool
+}
+
+func newUDPAssociation(ctx context.Context, relay net.PacketConn, request *common.Metadata, router *route.Router) *udpAssociation {
+	assoc := &udpAssociation{
+		ctx:      ctx,
+		relay:    relay,
+		router:   router,
+		request:  request,
+		outConns: map[outConnKey]net.PacketConn{},
+	}
+	if request.RemoteAddr != nil {
+		assoc.clientIP = request.RemoteAddr.IP
+	}
+	return assoc
+}
+
+// serve reads datagrams from the client until the relay is closed
+func (a *udpAssociation) serve() {
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		n, from, err := a.relay.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Println(err)
+			}
+			return
+		}
+		if !a.acceptFrom(from) {
+			continue
+		}
+		if err := a.handlePacket(buf[:n], from); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// acceptFrom checks the source of a datagram, the first valid source becomes
+// the client of the association
+func (a *udpAssociation) acceptFrom(from net.Addr) bool {
+	udpAddr, ok := from.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	if a.clientIP != nil && !a.clientIP.Equal(udpAddr.IP) {
+		return false
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.client == nil {
+		a.client = udpAddr
+		return true
+	}
+	return a.client.String() == udpAddr.String()
+}
+
+// handlePacket parses the UDP request header and sends the payload through
+// the routed outbound
+func (a *udpAssociation) handlePacket(packet []byte, from net.Addr) error {
+	// RSV RSV FRAG ATYP DST.ADDR DST.PORT DATA
+	if len(packet) < 4 {
+		return shortUDPHeader
+	}
+	// Fragmentation is not supported, drop the datagram
+	if packet[2] != 0 {
+		return nil
+	}
+
+	r := bytes.NewReader(packet[3:])
+	dest, err := common.ReadAddrSpec(r)
+	if err != nil {
+		return fmt.Errorf("Failed to read udp destination address: %v", err)
+	}
+	payload := packet[len(packet)-r.Len():]
+
+	udpAddr := from.(*net.UDPAddr)
+	metadata := &common.Metadata{
+		Inbound:    a.request.Inbound,
+		User:       a.request.User,
+		RemoteAddr: &common.AddrSpec{IP: udpAddr.IP, Port: udpAddr.Port},
+		DestAddr:   dest,
+	}
+	if a.sniff.Sniff {
+		sniff.PacketMetadata(payload, metadata, a.sniff.SniffOverrideDestination)
+	}
+	outAdaptor := a.router.Route(metadata)
+	// 数据包需要目标IP，as_is时也在本地解析
+	if dest.FQDN != "" && dest.IP == nil {
+		ip, err := outAdaptor.Resolve(a.ctx, dest.FQDN)
+		if err != nil {
+			return fmt.Errorf("Failed to resolve udp destination %v: %v", dest.FQDN, err)
+		}
+		dest.IP = ip
+	}
+	a.fakeAddrs.Add(metadata)
+
+	network := "udp6"
+	if dest.IP.To4() != nil {
+		network = "udp4"
+	}
+	outConn, err := a.outConn(outAdaptor, network)
+	if err != nil {
+		return fmt.Errorf("Failed to listen packet on outbound: %v", err)
+	}
+
+	_, err = outConn.WriteTo(payload, &net.UDPAddr{IP: dest.IP, Port: dest.Port})
+	return err
+}
+
+// outConn returns the packet conn of the outbound, creating it on first use
+func (a *udpAssociation) outConn(outAdaptor *outbound.WrapperOutAdaptor, network string) (net.PacketConn, error) {
+	key := outConnKey{outAdaptor: outAdaptor, network: network}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return nil, net.ErrClosed
+	}
+	if outConn, ok := a.outConns[key]; ok {
+		return outConn, nil
+	}
+
+	outConn, err := outAdaptor.ListenPacket(a.ctx, network, "")
+	if err != nil {
+		return nil, err
+	}
+	a.outConns[key] = outConn
+	go a.replyLoop(outConn)
+	return outConn, nil
+}
+
+// replyLoop sends datagrams received by an outbound back to the client
+func (a *udpAssociation) replyLoop(outConn net.PacketConn) {
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		n, from, err := outConn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		udpAddr, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		packet, err := common.AppendAddrSpec([]byte{0, 0, 0}, a.fakeAddrs.ReplyAddr(udpAddr))
+		if err != nil {
+			continue
+		}
+		packet = append(packet, buf[:n]...)
+
+		a.mu.Lock()
+		client := a.client
+		a.mu.Unlock()
+		if _, err := a.relay.WriteTo(packet, client); err != nil {
+			return
+		}
+	}
+}
+
+// Close tears down the relay and all outbound packet conns
+func (a *udpAssociation) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return nil
+	}
+	a.closed = true
+	for _, outConn := range a.outConns {
+		_ = outConn.Close()
+	}
+	return a.relay.Close()
+}
@@ -0,0 +1,158 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ido2021/light-proxy/adaptor/internal/testutil"
+	"github.com/ido2021/light-proxy/adaptor/outbound"
+	"github.com/ido2021/light-proxy/common"
+	"github.com/ido2021/light-proxy/route"
+)
+
+// startTestServer serves a single socks5 connection routed to direct
+func startTestServer(t *testing.T, config string) string {
+	router, err := route.NewRouter(common.Route{Final: outbound.Direct}, map[string]*outbound.WrapperOutAdaptor{
+		outbound.Direct: outbound.NewWrapperOutAdaptor(&outbound.DirectOutAdaptor{}),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return serveTestRouter(t, config, router)
+}
+
+// serveTestRouter serves a single socks5 connection with router
+func serveTestRouter(t *testing.T, config string, router *route.Router) string {
+	adaptor, err := NewSocks5Adaptor("test", json.RawMessage(config))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	s5 := adaptor.(*Socks5InAdaptor)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		s5.HandleConn(context.Background(), conn, router)
+	}()
+	return l.Addr().String()
+}
+
+// associate asks the server at addr for an association and returns the
+// relay address
+func associate(t *testing.T, addr string) (net.Conn, *net.UDPAddr) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	// Negotiate no auth and ask for an association
+	conn.Write([]byte{Socks5Version, 1, NoAuth})
+	conn.Write([]byte{Socks5Version, AssociateCommand, 0, common.AtypIPv4, 0, 0, 0, 0, 0, 0})
+
+	out := make([]byte, 2)
+	if _, err := io.ReadFull(conn, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	reply := make([]byte, 3)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if reply[1] != successReply {
+		t.Fatalf("bad reply: %v", reply)
+	}
+	bind, err := common.ReadAddrSpec(conn)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return conn, &net.UDPAddr{IP: bind.IP, Port: bind.Port}
+}
+
+// sendTo sends ping to dest through the relay and returns the reply
+func sendTo(t *testing.T, relay *net.UDPAddr, dest *common.AddrSpec) []byte {
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(time.Second))
+
+	packet, _ := common.AppendAddrSpec([]byte{0, 0, 0}, dest)
+	packet = append(packet, "ping"...)
+	if _, err := client.WriteTo(packet, relay); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	buf := make([]byte, 1024)
+	n, _, err := client.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return buf[:n]
+}
+
+func TestSOCKS5_Associate(t *testing.T) {
+	echoAddr := testutil.EchoUDP(t).LocalAddr().(*net.UDPAddr)
+	conn, relay := associate(t, startTestServer(t, `{}`))
+	defer conn.Close()
+
+	packet, _ := common.AppendAddrSpec([]byte{0, 0, 0}, &common.AddrSpec{IP: echoAddr.IP, Port: echoAddr.Port})
+	packet = append(packet, "ping"...)
+	if reply := sendTo(t, relay, &common.AddrSpec{IP: echoAddr.IP, Port: echoAddr.Port}); !bytes.Equal(reply, packet) {
+		t.Fatalf("bad: %v", reply)
+	}
+}
+
+// staticFakeIP maps 198.18.0.1 to echo.test
+type staticFakeIP struct{}
+
+func (staticFakeIP) Contains(ip net.IP) bool {
+	return ip.Equal(net.IPv4(198, 18, 0, 1))
+}
+
+func (staticFakeIP) LookupDomain(ip net.IP) (string, bool) {
+	return "echo.test", true
+}
+
+// loopbackOutAdaptor resolves every domain to 127.0.0.1
+type loopbackOutAdaptor struct {
+	outbound.DirectOutAdaptor
+}
+
+func (l *loopbackOutAdaptor) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return []string{"127.0.0.1"}, nil
+}
+
+// TestSOCKS5_AssociateFakeIP checks that the replies to a fake destination
+// come from the fake address
+func TestSOCKS5_AssociateFakeIP(t *testing.T) {
+	echoAddr := testutil.EchoUDP(t).LocalAddr().(*net.UDPAddr)
+	router, err := route.NewRouter(common.Route{Final: outbound.Direct}, map[string]*outbound.WrapperOutAdaptor{
+		outbound.Direct: outbound.NewWrapperOutAdaptor(&loopbackOutAdaptor{}),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	router.SetFakeIP(staticFakeIP{})
+	conn, relay := associate(t, serveTestRouter(t, `{}`, router))
+	defer conn.Close()
+
+	fake := &common.AddrSpec{IP: net.IPv4(198, 18, 0, 1), Port: echoAddr.Port}
+	reply := sendTo(t, relay, fake)
+	from, err := common.ReadAddrSpec(bytes.NewReader(reply[3:]))
+	if err != nil || from.Address() != fake.Address() {
+		t.Fatalf("bad: %v %v", from, err)
+	}
+}
@@ -0,0 +1,251 @@
+// Package trojan is an inbound serving Trojan clients, it terminates TLS and
+// relays everything which is not a Trojan request to an HTTP backend.
+package trojan
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ido2021/light-proxy/adaptor/inbound"
+	common2 "github.com/ido2021/light-proxy/adaptor/inbound/common"
+	"github.com/ido2021/light-proxy/common"
+	"github.com/ido2021/light-proxy/common/sniff"
+	trojan2 "github.com/ido2021/light-proxy/common/trojan"
+	"github.com/ido2021/light-proxy/route"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// handshakeTimeout bounds the TLS handshake and reading the request header
+const handshakeTimeout = 10 * time.Second
+
+func init() {
+	inbound.RegisterInAdaptorFactory(inbound.TROJAN, NewTrojanAdaptor)
+}
+
+type TrojanConfig struct {
+	Address string `json:"address"`
+	// Password 未配置users时的密码
+	Password string          `json:"password,omitempty"`
+	Users    []*common2.User `json:"users,omitempty"`
+	// Cert Key PEM格式的证书及私钥文件
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+	// Fallback 非Trojan流量转发到的HTTP服务 host:port，为空时关闭连接
+	Fallback string `json:"fallback,omitempty"`
+	common2.SniffConfig
+}
+
+type TrojanAdaptor struct {
+	tag       string
+	conf      *TrojanConfig
+	tlsConfig *tls.Config
+	// users 密码的SHA224到用户名，匿名时为空字符串
+	users map[string]string
+
+	mu       sync.Mutex
+	listener net.Listener
+}
+
+func NewTrojanAdaptor(tag string, config json.RawMessage) (inbound.InAdaptor, error) {
+	conf := &TrojanConfig{}
+	err := json.Unmarshal(config, conf)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(conf.Cert, conf.Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load trojan certificate: %w", err)
+	}
+	users := conf.Users
+	if len(users) == 0 {
+		if conf.Password == "" {
+			return nil, errors.New("trojan inbound has no password")
+		}
+		users = []*common2.User{{Password: conf.Password}}
+	}
+
+	adaptor := &TrojanAdaptor{
+		tag:       tag,
+		conf:      conf,
+		tlsConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		users:     map[string]string{},
+	}
+	for _, user := range users {
+		adaptor.users[string(trojan2.Key(user.Password))] = user.UserName
+	}
+	return adaptor, nil
+}
+
+func (t *TrojanAdaptor) Start(router *route.Router) error {
+	l, err := net.Listen("tcp", t.conf.Address)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.listener = l
+	t.mu.Unlock()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			// 监听关闭了，退出
+			if errors.Is(err, net.ErrClosed) {
+				break
+			}
+			log.Println("获取连接异常：", err)
+			continue
+		}
+		go t.HandleConn(context.Background(), conn, router)
+	}
+	return nil
+}
+
+func (t *TrojanAdaptor) Stop() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.listener == nil {
+		return nil
+	}
+	return t.listener.Close()
+}
+
+func (t *TrojanAdaptor) HandleConn(ctx context.Context, conn net.Conn, router *route.Router) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	tlsConn := tls.Server(conn, t.tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		log.Println("trojan:", conn.RemoteAddr(), err)
+		return
+	}
+
+	bufConn := common.NewBufferedConn(tlsConn)
+	auth, ok := t.authenticate(bufConn)
+	if !ok {
+		_ = conn.SetDeadline(time.Time{})
+		t.fallback(ctx, bufConn)
+		return
+	}
+	cmd, dest, err := readRequest(bufConn)
+	if err != nil {
+		log.Println("trojan: bad request:", err)
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	metadata := &common.Metadata{
+		Inbound:  t.tag,
+		User:     auth.Username(),
+		DestAddr: dest,
+	}
+	if client, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		metadata.RemoteAddr = &common.AddrSpec{IP: client.IP, Port: client.Port}
+	}
+	switch cmd {
+	case trojan2.ConnectCommand:
+		err = t.handleConnect(ctx, bufConn, metadata, router)
+	case trojan2.AssociateCommand:
+		err = newUDPAssociation(ctx, bufConn, metadata, router, t.conf.SniffConfig).serve()
+	default:
+		err = fmt.Errorf("unsupported command: %v", cmd)
+	}
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// authenticate reads the password hash of a Trojan request. The stream is
+// left untouched if it is not one, a byte which can not be in a hash ends
+// the check without waiting for more data
+func (t *TrojanAdaptor) authenticate(conn *common.BufferedConn) (*common.AuthContext, bool) {
+	if _, err := conn.Peek(1); err != nil {
+		return nil, false
+	}
+	for n := 1; ; n++ {
+		if buffered := conn.Buffered(); buffered > n {
+			n = buffered
+		}
+		if n > trojan2.KeySize {
+			n = trojan2.KeySize
+		}
+		b, err := conn.Peek(n)
+		if err != nil || !isHex(b) {
+			return nil, false
+		}
+		if n < trojan2.KeySize {
+			continue
+		}
+		user, ok := t.users[string(b)]
+		if !ok {
+			return nil, false
+		}
+		_, _ = conn.Reader().Discard(n)
+		if user == "" {
+			return nil, true
+		}
+		return &common.AuthContext{Payload: map[string]string{"Username": user}}, true
+	}
+}
+
+// isHex reports whether b is lower case hex
+func isHex(b []byte) bool {
+	for _, c := range b {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// readRequest reads the rest of the request header following the password
+// hash
+func readRequest(r io.Reader) (uint8, *common.AddrSpec, error) {
+	cmd, addr, err := trojan2.ReadRequest(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	dest, err := common.ReadAddrSpec(bytes.NewReader(addr))
+	if err != nil {
+		return 0, nil, err
+	}
+	return cmd, dest, nil
+}
+
+// fallback relays the stream, including what was read while checking it, to
+// the HTTP backend
+func (t *TrojanAdaptor) fallback(ctx context.Context, conn *common.BufferedConn) {
+	if t.conf.Fallback == "" {
+		return
+	}
+	var dialer net.Dialer
+	backend, err := dialer.DialContext(ctx, "tcp", t.conf.Fallback)
+	if err != nil {
+		log.Println("trojan: fallback:", err)
+		return
+	}
+	defer backend.Close()
+	common.Relay(backend, conn)
+}
+
+func (t *TrojanAdaptor) handleConnect(ctx context.Context, conn *common.BufferedConn, metadata *common.Metadata, router *route.Router) error {
+	if t.conf.Sniff {
+		sniff.Conn(conn, metadata, t.conf.SniffOverrideDestination, t.conf.Timeout())
+	}
+	outAdaptor := router.Route(metadata)
+	dest := metadata.DestAddr
+	if err := outAdaptor.ResolveDest(ctx, dest); err != nil {
+		return fmt.Errorf("Failed to resolve destination %v: %v", dest.FQDN, err)
+	}
+	target, err := outAdaptor.Dial(ctx, "tcp", dest.Address())
+	if err != nil {
+		return fmt.Errorf("Connect to %v failed: %v", dest, err)
+	}
+	defer target.Close()
+	common.Relay(target, conn)
+	return nil
+}
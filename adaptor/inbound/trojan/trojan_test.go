@@ -0,0 +1,176 @@
+package trojan
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ido2021/light-proxy/adaptor/internal/testutil"
+	"github.com/ido2021/light-proxy/adaptor/outbound"
+	"github.com/ido2021/light-proxy/adaptor/outbound/trojan"
+	"github.com/ido2021/light-proxy/common"
+	trojan2 "github.com/ido2021/light-proxy/common/trojan"
+)
+
+// writeCert writes a self-signed certificate of example.com, it is its own CA
+func writeCert(t *testing.T) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "example.com"},
+		DNSNames:              []string{"example.com"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return certFile, keyFile
+}
+
+// startServer serves the trojan inbound
+func startServer(t *testing.T, certFile, keyFile, fallback string) string {
+	router := testutil.NewRouter(t)
+	config, _ := json.Marshal(map[string]interface{}{
+		"users":    []map[string]string{{"user_name": "alice", "password": "foo"}, {"user_name": "bob", "password": "bar"}},
+		"cert":     certFile,
+		"key":      keyFile,
+		"fallback": fallback,
+	})
+	adaptor, err := NewTrojanAdaptor("test", config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return testutil.Serve(t, func(conn net.Conn) {
+		adaptor.(*TrojanAdaptor).HandleConn(context.Background(), conn, router)
+	}).Addr().String()
+}
+
+func newOutAdaptor(t *testing.T, addr, password, ca string) outbound.OutAdaptor {
+	return testutil.NewOutAdaptor(t, trojan.NewTrojanOutAdaptor, &trojan.TrojanConfig{
+		Address:  addr,
+		Password: password,
+		TLS:      &outbound.TLSConfig{ServerName: "example.com", CA: ca},
+	})
+}
+
+func TestTrojanAdaptor_TCP(t *testing.T) {
+	echo := testutil.EchoTCP(t)
+	certFile, keyFile := writeCert(t)
+	addr := startServer(t, certFile, keyFile, "")
+	for _, c := range []struct {
+		password string
+		ok       bool
+	}{
+		{"foo", true},
+		// bob被路由到block，错误的密码没有配置fallback时关闭连接
+		{"bar", false},
+		{"baz", false},
+	} {
+		conn, err := newOutAdaptor(t, addr, c.password, certFile).Dial(context.Background(), "tcp", echo.Addr().String())
+		if err != nil {
+			t.Fatalf("%s: err: %v", c.password, err)
+		}
+		if err := testutil.Ping(conn); (err == nil) != c.ok {
+			t.Fatalf("%s: bad: %v", c.password, err)
+		}
+		conn.Close()
+	}
+
+	// 服务器证书不受信任
+	config := `{"address": "` + addr + `", "password": "foo", "tls": {"serverName": "example.com"}}`
+	outAdaptor, err := trojan.NewTrojanOutAdaptor(json.RawMessage(config))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := outAdaptor.Dial(context.Background(), "tcp", echo.Addr().String()); err == nil {
+		t.Fatal("expect error")
+	}
+}
+
+func TestTrojanAdaptor_UDP(t *testing.T) {
+	echo := testutil.EchoUDP(t)
+	certFile, keyFile := writeCert(t)
+	addr := startServer(t, certFile, keyFile, "")
+	conn, err := newOutAdaptor(t, addr, "foo", certFile).ListenPacket(context.Background(), "udp4", "")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	// 被block的数据包丢弃，关联继续
+	if _, err := conn.WriteTo([]byte("ping"), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: testutil.BlockedPort}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := testutil.PingPacket(conn, echo.LocalAddr()); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+}
+
+func TestTrojanAdaptor_Fallback(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+
+	certFile, keyFile := writeCert(t)
+	addr := startServer(t, certFile, keyFile, backend.Listener.Addr().String())
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}, Timeout: time.Second}
+	resp, err := client.Get("https://" + addr + "/")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "hello" {
+		t.Fatalf("bad: %q", body)
+	}
+}
+
+func TestReadRequest(t *testing.T) {
+	addr, _ := common.AppendAddrSpec(nil, &common.AddrSpec{FQDN: "example.com", Port: 443})
+	request := trojan2.AppendRequest(nil, trojan2.Key("foo"), trojan2.ConnectCommand, addr)
+	cmd, dest, err := readRequest(bytes.NewReader(request[trojan2.KeySize:]))
+	if err != nil || cmd != trojan2.ConnectCommand || dest.FQDN != "example.com" || dest.Port != 443 {
+		t.Fatalf("bad: %v %v %v", cmd, dest, err)
+	}
+}
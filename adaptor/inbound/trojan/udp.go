@@ -0,0 +1,161 @@
+package trojan
+
+import (
+	"bytes"
+	"context"
+	common2 "github.com/ido2021/light-proxy/adaptor/inbound/common"
+	"github.com/ido2021/light-proxy/adaptor/outbound"
+	"github.com/ido2021/light-proxy/common"
+	"github.com/ido2021/light-proxy/common/sniff"
+	trojan2 "github.com/ido2021/light-proxy/common/trojan"
+	"github.com/ido2021/light-proxy/route"
+	"log"
+	"net"
+	"sync"
+)
+
+// maxUDPPacketSize is the maximum size of a UDP datagram
+const maxUDPPacketSize = 64 * 1024
+
+// outConnKey identifies the outbound packet conn of an association
+type outConnKey struct {
+	outAdaptor *outbound.WrapperOutAdaptor
+	network    string
+}
+
+// udpAssociation relays the packets framed on the stream of a UDP ASSOCIATE
+// request through the outbounds chosen by the router
+type udpAssociation struct {
+	ctx    context.Context
+	conn   *common.BufferedConn
+	router *route.Router
+	// request is the metadata of the associate request
+	request *common.Metadata
+	sniff   common2.SniffConfig
+	// fakeAddrs 回复的来源使用客户端发送时的假地址
+	fakeAddrs common2.FakeAddrs
+
+	writeMu  sync.Mutex
+	mu       sync.Mutex
+	outConns map[outConnKey]net.PacketConn
+	closed   bool
+}
+
+func newUDPAssociation(ctx context.Context, conn *common.BufferedConn, request *common.Metadata, router *route.Router, sniffConfig common2.SniffConfig) *udpAssociation {
+	return &udpAssociation{
+		ctx:      ctx,
+		conn:     conn,
+		router:   router,
+		request:  request,
+		sniff:    sniffConfig,
+		outConns: map[outConnKey]net.PacketConn{},
+	}
+}
+
+// serve reads the packets of the client until the stream ends
+func (a *udpAssociation) serve() error {
+	defer a.close()
+	for {
+		addr, payload, err := trojan2.ReadPacket(a.conn)
+		if err != nil {
+			return nil
+		}
+		dest, err := common.ReadAddrSpec(bytes.NewReader(addr))
+		if err != nil {
+			continue
+		}
+		a.handlePacket(dest, payload)
+	}
+}
+
+// handlePacket relays a packet of the client, a packet which can not be
+// relayed is dropped without ending the association
+func (a *udpAssociation) handlePacket(dest *common.AddrSpec, payload []byte) {
+	metadata := &common.Metadata{
+		Inbound:    a.request.Inbound,
+		User:       a.request.User,
+		RemoteAddr: a.request.RemoteAddr,
+		DestAddr:   dest,
+	}
+	if a.sniff.Sniff {
+		sniff.PacketMetadata(payload, metadata, a.sniff.SniffOverrideDestination)
+	}
+	outAdaptor := a.router.Route(metadata)
+	// 数据包需要目标IP，as_is时也在本地解析
+	if dest.FQDN != "" && dest.IP == nil {
+		ip, err := outAdaptor.Resolve(a.ctx, dest.FQDN)
+		if err != nil {
+			return
+		}
+		dest.IP = ip
+	}
+	a.fakeAddrs.Add(metadata)
+
+	network := "udp6"
+	if dest.IP.To4() != nil {
+		network = "udp4"
+	}
+	outConn, err := a.outConn(outAdaptor, network)
+	if err != nil {
+		// 例如被路由到block
+		log.Println("trojan: failed to listen packet on outbound:", err)
+		return
+	}
+	_, _ = outConn.WriteTo(payload, &net.UDPAddr{IP: dest.IP, Port: dest.Port})
+}
+
+// outConn returns the packet conn of the outbound, creating it on first use
+func (a *udpAssociation) outConn(outAdaptor *outbound.WrapperOutAdaptor, network string) (net.PacketConn, error) {
+	key := outConnKey{outAdaptor: outAdaptor, network: network}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return nil, net.ErrClosed
+	}
+	if outConn, ok := a.outConns[key]; ok {
+		return outConn, nil
+	}
+	outConn, err := outAdaptor.ListenPacket(a.ctx, network, "")
+	if err != nil {
+		return nil, err
+	}
+	a.outConns[key] = outConn
+	go a.replyLoop(outConn)
+	return outConn, nil
+}
+
+// replyLoop sends the packets received by an outbound back to the client
+func (a *udpAssociation) replyLoop(outConn net.PacketConn) {
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		n, from, err := outConn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		udpAddr, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		addr, err := common.AppendAddrSpec(nil, a.fakeAddrs.ReplyAddr(udpAddr))
+		if err != nil {
+			continue
+		}
+		packet := trojan2.AppendPacket(nil, addr, buf[:n])
+		a.writeMu.Lock()
+		_, err = a.conn.Write(packet)
+		a.writeMu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (a *udpAssociation) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.closed = true
+	for _, outConn := range a.outConns {
+		_ = outConn.Close()
+	}
+}
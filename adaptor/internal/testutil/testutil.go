@@ -0,0 +1,135 @@
+// Package testutil holds the fixtures shared by the tests of the inbounds and
+// outbounds: a router, echo servers and a serving loop.
+package testutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ido2021/light-proxy/adaptor/outbound"
+	"github.com/ido2021/light-proxy/common"
+	"github.com/ido2021/light-proxy/route"
+)
+
+// BlockedPort is a destination port routed to block by NewRouter
+const BlockedPort = 9
+
+// NewRouter routes to direct, the user bob and BlockedPort are blocked
+func NewRouter(t testing.TB) *route.Router {
+	router, err := route.NewRouter(common.Route{
+		Rules: []common.Rule{
+			{User: []string{"bob"}, Outbound: outbound.Block},
+			{Port: []uint16{BlockedPort}, Outbound: outbound.Block},
+		},
+		Final: outbound.Direct,
+	}, map[string]*outbound.WrapperOutAdaptor{
+		outbound.Direct: outbound.NewWrapperOutAdaptor(&outbound.DirectOutAdaptor{}),
+		outbound.Block:  outbound.NewWrapperOutAdaptor(&outbound.BlockOutAdaptor{}),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return router
+}
+
+// NewOutAdaptor creates an outbound of factory with config encoded to JSON,
+// a json.RawMessage is used as is
+func NewOutAdaptor(t testing.TB, factory outbound.Factory, config interface{}) outbound.OutAdaptor {
+	b, err := json.Marshal(config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	outAdaptor, err := factory(b)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return outAdaptor
+}
+
+// Serve calls handle for each conn accepted on a local TCP listener until
+// the test ends, the conn is closed once handle returns
+func Serve(t testing.TB, handle func(conn net.Conn)) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return l
+}
+
+// EchoTCP starts a TCP server writing back what it reads
+func EchoTCP(t testing.TB) net.Listener {
+	return Serve(t, func(conn net.Conn) {
+		_, _ = io.Copy(conn, conn)
+	})
+}
+
+// EchoUDP starts a UDP server sending back the packets it receives
+func EchoUDP(t testing.TB) net.PacketConn {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo(buf[:n], from)
+		}
+	}()
+	return pc
+}
+
+// Ping writes ping on a conn to an echo server and reads it back
+func Ping(conn net.Conn) error {
+	_ = conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		return err
+	}
+	out := make([]byte, 4)
+	if _, err := io.ReadFull(conn, out); err != nil {
+		return err
+	}
+	if string(out) != "ping" {
+		return fmt.Errorf("bad: %q", out)
+	}
+	return nil
+}
+
+// PingPacket sends ping to the echo server at echo and expects it back from
+// the same address
+func PingPacket(conn net.PacketConn, echo net.Addr) error {
+	_ = conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.WriteTo([]byte("ping"), echo); err != nil {
+		return err
+	}
+	buf := make([]byte, 1024)
+	n, from, err := conn.ReadFrom(buf)
+	if err != nil {
+		return err
+	}
+	if string(buf[:n]) != "ping" || from.String() != echo.String() {
+		return fmt.Errorf("bad: %q from %v", buf[:n], from)
+	}
+	return nil
+}
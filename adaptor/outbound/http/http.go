@@ -0,0 +1,147 @@
+// Package http is an outbound tunneling TCP connections through an upstream
+// HTTP proxy with the CONNECT method, optionally over TLS.
+package http
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ido2021/light-proxy/adaptor/outbound"
+	"github.com/ido2021/light-proxy/common"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// handshakeTimeout bounds the CONNECT request if ctx has no deadline
+const handshakeTimeout = 10 * time.Second
+
+var (
+	errUnsupportedNetwork = errors.New("http proxy: unsupported network")
+)
+
+func init() {
+	outbound.RegisterOutAdaptorFactory("http", NewHttpOutAdaptor)
+}
+
+type HttpConfig struct {
+	// Address 上游HTTP代理地址 host:port
+	Address string `json:"address"`
+	// UserName 不为空时使用Basic认证
+	UserName string `json:"user_name,omitempty"`
+	Password string `json:"password,omitempty"`
+	// Headers CONNECT请求附加的请求头
+	Headers map[string]string `json:"headers,omitempty"`
+	// TLS 不为空时使用TLS连接代理服务器(HTTPS代理)
+	TLS *outbound.TLSConfig `json:"tls,omitempty"`
+}
+
+type HttpOutAdaptor struct {
+	conf      *HttpConfig
+	header    http.Header
+	tlsConfig *tls.Config
+	dialer    net.Dialer
+}
+
+func NewHttpOutAdaptor(config json.RawMessage) (outbound.OutAdaptor, error) {
+	conf := &HttpConfig{}
+	err := json.Unmarshal(config, conf)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := net.SplitHostPort(conf.Address); err != nil {
+		return nil, fmt.Errorf("invalid http proxy address: %w", err)
+	}
+
+	adaptor := &HttpOutAdaptor{conf: conf, header: http.Header{}}
+	for key, value := range conf.Headers {
+		adaptor.header.Set(key, value)
+	}
+	if conf.UserName != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(conf.UserName + ":" + conf.Password))
+		adaptor.header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if conf.TLS != nil {
+		if adaptor.tlsConfig, err = conf.TLS.Build(conf.Address); err != nil {
+			return nil, err
+		}
+	}
+	return adaptor, nil
+}
+
+func (h *HttpOutAdaptor) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if !strings.HasPrefix(network, "tcp") {
+		return nil, errUnsupportedNetwork
+	}
+	conn, err := h.dialer.DialContext(ctx, "tcp", h.conf.Address)
+	if err != nil {
+		return nil, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(handshakeTimeout)
+	}
+	_ = conn.SetDeadline(deadline)
+
+	if h.tlsConfig != nil {
+		tlsConn := tls.Client(conn, h.tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	bufConn, err := h.connect(conn, addr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return bufConn, nil
+}
+
+// connect sends the CONNECT request, the returned conn keeps the bytes the
+// proxy sent after the response
+func (h *HttpOutAdaptor) connect(conn net.Conn, addr string) (net.Conn, error) {
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: addr},
+		Host:   addr,
+		Header: h.header.Clone(),
+	}
+	if err := request.Write(conn); err != nil {
+		return nil, err
+	}
+
+	bufConn := common.NewBufferedConn(conn)
+	response, err := http.ReadResponse(bufConn.Reader(), request)
+	if err != nil {
+		return nil, err
+	}
+	response.Body.Close()
+	// 任何2xx响应都表示隧道已建立
+	if response.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("http proxy: CONNECT %s: %s", addr, response.Status)
+	}
+	return bufConn, nil
+}
+
+// ListenPacket is not supported, HTTP proxies only tunnel TCP
+func (h *HttpOutAdaptor) ListenPacket(ctx context.Context, network, addr string) (net.PacketConn, error) {
+	return nil, outbound.ErrUDPNotSupported
+}
+
+// LookupHost resolves locally, an HTTP proxy has no name resolution
+func (h *HttpOutAdaptor) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return net.DefaultResolver.LookupHost(ctx, host)
+}
+
+func (h *HttpOutAdaptor) Close() error {
+	return nil
+}
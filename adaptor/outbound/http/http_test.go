@@ -0,0 +1,108 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ido2021/light-proxy/adaptor/internal/testutil"
+)
+
+// connectHandler tunnels CONNECT requests carrying the expected headers
+type connectHandler struct {
+	auth string
+}
+
+func (h *connectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect || r.Header.Get("X-Test") != "1" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if h.auth != "" && r.Header.Get("Proxy-Authorization") != h.auth {
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		return
+	}
+	target, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer target.Close()
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	go io.Copy(target, conn)
+	io.Copy(conn, target)
+}
+
+func dialEcho(config string, echoAddr string) error {
+	outAdaptor, err := NewHttpOutAdaptor(json.RawMessage(config))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := outAdaptor.Dial(ctx, "tcp", echoAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return testutil.Ping(conn)
+}
+
+func TestHttpOutAdaptor(t *testing.T) {
+	echoAddr := testutil.EchoTCP(t).Addr().String()
+	proxy := httptest.NewServer(&connectHandler{auth: "Basic Zm9vOmJhcg=="})
+	defer proxy.Close()
+	addr := proxy.Listener.Addr().String()
+
+	if err := dialEcho(`{"address": "`+addr+`", "user_name": "foo", "password": "bar", "headers": {"X-Test": "1"}}`, echoAddr); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, config := range []string{
+		`{"address": "` + addr + `", "user_name": "foo", "password": "baz", "headers": {"X-Test": "1"}}`,
+		`{"address": "` + addr + `", "user_name": "foo", "password": "bar"}`,
+	} {
+		if err := dialEcho(config, echoAddr); err == nil {
+			t.Fatalf("%s: expect error", config)
+		}
+	}
+}
+
+func TestHttpOutAdaptor_TLS(t *testing.T) {
+	echoAddr := testutil.EchoTCP(t).Addr().String()
+	proxy := httptest.NewTLSServer(&connectHandler{})
+	defer proxy.Close()
+	addr := proxy.Listener.Addr().String()
+
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: proxy.Certificate().Raw})
+	if err := os.WriteFile(ca, pemData, 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// 测试证书包含example.com
+	config := `{"address": "` + addr + `", "headers": {"X-Test": "1"}, "tls": {"serverName": "example.com", "ca": "` + ca + `"}}`
+	if err := dialEcho(config, echoAddr); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, config := range []string{
+		`{"address": "` + addr + `", "headers": {"X-Test": "1"}, "tls": {}}`,
+		`{"address": "` + addr + `", "headers": {"X-Test": "1"}, "tls": {"serverName": "example.org", "ca": "` + ca + `"}}`,
+	} {
+		if err := dialEcho(config, echoAddr); err == nil {
+			t.Fatalf("%s: expect error", config)
+		}
+	}
+}
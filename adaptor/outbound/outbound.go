@@ -3,6 +3,7 @@ package outbound
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"net"
 )
 
@@ -12,14 +13,28 @@ const (
 	Proxy  = "proxy"
 )
 
+var (
+	ErrBlocked            = errors.New("blocked by outbound")
+	ErrListenNotSupported = errors.New("outbound does not support listening")
+	ErrUDPNotSupported    = errors.New("outbound does not support udp")
+)
+
 type Dial func(ctx context.Context, network, addr string) (net.Conn, error)
 
 type OutAdaptor interface {
 	Dial(ctx context.Context, network, addr string) (net.Conn, error)
+	// ListenPacket 创建一个用于发送UDP数据包的PacketConn，network为udp4或udp6
+	ListenPacket(ctx context.Context, network, addr string) (net.PacketConn, error)
 	LookupHost(ctx context.Context, host string) (addrs []string, err error)
 	Close() error
 }
 
+// Listener is implemented by outbounds which are able to accept incoming
+// connections, e.g. for the SOCKS5 BIND command
+type Listener interface {
+	Listen(ctx context.Context, network, addr string) (net.Listener, error)
+}
+
 type Factory func(config json.RawMessage) (OutAdaptor, error)
 
 var outAdaptorFactories = map[string]Factory{}
@@ -47,6 +62,16 @@ func (d *DirectOutAdaptor) Dial(ctx context.Context, network, addr string) (net.
 	return net.Dial(network, addr)
 }
 
+func (d *DirectOutAdaptor) Listen(ctx context.Context, network, addr string) (net.Listener, error) {
+	var lc net.ListenConfig
+	return lc.Listen(ctx, network, addr)
+}
+
+func (d *DirectOutAdaptor) ListenPacket(ctx context.Context, network, addr string) (net.PacketConn, error) {
+	var lc net.ListenConfig
+	return lc.ListenPacket(ctx, network, addr)
+}
+
 type BlockOutAdaptor struct {
 }
 
@@ -59,5 +84,9 @@ func (b *BlockOutAdaptor) Close() error {
 }
 
 func (b *BlockOutAdaptor) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
-	return nil, nil
+	return nil, ErrBlocked
+}
+
+func (b *BlockOutAdaptor) ListenPacket(ctx context.Context, network, addr string) (net.PacketConn, error) {
+	return nil, ErrBlocked
 }
@@ -0,0 +1,157 @@
+// Package shadowsocks is an outbound to a Shadowsocks server with the AEAD
+// or the 2022 ciphers, TCP and UDP.
+package shadowsocks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ido2021/light-proxy/adaptor/outbound"
+	"github.com/ido2021/light-proxy/common"
+	"github.com/ido2021/light-proxy/common/shadowsocks"
+	"net"
+	"strings"
+)
+
+// maxUDPPacketSize is the maximum size of a UDP datagram
+const maxUDPPacketSize = 64 * 1024
+
+var (
+	errUnsupportedNetwork = errors.New("shadowsocks: unsupported network")
+)
+
+func init() {
+	outbound.RegisterOutAdaptorFactory("shadowsocks", NewShadowsocksOutAdaptor)
+}
+
+type ShadowsocksConfig struct {
+	// Address 服务器地址 host:port
+	Address string `json:"address"`
+	// Method 加密方式，如 aes-256-gcm、2022-blake3-aes-128-gcm
+	Method string `json:"method"`
+	// Password 2022加密方式为base64编码的密钥
+	Password string `json:"password"`
+}
+
+type ShadowsocksOutAdaptor struct {
+	conf   *ShadowsocksConfig
+	method *shadowsocks.Method
+	dialer net.Dialer
+}
+
+func NewShadowsocksOutAdaptor(config json.RawMessage) (outbound.OutAdaptor, error) {
+	conf := &ShadowsocksConfig{}
+	err := json.Unmarshal(config, conf)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := net.SplitHostPort(conf.Address); err != nil {
+		return nil, fmt.Errorf("invalid shadowsocks server address: %w", err)
+	}
+	method, err := shadowsocks.NewMethod(conf.Method, conf.Password)
+	if err != nil {
+		return nil, err
+	}
+	return &ShadowsocksOutAdaptor{conf: conf, method: method}, nil
+}
+
+func (s *ShadowsocksOutAdaptor) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if !strings.HasPrefix(network, "tcp") {
+		return nil, errUnsupportedNetwork
+	}
+	header, err := encodeAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := s.dialer.DialContext(ctx, "tcp", s.conf.Address)
+	if err != nil {
+		return nil, err
+	}
+	// 请求头随第一次写入发送
+	return shadowsocks.NewClientConn(conn, s.method, header), nil
+}
+
+func (s *ShadowsocksOutAdaptor) ListenPacket(ctx context.Context, network, addr string) (net.PacketConn, error) {
+	serverAddr, err := net.ResolveUDPAddr("udp", s.conf.Address)
+	if err != nil {
+		return nil, err
+	}
+	session, err := shadowsocks.NewUDPSession(s.method, true)
+	if err != nil {
+		return nil, err
+	}
+	var lc net.ListenConfig
+	udpConn, err := lc.ListenPacket(ctx, "udp", "")
+	if err != nil {
+		return nil, err
+	}
+	return &packetConn{PacketConn: udpConn, server: serverAddr, session: session}, nil
+}
+
+// LookupHost resolves locally, Shadowsocks has no name resolution
+func (s *ShadowsocksOutAdaptor) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return net.DefaultResolver.LookupHost(ctx, host)
+}
+
+func (s *ShadowsocksOutAdaptor) Close() error {
+	return nil
+}
+
+// encodeAddr encodes addr in the SOCKS5 address encoding
+func encodeAddr(addr string) ([]byte, error) {
+	dest, err := common.ParseAddrSpec(addr)
+	if err != nil {
+		return nil, err
+	}
+	return common.AppendAddrSpec(nil, dest)
+}
+
+// packetConn relays datagrams through the server, each one encrypted with
+// the target address
+type packetConn struct {
+	net.PacketConn
+	server  *net.UDPAddr
+	session *shadowsocks.UDPSession
+}
+
+func (c *packetConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	header, err := encodeAddr(addr.String())
+	if err != nil {
+		return 0, err
+	}
+	packet, err := c.session.Pack(header, p)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.PacketConn.WriteTo(packet, c.server); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *packetConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		n, from, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		// 忽略不是来自服务器的和无法解密的数据包
+		udpAddr, ok := from.(*net.UDPAddr)
+		if !ok || !udpAddr.IP.Equal(c.server.IP) || udpAddr.Port != c.server.Port {
+			continue
+		}
+		plaintext, err := c.session.Unpack(buf[:n])
+		if err != nil {
+			continue
+		}
+		r := bytes.NewReader(plaintext)
+		src, err := common.ReadAddrSpec(r)
+		if err != nil || src.IP == nil {
+			continue
+		}
+		return copy(p, plaintext[len(plaintext)-r.Len():]), &net.UDPAddr{IP: src.IP, Port: src.Port}, nil
+	}
+}
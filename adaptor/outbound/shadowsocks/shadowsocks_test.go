@@ -0,0 +1,134 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ido2021/light-proxy/adaptor/internal/testutil"
+	"github.com/ido2021/light-proxy/common"
+	"github.com/ido2021/light-proxy/common/shadowsocks"
+)
+
+const testKey = "AAECAwQFBgcICQoLDA0ODw=="
+
+var testConfigs = map[string]string{
+	"aes-128-gcm":                   "foo",
+	"chacha20-ietf-poly1305":        "foo",
+	"2022-blake3-aes-128-gcm":       testKey,
+	"2022-blake3-chacha20-poly1305": "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=",
+}
+
+// startServer serves a minimal shadowsocks server relaying TCP and UDP
+func startServer(t *testing.T, method *shadowsocks.Method) string {
+	l := testutil.Serve(t, func(conn net.Conn) {
+		ssConn, _, err := shadowsocks.Accept(conn, []*shadowsocks.Method{method}, nil)
+		if err != nil {
+			return
+		}
+		dest, err := common.ReadAddrSpec(ssConn)
+		if err != nil || ssConn.SkipPadding() != nil {
+			return
+		}
+		target, err := net.Dial("tcp", dest.Address())
+		if err != nil {
+			return
+		}
+		defer target.Close()
+		go io.Copy(target, ssConn)
+		io.Copy(ssConn, target)
+	})
+
+	pc, err := net.ListenPacket("udp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		session, _ := shadowsocks.NewUDPSession(method, false)
+		buf := make([]byte, maxUDPPacketSize)
+		for {
+			n, client, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			plaintext, err := session.Unpack(buf[:n])
+			if err != nil {
+				continue
+			}
+			r := bytes.NewReader(plaintext)
+			dest, err := common.ReadAddrSpec(r)
+			if err != nil {
+				continue
+			}
+			target, _ := net.ResolveUDPAddr("udp", dest.Address())
+			relay, _ := net.ListenPacket("udp", "127.0.0.1:0")
+			relay.SetDeadline(time.Now().Add(time.Second))
+			relay.WriteTo(plaintext[len(plaintext)-r.Len():], target)
+			reply := make([]byte, 1024)
+			m, _, err := relay.ReadFrom(reply)
+			relay.Close()
+			if err != nil {
+				continue
+			}
+			packet, _ := session.Pack(plaintext[:len(plaintext)-r.Len()], reply[:m])
+			pc.WriteTo(packet, client)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func newTestAdaptor(t *testing.T, method, password string) *ShadowsocksOutAdaptor {
+	config, _ := json.Marshal(&ShadowsocksConfig{Address: "127.0.0.1:0", Method: method, Password: password})
+	adaptor, err := NewShadowsocksOutAdaptor(config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ss := adaptor.(*ShadowsocksOutAdaptor)
+	ss.conf.Address = startServer(t, ss.method)
+	return ss
+}
+
+func TestShadowsocksOutAdaptor_Dial(t *testing.T) {
+	echo := testutil.EchoTCP(t)
+	for method, password := range testConfigs {
+		outAdaptor := newTestAdaptor(t, method, password)
+		conn, err := outAdaptor.Dial(context.Background(), "tcp", echo.Addr().String())
+		if err != nil {
+			t.Fatalf("%s: err: %v", method, err)
+		}
+		if err := testutil.Ping(conn); err != nil {
+			t.Fatalf("%s: err: %v", method, err)
+		}
+		conn.Close()
+	}
+
+	for _, config := range []string{
+		`{"address": "127.0.0.1:8388", "method": "rc4-md5", "password": "foo"}`,
+		`{"address": "127.0.0.1:8388", "method": "2022-blake3-aes-256-gcm", "password": "` + testKey + `"}`,
+		`{"address": "127.0.0.1", "method": "aes-128-gcm", "password": "foo"}`,
+	} {
+		if _, err := NewShadowsocksOutAdaptor(json.RawMessage(config)); err == nil {
+			t.Fatalf("%s: expect error", config)
+		}
+	}
+}
+
+func TestShadowsocksOutAdaptor_ListenPacket(t *testing.T) {
+	echo := testutil.EchoUDP(t)
+	for method, password := range testConfigs {
+		outAdaptor := newTestAdaptor(t, method, password)
+		conn, err := outAdaptor.ListenPacket(context.Background(), "udp4", "")
+		if err != nil {
+			t.Fatalf("%s: err: %v", method, err)
+		}
+		if err := testutil.PingPacket(conn, echo.LocalAddr()); err != nil {
+			t.Fatalf("%s: err: %v", method, err)
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,283 @@
+// Package socks5 is an outbound chaining into an upstream SOCKS5 server, TCP
+// with the CONNECT command and UDP with UDP ASSOCIATE, RFC 1928.
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ido2021/light-proxy/adaptor/inbound/socks"
+	"github.com/ido2021/light-proxy/adaptor/outbound"
+	"github.com/ido2021/light-proxy/common"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// userAuthVersion is the version of the username/password negotiation, RFC 1929
+	userAuthVersion = uint8(1)
+	successReply    = uint8(0)
+	// maxUDPPacketSize is the maximum size of a UDP datagram
+	maxUDPPacketSize = 64 * 1024
+	// handshakeTimeout bounds the negotiation if ctx has no deadline
+	handshakeTimeout = 10 * time.Second
+)
+
+var (
+	errUnsupportedNetwork = errors.New("socks5: unsupported network")
+	errAuthFailed         = errors.New("socks5: authentication failed")
+)
+
+// replyMessages describes the reply codes of RFC 1928 section 6
+var replyMessages = []string{
+	"succeeded",
+	"general SOCKS server failure",
+	"connection not allowed by ruleset",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"TTL expired",
+	"command not supported",
+	"address type not supported",
+}
+
+func init() {
+	outbound.RegisterOutAdaptorFactory("socks5", NewSocks5OutAdaptor)
+}
+
+type Socks5Config struct {
+	// Address 上游SOCKS5服务器地址 host:port
+	Address string `json:"address"`
+	// UserName 不为空时使用用户名密码认证
+	UserName string `json:"user_name,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+type Socks5OutAdaptor struct {
+	conf   *Socks5Config
+	dialer net.Dialer
+}
+
+func NewSocks5OutAdaptor(config json.RawMessage) (outbound.OutAdaptor, error) {
+	conf := &Socks5Config{}
+	err := json.Unmarshal(config, conf)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := net.SplitHostPort(conf.Address); err != nil {
+		return nil, fmt.Errorf("invalid socks5 server address: %w", err)
+	}
+	if len(conf.UserName) > socks.MaxAuthLen || len(conf.Password) > socks.MaxAuthLen {
+		return nil, errors.New("socks5 user name or password too long")
+	}
+	return &Socks5OutAdaptor{conf: conf}, nil
+}
+
+func (s *Socks5OutAdaptor) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if !strings.HasPrefix(network, "tcp") {
+		return nil, errUnsupportedNetwork
+	}
+	dest, err := common.ParseAddrSpec(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, _, err := s.request(ctx, socks.ConnectCommand, dest)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// ListenPacket asks the server for a UDP association, the association lasts
+// as long as the returned conn
+func (s *Socks5OutAdaptor) ListenPacket(ctx context.Context, network, addr string) (net.PacketConn, error) {
+	// 客户端将从任意地址发送数据包，地址未知时填0
+	conn, relay, err := s.request(ctx, socks.AssociateCommand, nil)
+	if err != nil {
+		return nil, err
+	}
+	// 服务器返回未指定地址时使用服务器的地址
+	if relay.IP == nil || relay.IP.IsUnspecified() {
+		relay.IP = conn.RemoteAddr().(*net.TCPAddr).IP
+		relay.FQDN = ""
+	}
+	relayAddr, err := net.ResolveUDPAddr("udp", relay.Address())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	var lc net.ListenConfig
+	udpConn, err := lc.ListenPacket(ctx, "udp", "")
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	pc := &packetConn{PacketConn: udpConn, control: conn, relay: relayAddr}
+	go pc.watchControl()
+	return pc, nil
+}
+
+// LookupHost resolves locally, SOCKS5 has no command for name resolution
+func (s *Socks5OutAdaptor) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return net.DefaultResolver.LookupHost(ctx, host)
+}
+
+func (s *Socks5OutAdaptor) Close() error {
+	return nil
+}
+
+// request connects to the server, authenticates and sends the command, the
+// connection and the bound address of the reply are returned
+func (s *Socks5OutAdaptor) request(ctx context.Context, cmd uint8, dest *common.AddrSpec) (net.Conn, *common.AddrSpec, error) {
+	conn, err := s.dialer.DialContext(ctx, "tcp", s.conf.Address)
+	if err != nil {
+		return nil, nil, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(handshakeTimeout)
+	}
+	_ = conn.SetDeadline(deadline)
+
+	bound, err := s.handshake(conn, cmd, dest)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, bound, nil
+}
+
+func (s *Socks5OutAdaptor) handshake(conn net.Conn, cmd uint8, dest *common.AddrSpec) (*common.AddrSpec, error) {
+	methods := []byte{socks.NoAuth}
+	if s.conf.UserName != "" {
+		methods = []byte{socks.UserPassAuth}
+	}
+	if _, err := conn.Write(append([]byte{socks.Socks5Version, byte(len(methods))}, methods...)); err != nil {
+		return nil, err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, err
+	}
+	if reply[0] != socks.Socks5Version {
+		return nil, fmt.Errorf("socks5: unexpected version %d", reply[0])
+	}
+	switch reply[1] {
+	case socks.NoAuth:
+	case socks.UserPassAuth:
+		if err := s.authenticate(conn); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, socks.NoSupportedAuth
+	}
+
+	// VER CMD RSV ATYP DST.ADDR DST.PORT
+	msg, err := common.AppendAddrSpec([]byte{socks.Socks5Version, cmd, 0}, dest)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	// VER REP RSV ATYP BND.ADDR BND.PORT
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[1] != successReply {
+		if int(header[1]) < len(replyMessages) {
+			return nil, fmt.Errorf("socks5: %s", replyMessages[header[1]])
+		}
+		return nil, fmt.Errorf("socks5: unknown reply %d", header[1])
+	}
+	return common.ReadAddrSpec(conn)
+}
+
+// authenticate sends the user name and password, RFC 1929
+func (s *Socks5OutAdaptor) authenticate(conn net.Conn) error {
+	msg := []byte{userAuthVersion, byte(len(s.conf.UserName))}
+	msg = append(msg, s.conf.UserName...)
+	msg = append(msg, byte(len(s.conf.Password)))
+	msg = append(msg, s.conf.Password...)
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != successReply {
+		return errAuthFailed
+	}
+	return nil
+}
+
+// packetConn relays datagrams through the UDP relay of the server, each one
+// prefixed with the request header
+type packetConn struct {
+	net.PacketConn
+	control net.Conn
+	relay   *net.UDPAddr
+
+	closeOnce sync.Once
+}
+
+// watchControl closes the packet conn when the server ends the association
+func (c *packetConn) watchControl() {
+	_, _ = io.Copy(io.Discard, c.control)
+	c.Close()
+}
+
+func (c *packetConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	dest, err := common.ParseAddrSpec(addr.String())
+	if err != nil {
+		return 0, err
+	}
+	// RSV RSV FRAG ATYP DST.ADDR DST.PORT DATA
+	packet, err := common.AppendAddrSpec([]byte{0, 0, 0}, dest)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.PacketConn.WriteTo(append(packet, p...), c.relay); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *packetConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		n, from, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		// 忽略不是来自中继的和分片的数据包
+		udpAddr, ok := from.(*net.UDPAddr)
+		if !ok || !udpAddr.IP.Equal(c.relay.IP) || udpAddr.Port != c.relay.Port || n < 4 || buf[2] != 0 {
+			continue
+		}
+		r := bytes.NewReader(buf[3:n])
+		src, err := common.ReadAddrSpec(r)
+		if err != nil || src.IP == nil {
+			continue
+		}
+		return copy(p, buf[n-r.Len():n]), &net.UDPAddr{IP: src.IP, Port: src.Port}, nil
+	}
+}
+
+func (c *packetConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.control.Close()
+		err = c.PacketConn.Close()
+	})
+	return err
+}
@@ -0,0 +1,74 @@
+package socks5
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ido2021/light-proxy/adaptor/inbound/socks"
+	"github.com/ido2021/light-proxy/adaptor/internal/testutil"
+	"github.com/ido2021/light-proxy/adaptor/outbound"
+)
+
+// startServer serves the socks5 inbound
+func startServer(t *testing.T, config string) string {
+	router := testutil.NewRouter(t)
+	adaptor, err := socks.NewSocks5Adaptor("test", json.RawMessage(config))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	s5 := adaptor.(*socks.Socks5InAdaptor)
+	return testutil.Serve(t, func(conn net.Conn) {
+		s5.HandleConn(context.Background(), conn, router)
+	}).Addr().String()
+}
+
+func newOutAdaptor(t *testing.T, config string) outbound.OutAdaptor {
+	return testutil.NewOutAdaptor(t, NewSocks5OutAdaptor, json.RawMessage(config))
+}
+
+func TestSocks5OutAdaptor_Dial(t *testing.T) {
+	echo := testutil.EchoTCP(t)
+	addr := startServer(t, `{"users": [{"user_name": "foo", "password": "bar"}]}`)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	outAdaptor := newOutAdaptor(t, `{"address": "`+addr+`", "user_name": "foo", "password": "bar"}`)
+	conn, err := outAdaptor.Dial(ctx, "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	if err := testutil.Ping(conn); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for _, config := range []string{
+		`{"address": "` + addr + `", "user_name": "foo", "password": "baz"}`,
+		`{"address": "` + addr + `"}`,
+	} {
+		if _, err := newOutAdaptor(t, config).Dial(ctx, "tcp", echo.Addr().String()); err == nil {
+			t.Fatalf("%s: expect error", config)
+		}
+	}
+
+	if _, err := NewSocks5OutAdaptor(json.RawMessage(`{"address": "127.0.0.1"}`)); err == nil {
+		t.Fatal("expect error")
+	}
+}
+
+func TestSocks5OutAdaptor_ListenPacket(t *testing.T) {
+	echo := testutil.EchoUDP(t)
+	addr := startServer(t, `{}`)
+	outAdaptor := newOutAdaptor(t, `{"address": "`+addr+`"}`)
+	conn, err := outAdaptor.ListenPacket(context.Background(), "udp4", "")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	if err := testutil.PingPacket(conn, echo.LocalAddr()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
@@ -0,0 +1,54 @@
+package outbound
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// DomainStrategy 决定目标为域名时是否在本地解析，以及解析后使用的地址族
+type DomainStrategy string
+
+const (
+	// AsIs 不在本地解析，把域名直接交给接出代理拨号
+	AsIs       DomainStrategy = "as_is"
+	PreferIPv4 DomainStrategy = "prefer_ipv4"
+	PreferIPv6 DomainStrategy = "prefer_ipv6"
+	IPv4Only   DomainStrategy = "ipv4_only"
+	IPv6Only   DomainStrategy = "ipv6_only"
+)
+
+// ParseDomainStrategy checks the configured strategy, empty means resolving
+// locally and picking an address of any family
+func ParseDomainStrategy(s string) (DomainStrategy, error) {
+	strategy := DomainStrategy(s)
+	switch strategy {
+	case "", AsIs, PreferIPv4, PreferIPv6, IPv4Only, IPv6Only:
+		return strategy, nil
+	default:
+		return "", fmt.Errorf("unknown domain strategy: %s", s)
+	}
+}
+
+// allow reports whether an address of this family may be used
+func (s DomainStrategy) allow(addr netip.Addr) bool {
+	switch s {
+	case IPv4Only:
+		return addr.Is4()
+	case IPv6Only:
+		return addr.Is6()
+	default:
+		return true
+	}
+}
+
+// prefer reports whether the address is of the preferred family
+func (s DomainStrategy) prefer(addr netip.Addr) bool {
+	switch s {
+	case PreferIPv4:
+		return addr.Is4()
+	case PreferIPv6:
+		return addr.Is6()
+	default:
+		return true
+	}
+}
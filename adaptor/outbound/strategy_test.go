@@ -0,0 +1,70 @@
+package outbound
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/ido2021/light-proxy/common"
+)
+
+// staticOutAdaptor resolves every host to the same addresses
+type staticOutAdaptor struct {
+	DirectOutAdaptor
+	addrs []string
+}
+
+func (s *staticOutAdaptor) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return s.addrs, nil
+}
+
+func TestDomainStrategy(t *testing.T) {
+	cases := []struct {
+		strategy DomainStrategy
+		addrs    []string
+		expected string
+	}{
+		{PreferIPv4, []string{"2001:db8::1", "192.0.2.1"}, "192.0.2.1"},
+		{PreferIPv4, []string{"2001:db8::1"}, "2001:db8::1"},
+		{PreferIPv6, []string{"192.0.2.1", "2001:db8::1"}, "2001:db8::1"},
+		{IPv4Only, []string{"2001:db8::1", "::ffff:192.0.2.1"}, "192.0.2.1"},
+		{IPv6Only, []string{"192.0.2.1", "2001:db8::1"}, "2001:db8::1"},
+		{IPv6Only, []string{"192.0.2.1"}, ""},
+	}
+	for i, c := range cases {
+		wrapper := NewWrapperOutAdaptor(&staticOutAdaptor{addrs: c.addrs})
+		wrapper.SetDomainStrategy(c.strategy)
+		ip, err := wrapper.Resolve(context.Background(), "example.com")
+		if c.expected == "" {
+			if err == nil {
+				t.Fatalf("case %d: expect error, got %s", i, ip)
+			}
+		} else if err != nil || !ip.Equal(net.ParseIP(c.expected)) {
+			t.Fatalf("case %d: bad: %s %v", i, ip, err)
+		}
+		wrapper.Close()
+	}
+}
+
+func TestResolveDest(t *testing.T) {
+	wrapper := NewWrapperOutAdaptor(&staticOutAdaptor{addrs: []string{"192.0.2.1"}})
+	defer wrapper.Close()
+
+	wrapper.SetDomainStrategy(AsIs)
+	dest := &common.AddrSpec{FQDN: "example.com", Port: 443}
+	if err := wrapper.ResolveDest(context.Background(), dest); err != nil || dest.IP != nil {
+		t.Fatalf("bad: %v %v", dest, err)
+	}
+	if dest.Address() != "example.com:443" {
+		t.Fatalf("bad address: %s", dest.Address())
+	}
+
+	wrapper.SetDomainStrategy(PreferIPv6)
+	if err := wrapper.ResolveDest(context.Background(), dest); err != nil || dest.Address() != "192.0.2.1:443" {
+		t.Fatalf("bad: %v %v", dest, err)
+	}
+
+	if _, err := ParseDomainStrategy("prefer_ipv5"); err == nil {
+		t.Fatal("expect error")
+	}
+}
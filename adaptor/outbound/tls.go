@@ -0,0 +1,45 @@
+package outbound
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+)
+
+// TLSConfig 连接上游代理服务器的TLS配置
+type TLSConfig struct {
+	// ServerName SNI及校验证书的域名，默认为服务器地址中的域名
+	ServerName string `json:"serverName,omitempty"`
+	// CA PEM格式的CA证书文件，配置后只信任该文件中的CA
+	CA string `json:"ca,omitempty"`
+	// Insecure 不校验服务器证书
+	Insecure bool `json:"insecure,omitempty"`
+}
+
+// Build returns the client config for the server at serverAddr, host:port
+func (c *TLSConfig) Build(serverAddr string) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.Insecure,
+	}
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(serverAddr)
+		if err != nil {
+			return nil, err
+		}
+		config.ServerName = host
+	}
+	if c.CA != "" {
+		pem, err := os.ReadFile(c.CA)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in ca: " + c.CA)
+		}
+	}
+	return config, nil
+}
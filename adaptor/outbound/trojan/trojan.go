@@ -0,0 +1,170 @@
+// Package trojan is an outbound to a Trojan server over TLS, TCP with the
+// CONNECT command and UDP with UDP ASSOCIATE.
+package trojan
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ido2021/light-proxy/adaptor/outbound"
+	"github.com/ido2021/light-proxy/common"
+	trojan2 "github.com/ido2021/light-proxy/common/trojan"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// handshakeTimeout bounds the TLS handshake if ctx has no deadline
+const handshakeTimeout = 10 * time.Second
+
+var (
+	errUnsupportedNetwork = errors.New("trojan: unsupported network")
+)
+
+func init() {
+	outbound.RegisterOutAdaptorFactory("trojan", NewTrojanOutAdaptor)
+}
+
+type TrojanConfig struct {
+	// Address 服务器地址 host:port
+	Address  string `json:"address"`
+	Password string `json:"password"`
+	// TLS 为空时使用系统CA校验服务器证书
+	TLS *outbound.TLSConfig `json:"tls,omitempty"`
+}
+
+type TrojanOutAdaptor struct {
+	conf      *TrojanConfig
+	key       []byte
+	tlsConfig *tls.Config
+	dialer    net.Dialer
+}
+
+func NewTrojanOutAdaptor(config json.RawMessage) (outbound.OutAdaptor, error) {
+	conf := &TrojanConfig{}
+	err := json.Unmarshal(config, conf)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := net.SplitHostPort(conf.Address); err != nil {
+		return nil, fmt.Errorf("invalid trojan server address: %w", err)
+	}
+	if conf.Password == "" {
+		return nil, errors.New("trojan password is empty")
+	}
+	tlsConf := conf.TLS
+	if tlsConf == nil {
+		tlsConf = &outbound.TLSConfig{}
+	}
+	adaptor := &TrojanOutAdaptor{conf: conf, key: trojan2.Key(conf.Password)}
+	if adaptor.tlsConfig, err = tlsConf.Build(conf.Address); err != nil {
+		return nil, err
+	}
+	return adaptor, nil
+}
+
+func (t *TrojanOutAdaptor) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if !strings.HasPrefix(network, "tcp") {
+		return nil, errUnsupportedNetwork
+	}
+	dest, err := common.ParseAddrSpec(addr)
+	if err != nil {
+		return nil, err
+	}
+	return t.request(ctx, trojan2.ConnectCommand, dest)
+}
+
+// ListenPacket relays the UDP packets through one TLS connection, the
+// association lasts as long as the returned conn
+func (t *TrojanOutAdaptor) ListenPacket(ctx context.Context, network, addr string) (net.PacketConn, error) {
+	conn, err := t.request(ctx, trojan2.AssociateCommand, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &packetConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// LookupHost resolves locally, Trojan has no name resolution
+func (t *TrojanOutAdaptor) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return net.DefaultResolver.LookupHost(ctx, host)
+}
+
+func (t *TrojanOutAdaptor) Close() error {
+	return nil
+}
+
+// request connects to the server and sends the request header, a nil dest
+// is sent as 0.0.0.0:0
+func (t *TrojanOutAdaptor) request(ctx context.Context, cmd uint8, dest *common.AddrSpec) (net.Conn, error) {
+	addr, err := common.AppendAddrSpec(nil, dest)
+	if err != nil {
+		return nil, err
+	}
+	header := trojan2.AppendRequest(nil, t.key, cmd, addr)
+	conn, err := t.dialer.DialContext(ctx, "tcp", t.conf.Address)
+	if err != nil {
+		return nil, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(handshakeTimeout)
+	}
+	_ = conn.SetDeadline(deadline)
+
+	tlsConn := tls.Client(conn, t.tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := tlsConn.Write(header); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// packetConn frames the UDP packets on the stream of an association
+type packetConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	writeMu sync.Mutex
+}
+
+func (c *packetConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	dest, err := common.ParseAddrSpec(addr.String())
+	if err != nil {
+		return 0, err
+	}
+	b, err := common.AppendAddrSpec(nil, dest)
+	if err != nil {
+		return 0, err
+	}
+	packet := trojan2.AppendPacket(nil, b, p)
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if _, err := c.Conn.Write(packet); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *packetConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		addr, payload, err := trojan2.ReadPacket(c.reader)
+		if err != nil {
+			return 0, nil, err
+		}
+		src, err := common.ReadAddrSpec(bytes.NewReader(addr))
+		if err != nil || src.IP == nil {
+			continue
+		}
+		return copy(p, payload), &net.UDPAddr{IP: src.IP, Port: src.Port}, nil
+	}
+}
@@ -0,0 +1,21 @@
+package trojan
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestNewTrojanOutAdaptor(t *testing.T) {
+	if _, err := NewTrojanOutAdaptor(json.RawMessage(`{"address": "example.com:443", "password": "foo"}`)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, config := range []string{
+		`{"address": "example.com", "password": "foo"}`,
+		`{"address": "example.com:443"}`,
+		`{"address": "example.com:443", "password": "foo", "tls": {"ca": "/nonexistent"}}`,
+	} {
+		if _, err := NewTrojanOutAdaptor(json.RawMessage(config)); err == nil {
+			t.Fatalf("%s: expect error", config)
+		}
+	}
+}
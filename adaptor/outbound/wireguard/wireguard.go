@@ -37,9 +37,10 @@ type WireGuardConfig struct {
 }
 
 type WireGuardOutAdaptor struct {
-	net       *netstack.Net
-	device    *device.Device
-	systemDNS bool
+	net        *netstack.Net
+	device     *device.Device
+	deviceAddr []netip.Addr
+	systemDNS  bool
 }
 
 func NewWireGuardOutAdaptor(config json.RawMessage) (outbound.OutAdaptor, error) {
@@ -55,6 +56,35 @@ func (wg *WireGuardOutAdaptor) Dial(ctx context.Context, network, addr string) (
 	return wg.net.DialContext(ctx, network, addr)
 }
 
+func (wg *WireGuardOutAdaptor) Listen(ctx context.Context, network, addr string) (net.Listener, error) {
+	laddr, err := wg.localAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return wg.net.ListenTCPAddrPort(laddr)
+}
+
+func (wg *WireGuardOutAdaptor) ListenPacket(ctx context.Context, network, addr string) (net.PacketConn, error) {
+	laddr, err := wg.localAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return wg.net.ListenUDPAddrPort(laddr)
+}
+
+// localAddr parses addr, 未指定本地地址时，使用与network同族的隧道地址
+func (wg *WireGuardOutAdaptor) localAddr(network, addr string) (netip.AddrPort, error) {
+	if addr != "" {
+		return netip.ParseAddrPort(addr)
+	}
+	for _, deviceAddr := range wg.deviceAddr {
+		if strings.HasSuffix(network, "6") == deviceAddr.Is6() {
+			return netip.AddrPortFrom(deviceAddr, 0), nil
+		}
+	}
+	return netip.AddrPort{}, fmt.Errorf("no %s address configured for wireguard", network)
+}
+
 func (wg *WireGuardOutAdaptor) LookupHost(ctx context.Context, host string) (addrs []string, err error) {
 	return wg.net.LookupContextHost(ctx, host)
 }
@@ -155,8 +185,9 @@ func StartWireguard(conf *WireGuardConfig, logLevel int) (outbound.OutAdaptor, e
 	}
 
 	return &WireGuardOutAdaptor{
-		net:       tnet,
-		systemDNS: len(setting.dns) == 0,
-		device:    dev,
+		net:        tnet,
+		systemDNS:  len(setting.dns) == 0,
+		device:     dev,
+		deviceAddr: setting.deviceAddr,
 	}, nil
 }
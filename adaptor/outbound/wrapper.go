@@ -0,0 +1,105 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"github.com/ido2021/light-proxy/common"
+	"math/rand"
+	"net"
+	"net/netip"
+)
+
+// HostResolver resolves the destinations given as domain for an outbound
+type HostResolver interface {
+	LookupHost(ctx context.Context, host string) (addrs []string, err error)
+}
+
+type WrapperOutAdaptor struct {
+	OutAdaptor
+	resolver HostResolver
+	strategy DomainStrategy
+}
+
+func NewWrapperOutAdaptor(outAdaptor OutAdaptor) *WrapperOutAdaptor {
+	return &WrapperOutAdaptor{
+		OutAdaptor: outAdaptor,
+	}
+}
+
+// SetResolver sets the resolver used by Resolve, the LookupHost of the
+// outbound itself is used if none is set
+func (wrapper *WrapperOutAdaptor) SetResolver(resolver HostResolver) {
+	wrapper.resolver = resolver
+}
+
+func (wrapper *WrapperOutAdaptor) lookupHost(ctx context.Context, host string) ([]string, error) {
+	if wrapper.resolver != nil {
+		return wrapper.resolver.LookupHost(ctx, host)
+	}
+	return wrapper.OutAdaptor.LookupHost(ctx, host)
+}
+
+// SetDomainStrategy sets how destinations given as domain are resolved
+func (wrapper *WrapperOutAdaptor) SetDomainStrategy(strategy DomainStrategy) {
+	wrapper.strategy = strategy
+}
+
+// Resolve returns a random address of host allowed by the domain strategy,
+// addresses of the preferred family are picked first
+func (wrapper *WrapperOutAdaptor) Resolve(ctx context.Context, host string) (net.IP, error) {
+	addrs, err := wrapper.lookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var allowed, preferred []netip.Addr
+	for _, saddr := range addrs {
+		addr, err := netip.ParseAddr(saddr)
+		if err != nil {
+			continue
+		}
+		addr = addr.Unmap()
+		if !wrapper.strategy.allow(addr) {
+			continue
+		}
+		allowed = append(allowed, addr)
+		if wrapper.strategy.prefer(addr) {
+			preferred = append(preferred, addr)
+		}
+	}
+	if len(preferred) > 0 {
+		allowed = preferred
+	}
+	if len(allowed) == 0 {
+		return nil, errors.New("no address found for: " + host)
+	}
+
+	return allowed[rand.Intn(len(allowed))].AsSlice(), nil
+}
+
+// ResolveDest fills in the IP of a destination given as domain, the domain is
+// kept and dialed by the outbound itself when the strategy is as_is
+func (wrapper *WrapperOutAdaptor) ResolveDest(ctx context.Context, dest *common.AddrSpec) error {
+	if dest.FQDN == "" || dest.IP != nil || wrapper.strategy == AsIs {
+		return nil
+	}
+	ip, err := wrapper.Resolve(ctx, dest.FQDN)
+	if err != nil {
+		return err
+	}
+	dest.IP = ip
+	return nil
+}
+
+// Listen accepts incoming connections through the outbound if it implements Listener
+func (wrapper *WrapperOutAdaptor) Listen(ctx context.Context, network, addr string) (net.Listener, error) {
+	listener, ok := wrapper.OutAdaptor.(Listener)
+	if !ok {
+		return nil, ErrListenNotSupported
+	}
+	return listener.Listen(ctx, network, addr)
+}
+
+func (wrapper *WrapperOutAdaptor) Close() error {
+	return wrapper.OutAdaptor.Close()
+}
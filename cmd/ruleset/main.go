@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"github.com/ido2021/light-proxy/route"
+	"log"
+	"os"
+)
+
+// 将文本格式的规则集编译为二进制格式
+func main() {
+	ipCidr := flag.Bool("ipcidr", false, "input is a CIDR list instead of a domain list")
+	output := flag.String("o", "ruleset.bin", "output file")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		log.Fatal("usage: ruleset [-ipcidr] [-o output] input")
+	}
+
+	set, err := route.LoadRuleSet(flag.Arg(0), *ipCidr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	f, err := os.Create(*output)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	if err := route.WriteRuleSet(f, set); err != nil {
+		log.Fatal(err)
+	}
+}
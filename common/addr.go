@@ -0,0 +1,88 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+const (
+	// MaxAddrLen is the maximum size of SOCKS address in bytes.
+	MaxAddrLen = 1 + 1 + 255 + 2
+
+	// SOCKS address types as defined in RFC 1928 section 5.
+	AtypIPv4       = 0x01
+	AtypDomainName = 0x03
+	AtypIPv6       = 0x04
+)
+
+var (
+	ErrUnrecognizedAddrType = errors.New("unrecognized address type")
+)
+
+// ReadAddr reads an address in the SOCKS5 encoding, ATYP followed by the
+// address and the port, and returns it still encoded
+func ReadAddr(r io.Reader) ([]byte, error) {
+	addr := make([]byte, 2, MaxAddrLen)
+	if _, err := io.ReadFull(r, addr); err != nil {
+		return nil, err
+	}
+	// 剩余的地址及端口长度
+	var n int
+	switch addr[0] {
+	case AtypIPv4:
+		n = 4 - 1 + 2
+	case AtypIPv6:
+		n = 16 - 1 + 2
+	case AtypDomainName:
+		n = int(addr[1]) + 2
+	default:
+		return nil, ErrUnrecognizedAddrType
+	}
+	addr = addr[:2+n]
+	if _, err := io.ReadFull(r, addr[2:]); err != nil {
+		return nil, err
+	}
+	return addr, nil
+}
+
+// ReadAddrSpec reads an address in the SOCKS5 encoding
+func ReadAddrSpec(r io.Reader) (*AddrSpec, error) {
+	addr, err := ReadAddr(r)
+	if err != nil {
+		return nil, err
+	}
+	port := addr[len(addr)-2:]
+	d := &AddrSpec{Port: int(port[0])<<8 | int(port[1])}
+	if addr[0] == AtypDomainName {
+		d.FQDN = string(addr[2 : len(addr)-2])
+	} else {
+		d.IP = net.IP(addr[1 : len(addr)-2])
+	}
+	return d, nil
+}
+
+// AppendAddrSpec appends ATYP, the address and the port of addr to b.
+// A nil addr is encoded as 0.0.0.0:0
+func AppendAddrSpec(b []byte, addr *AddrSpec) ([]byte, error) {
+	switch {
+	case addr == nil:
+		return append(b, AtypIPv4, 0, 0, 0, 0, 0, 0), nil
+	case addr.FQDN != "":
+		if len(addr.FQDN) > 255 {
+			return nil, fmt.Errorf("Failed to format address: %v", addr)
+		}
+		b = append(b, AtypDomainName, byte(len(addr.FQDN)))
+		b = append(b, addr.FQDN...)
+	case addr.IP.To4() != nil:
+		b = append(b, AtypIPv4)
+		b = append(b, addr.IP.To4()...)
+	case addr.IP.To16() != nil:
+		b = append(b, AtypIPv6)
+		b = append(b, addr.IP.To16()...)
+	default:
+		return nil, fmt.Errorf("Failed to format address: %v", addr)
+	}
+	return append(b, byte(addr.Port>>8), byte(addr.Port)), nil
+}
@@ -0,0 +1,38 @@
+package common
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestAddrSpec_Codec(t *testing.T) {
+	for _, addr := range []*AddrSpec{
+		{IP: net.IPv4(127, 0, 0, 1), Port: 53},
+		{IP: net.ParseIP("fd00::1"), Port: 443},
+		{FQDN: "example.com", Port: 80},
+	} {
+		b, err := AppendAddrSpec([]byte{0}, addr)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		out, err := ReadAddrSpec(bytes.NewReader(b[1:]))
+		if err != nil || out.Address() != addr.Address() {
+			t.Fatalf("bad: %v %v", out, err)
+		}
+	}
+
+	if b, _ := AppendAddrSpec(nil, nil); !bytes.Equal(b, []byte{AtypIPv4, 0, 0, 0, 0, 0, 0}) {
+		t.Fatalf("bad: %v", b)
+	}
+	if _, err := AppendAddrSpec(nil, &AddrSpec{FQDN: strings.Repeat("a", 256)}); err == nil {
+		t.Fatal("expect error")
+	}
+	if _, err := ReadAddrSpec(bytes.NewReader([]byte{9, 0, 0})); err != ErrUnrecognizedAddrType {
+		t.Fatalf("bad: %v", err)
+	}
+	if _, err := ReadAddrSpec(bytes.NewReader([]byte{AtypIPv4, 127, 0})); err == nil {
+		t.Fatal("expect error")
+	}
+}
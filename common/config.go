@@ -4,13 +4,17 @@ import "encoding/json"
 
 // Config is used to setup and configure a Server
 type Config struct {
-	Inbounds []Inbound `json:"inbounds"`
-	Route    Route     `json:"route,omitempty"`
+	Inbounds  []Inbound  `json:"inbounds"`
+	Route     Route      `json:"route,omitempty"`
+	Outbounds []Outbound `json:"outbounds,omitempty"`
+	// Deprecated: 使用Outbounds，未配置tag时注册为proxy
 	Outbound *Outbound `json:"outbound,omitempty"`
+	DNS      DNS       `json:"dns,omitempty"`
 	Log      Log       `json:"log,omitempty"`
 }
 
 type Inbound struct {
+	Tag    string          `json:"tag,omitempty"`
 	Type   string          `json:"type"`
 	Config json.RawMessage `json:"config"`
 }
@@ -18,18 +22,120 @@ type Inbound struct {
 type Route struct {
 	Final string `json:"final,omitempty"`
 	Rules []Rule `json:"rules,omitempty"`
+	// GeoIPPath MaxMind mmdb格式的GeoIP数据库
+	GeoIPPath string `json:"geoipPath,omitempty"`
+	// GeositePath v2ray格式的geosite.dat，或每个分类一个域名列表文件的目录
+	GeositePath string `json:"geositePath,omitempty"`
 }
 
+// Rule 同一类条件之间为或关系，不同类条件之间为与关系：
+// (domain || domainSuffix || domainKeyword || domainRegex || geosite || ipCidr || geoip) && sourceIpCidr && (port || portRange) && sourcePort && inbound && user
+// type为logical时按mode(and|or)组合子规则rules，invert对任意规则的结果取反
 type Rule struct {
-	Domain       []string `json:"domain,omitempty"`
-	DomainSuffix []string `json:"domainSuffix,omitempty"`
-	DomainPath   string   `json:"domainPath,omitempty"`
-	Outbound     string   `json:"outbound"`
+	Type   string `json:"type,omitempty"`
+	Mode   string `json:"mode,omitempty"`
+	Rules  []Rule `json:"rules,omitempty"`
+	Invert bool   `json:"invert,omitempty"`
+
+	Domain []string `json:"domain,omitempty"`
+	// DomainSuffix 按label匹配，example.com匹配自身及子域名，.example.com只匹配子域名
+	DomainSuffix  []string `json:"domainSuffix,omitempty"`
+	DomainKeyword []string `json:"domainKeyword,omitempty"`
+	DomainRegex   []string `json:"domainRegex,omitempty"`
+	// Geosite 域名分类，支持属性过滤，例如 google@cn
+	Geosite []string `json:"geosite,omitempty"`
+	// DomainPath 域名规则集文件，支持v2ray域名列表格式及编译后的二进制格式
+	DomainPath string   `json:"domainPath,omitempty"`
+	IPCidr     []string `json:"ipCidr,omitempty"`
+	// IPCidrPath CIDR规则集文件，每行一个CIDR或编译后的二进制格式
+	IPCidrPath string `json:"ipCidrPath,omitempty"`
+	// GeoIP 国家代码，private匹配私有地址
+	GeoIP        []string `json:"geoip,omitempty"`
+	SourceIPCidr []string `json:"sourceIpCidr,omitempty"`
+	Port         []uint16 `json:"port,omitempty"`
+	// PortRange 格式为 1000-2000
+	PortRange  []string `json:"portRange,omitempty"`
+	SourcePort []uint16 `json:"sourcePort,omitempty"`
+	// Inbound 入站tag
+	Inbound []string `json:"inbound,omitempty"`
+	// User 认证的用户名，匿名访问不匹配
+	User []string `json:"user,omitempty"`
+	// Outbound 子规则不需要配置
+	Outbound string `json:"outbound,omitempty"`
 }
 
 type Outbound struct {
-	Type   string          `json:"type"`
-	Config json.RawMessage `json:"config"`
+	Tag  string `json:"tag"`
+	Type string `json:"type"`
+	// DomainStrategy 目标为域名时的处理方式：as_is由接出代理解析，
+	// prefer_ipv4、prefer_ipv6、ipv4_only、ipv6_only在本地解析并选择地址族，默认本地解析任意地址
+	DomainStrategy string          `json:"domainStrategy,omitempty"`
+	Config         json.RawMessage `json:"config"`
+}
+
+// DNS 未配置servers时，每个接出代理使用自身的解析器
+type DNS struct {
+	Servers []DNSServer `json:"servers,omitempty"`
+	// Rules 按顺序匹配查询的域名，选择DNS服务器
+	Rules []DNSRule `json:"rules,omitempty"`
+	// Final 未匹配任何规则时使用的服务器，默认为第一个服务器
+	Final string `json:"final,omitempty"`
+	// Fallback 选中的服务器查询失败时依次尝试的服务器
+	Fallback []string `json:"fallback,omitempty"`
+	// FakeIP 地址为fakeip的服务器从该地址池分配假地址
+	FakeIP *FakeIP `json:"fakeip,omitempty"`
+	// Hosts 静态解析，优先于DNS服务器。域名支持*.example.com通配所有子域名，
+	// 值为IP列表，或者单个域名表示别名，解析该域名代替
+	Hosts map[string][]string `json:"hosts,omitempty"`
+	// HostsPath /etc/hosts格式的文件，hosts中的配置优先
+	HostsPath string   `json:"hostsPath,omitempty"`
+	Cache     DNSCache `json:"cache,omitempty"`
+}
+
+// DNSCache 按TTL缓存应答，未配置servers时每个接出代理的解析器各自缓存
+type DNSCache struct {
+	// Size 最多缓存的应答数量，默认为4096
+	Size int `json:"size,omitempty"`
+	// MinTTL、MaxTTL 限制缓存时间的范围，单位秒，0为不限制
+	MinTTL uint32 `json:"minTtl,omitempty"`
+	MaxTTL uint32 `json:"maxTtl,omitempty"`
+	// NegativeTTL 没有SOA记录的NXDOMAIN或空应答的缓存时间，单位秒，默认为30
+	NegativeTTL uint32 `json:"negativeTtl,omitempty"`
+	// ServeStale 过期后继续用旧应答回复的时间，同时在后台刷新，单位秒，0为不启用
+	ServeStale uint32 `json:"serveStale,omitempty"`
+	// Prefetch 多次命中的应答在TTL剩余不足10%时提前在后台刷新
+	Prefetch bool `json:"prefetch,omitempty"`
+	// Path 不为空时缓存持久化到该文件，重启后仍然有效。未配置servers时每个接出代理使用Path加.tag的文件
+	Path string `json:"path,omitempty"`
+}
+
+type FakeIP struct {
+	// Inet4Range 默认为198.18.0.0/15
+	Inet4Range string `json:"inet4Range,omitempty"`
+	// Inet6Range 为空时AAAA查询返回空应答
+	Inet6Range string `json:"inet6Range,omitempty"`
+	// Size 最多保存的域名数量，超出时淘汰最久未使用的域名，默认为65536
+	Size int `json:"size,omitempty"`
+	// Path 不为空时映射持久化到该文件，重启后仍然有效
+	Path string `json:"path,omitempty"`
+}
+
+type DNSServer struct {
+	Tag string `json:"tag"`
+	// Address 支持 8.8.8.8、udp://8.8.8.8:53、tcp://8.8.8.8、tls://dns.google、
+	// https://dns.google/dns-query，local使用接出代理自身的解析器，fakeip使用假地址池
+	Address string `json:"address"`
+	// Detour 连接DNS服务器使用的接出代理，默认直连
+	Detour string `json:"detour,omitempty"`
+}
+
+type DNSRule struct {
+	Domain        []string `json:"domain,omitempty"`
+	DomainSuffix  []string `json:"domainSuffix,omitempty"`
+	DomainKeyword []string `json:"domainKeyword,omitempty"`
+	DomainRegex   []string `json:"domainRegex,omitempty"`
+	Geosite       []string `json:"geosite,omitempty"`
+	Server        string   `json:"server"`
 }
 
 type Log struct {
@@ -25,6 +25,14 @@ type AuthContext struct {
 	Payload map[string]string
 }
 
+// Username returns the authenticated user, empty for anonymous access
+func (a *AuthContext) Username() string {
+	if a == nil {
+		return ""
+	}
+	return a.Payload["Username"]
+}
+
 // AddrSpec is used to return the target AddrSpec
 // which may be specified as IPv4, IPv6, or a FQDN
 type AddrSpec struct {
@@ -49,6 +57,26 @@ func (a AddrSpec) Address() string {
 	return net.JoinHostPort(a.FQDN, strconv.Itoa(a.Port))
 }
 
+// ParseAddrSpec parses an address in host:port form, host is either an IP or
+// a domain
+func ParseAddrSpec(addr string) (*AddrSpec, error) {
+	host, sport, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(sport, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port: %s", addr)
+	}
+	spec := &AddrSpec{Port: int(port)}
+	if ip := net.ParseIP(host); ip != nil {
+		spec.IP = ip
+	} else {
+		spec.FQDN = host
+	}
+	return spec, nil
+}
+
 // A Request represents request received by a server
 type Request struct {
 	// Protocol
@@ -64,10 +92,17 @@ type Request struct {
 }
 
 type Metadata struct {
+	// Inbound is the tag of the inbound which accepted the request
+	Inbound string
+	// User is the authenticated user, empty for anonymous access
+	User string
 	// AddrSpec of the network that sent the request
 	RemoteAddr *AddrSpec
 	// AddrSpec of the desired destination
 	DestAddr *AddrSpec
+	// FakeAddr is the fake-IP destination whose domain was restored into
+	// DestAddr, UDP replies are sent back from it
+	FakeAddr *AddrSpec
 }
 
 //type conn interface {
@@ -0,0 +1,146 @@
+// Package shadowsocks implements the framing and encryption of Shadowsocks:
+// the AEAD ciphers of SIP004 and the 2022 edition of SIP022. The target
+// address is carried as plaintext in the SOCKS5 encoding, which the callers
+// read and write themselves.
+package shadowsocks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"lukechampine.com/blake3"
+)
+
+const (
+	// subkeyInfo is the HKDF info of the AEAD ciphers
+	subkeyInfo = "ss-subkey"
+	// sessionSubkeyContext is the BLAKE3 context of the 2022 ciphers
+	sessionSubkeyContext = "shadowsocks 2022 session subkey"
+)
+
+var (
+	ErrUnsupportedMethod = errors.New("shadowsocks: unsupported method")
+	ErrBadKey            = errors.New("shadowsocks: bad key")
+)
+
+type cipherInfo struct {
+	keySize int
+	is2022  bool
+	newAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+var ciphers = map[string]*cipherInfo{
+	"aes-128-gcm":                   {keySize: 16, newAEAD: newGCM},
+	"aes-256-gcm":                   {keySize: 32, newAEAD: newGCM},
+	"chacha20-ietf-poly1305":        {keySize: 32, newAEAD: chacha20poly1305.New},
+	"2022-blake3-aes-128-gcm":       {keySize: 16, is2022: true, newAEAD: newGCM},
+	"2022-blake3-aes-256-gcm":       {keySize: 32, is2022: true, newAEAD: newGCM},
+	"2022-blake3-chacha20-poly1305": {keySize: 32, is2022: true, newAEAD: chacha20poly1305.New},
+}
+
+// Method is a cipher with its key, the salt of every session has the size of
+// the key
+type Method struct {
+	name string
+	*cipherInfo
+	key []byte
+	// block 2022 AES的UDP分离头使用PSK加密
+	block cipher.Block
+	// udpAEAD 2022 chacha20-poly1305的UDP使用PSK的XChaCha20-Poly1305
+	udpAEAD cipher.AEAD
+}
+
+// NewMethod creates the cipher method with password, the 2022 ciphers take a
+// base64 key of the key size instead
+func NewMethod(method, password string) (*Method, error) {
+	info, exist := ciphers[method]
+	if !exist {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedMethod, method)
+	}
+	m := &Method{name: method, cipherInfo: info}
+	if !info.is2022 {
+		m.key = kdf(password, info.keySize)
+		return m, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(password)
+	if err != nil || len(key) != info.keySize {
+		return nil, fmt.Errorf("%w: %s needs a base64 key of %d bytes", ErrBadKey, method, info.keySize)
+	}
+	m.key = key
+	if method == "2022-blake3-chacha20-poly1305" {
+		m.udpAEAD, err = chacha20poly1305.NewX(key)
+	} else {
+		m.block, err = aes.NewCipher(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Method) Name() string {
+	return m.name
+}
+
+// Is2022 reports whether m is a SIP022 cipher
+func (m *Method) Is2022() bool {
+	return m.is2022
+}
+
+func (m *Method) saltSize() int {
+	return m.keySize
+}
+
+// sessionAEAD derives the subkey of a session from salt
+func (m *Method) sessionAEAD(salt []byte) (cipher.AEAD, error) {
+	subkey := make([]byte, m.keySize)
+	if m.is2022 {
+		material := make([]byte, 0, len(m.key)+len(salt))
+		material = append(append(material, m.key...), salt...)
+		blake3.DeriveKey(subkey, sessionSubkeyContext, material)
+	} else if _, err := io.ReadFull(hkdf.New(sha1.New, m.key, salt, []byte(subkeyInfo)), subkey); err != nil {
+		return nil, err
+	}
+	return m.newAEAD(subkey)
+}
+
+// kdf is EVP_BytesToKey of OpenSSL with MD5 and no salt
+func kdf(password string, keySize int) []byte {
+	var key, prev []byte
+	h := md5.New()
+	for len(key) < keySize {
+		h.Reset()
+		h.Write(prev)
+		h.Write([]byte(password))
+		key = h.Sum(key)
+		prev = key[len(key)-h.Size():]
+	}
+	return key[:keySize]
+}
+
+// increment increases the little endian nonce by one
+func increment(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
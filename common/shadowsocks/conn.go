@@ -0,0 +1,360 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	mrand "math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// maxPayloadSize is the maximum payload of a chunk of the AEAD ciphers
+	maxPayloadSize = 0x3FFF
+	// maxPayloadSize2022 is the maximum payload of a chunk of the 2022 ciphers
+	maxPayloadSize2022 = 0xFFFF
+	tagSize            = 16
+
+	headerTypeClient = 0
+	headerTypeServer = 1
+	// maxTimeDiff is the maximum difference of the timestamp in a 2022 header
+	maxTimeDiff = 30 * time.Second
+	// maxPaddingLength bounds the padding of a 2022 request without payload
+	maxPaddingLength = 900
+)
+
+var (
+	ErrBadHeader    = errors.New("shadowsocks: bad header")
+	ErrBadTimestamp = errors.New("shadowsocks: bad timestamp")
+	ErrReplay       = errors.New("shadowsocks: replayed salt")
+	errShortPacket  = errors.New("shadowsocks: short packet")
+)
+
+func (m *Method) maxPayload() int {
+	if m.is2022 {
+		return maxPayloadSize2022
+	}
+	return maxPayloadSize
+}
+
+// aeadWriter seals payloads into chunks, each a sealed length followed by
+// the sealed payload
+type aeadWriter struct {
+	aead       cipher.AEAD
+	nonce      []byte
+	maxPayload int
+}
+
+func newAEADWriter(aead cipher.AEAD, maxPayload int) *aeadWriter {
+	return &aeadWriter{aead: aead, nonce: make([]byte, aead.NonceSize()), maxPayload: maxPayload}
+}
+
+func (w *aeadWriter) seal(dst, plaintext []byte) []byte {
+	dst = w.aead.Seal(dst, w.nonce, plaintext, nil)
+	increment(w.nonce)
+	return dst
+}
+
+func (w *aeadWriter) appendChunks(dst, p []byte) []byte {
+	for len(p) > 0 {
+		n := len(p)
+		if n > w.maxPayload {
+			n = w.maxPayload
+		}
+		dst = w.seal(dst, []byte{byte(n >> 8), byte(n)})
+		dst = w.seal(dst, p[:n])
+		p = p[n:]
+	}
+	return dst
+}
+
+// aeadReader opens the chunks written by aeadWriter
+type aeadReader struct {
+	r     io.Reader
+	aead  cipher.AEAD
+	nonce []byte
+	// buf 未读取的明文
+	buf []byte
+}
+
+func newAEADReader(r io.Reader, aead cipher.AEAD) *aeadReader {
+	return &aeadReader{r: r, aead: aead, nonce: make([]byte, aead.NonceSize())}
+}
+
+// open reads and opens a sealed message of n bytes
+func (r *aeadReader) open(n int) ([]byte, error) {
+	b := make([]byte, n+r.aead.Overhead())
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		return nil, err
+	}
+	plaintext, err := r.aead.Open(b[:0], r.nonce, b, nil)
+	if err != nil {
+		return nil, err
+	}
+	increment(r.nonce)
+	return plaintext, nil
+}
+
+func (r *aeadReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		length, err := r.open(2)
+		if err != nil {
+			return 0, err
+		}
+		if r.buf, err = r.open(int(binary.BigEndian.Uint16(length))); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// Conn is an encrypted TCP session. The client sends the target address
+// with its first write, the server reads it as the first bytes of the stream
+type Conn struct {
+	net.Conn
+	method *Method
+	client bool
+	// addr 客户端首次写入时发送的目标地址
+	addr []byte
+	// requestSalt 客户端请求的salt，2022的响应头中包含该salt
+	requestSalt []byte
+
+	writeMu sync.Mutex
+	writer  *aeadWriter
+	reader  *aeadReader
+}
+
+// NewClientConn starts a session to the server on conn for the target addr,
+// which is in the SOCKS5 address encoding
+func NewClientConn(conn net.Conn, m *Method, addr []byte) *Conn {
+	return &Conn{Conn: conn, method: m, client: true, addr: addr}
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.write(p)
+}
+
+func (c *Conn) write(p []byte) (int, error) {
+	var buf []byte
+	var err error
+	if c.writer == nil {
+		if c.client {
+			buf, err = c.request(p)
+		} else {
+			buf, err = c.response(p)
+		}
+		if err != nil {
+			return 0, err
+		}
+	} else {
+		buf = c.writer.appendChunks(nil, p)
+	}
+	if _, err := c.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// newWriter starts the sealing of the written stream with a random salt
+func (c *Conn) newWriter() ([]byte, error) {
+	salt := make([]byte, c.method.saltSize())
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := c.method.sessionAEAD(salt)
+	if err != nil {
+		return nil, err
+	}
+	c.writer = newAEADWriter(aead, c.method.maxPayload())
+	return salt, nil
+}
+
+// request returns the salt and the request header followed by payload
+func (c *Conn) request(payload []byte) ([]byte, error) {
+	salt, err := c.newWriter()
+	if err != nil {
+		return nil, err
+	}
+	c.requestSalt = salt
+	if !c.method.is2022 {
+		return c.writer.appendChunks(salt, append(append([]byte(nil), c.addr...), payload...)), nil
+	}
+
+	// 可变长度头：地址、填充长度、填充、初始数据，没有初始数据时必须填充
+	header := append([]byte(nil), c.addr...)
+	padding := 0
+	if len(payload) == 0 {
+		padding = 1 + mrand.Intn(maxPaddingLength)
+	}
+	header = append(header, byte(padding>>8), byte(padding))
+	header = append(header, make([]byte, padding)...)
+	n := maxPayloadSize2022 - len(header)
+	if n > len(payload) {
+		n = len(payload)
+	}
+	header = append(header, payload[:n]...)
+
+	fixed := make([]byte, 1+8+2)
+	fixed[0] = headerTypeClient
+	binary.BigEndian.PutUint64(fixed[1:], uint64(time.Now().Unix()))
+	binary.BigEndian.PutUint16(fixed[9:], uint16(len(header)))
+	buf := c.writer.seal(salt, fixed)
+	buf = c.writer.seal(buf, header)
+	return c.writer.appendChunks(buf, payload[n:]), nil
+}
+
+// response returns the salt and the response header followed by payload
+func (c *Conn) response(payload []byte) ([]byte, error) {
+	salt, err := c.newWriter()
+	if err != nil {
+		return nil, err
+	}
+	if !c.method.is2022 {
+		return c.writer.appendChunks(salt, payload), nil
+	}
+
+	n := len(payload)
+	if n > maxPayloadSize2022 {
+		n = maxPayloadSize2022
+	}
+	fixed := make([]byte, 1+8+len(c.requestSalt)+2)
+	fixed[0] = headerTypeServer
+	binary.BigEndian.PutUint64(fixed[1:], uint64(time.Now().Unix()))
+	copy(fixed[9:], c.requestSalt)
+	binary.BigEndian.PutUint16(fixed[9+len(c.requestSalt):], uint16(n))
+	buf := c.writer.seal(salt, fixed)
+	buf = c.writer.seal(buf, payload[:n])
+	return c.writer.appendChunks(buf, payload[n:]), nil
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	if c.reader == nil {
+		// 服务器先发送数据的协议，先发送请求头
+		c.writeMu.Lock()
+		var err error
+		if c.writer == nil {
+			_, err = c.write(nil)
+		}
+		c.writeMu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		if err := c.readResponse(); err != nil {
+			return 0, err
+		}
+	}
+	return c.reader.Read(p)
+}
+
+// readResponse reads the salt and the response header of the server
+func (c *Conn) readResponse() error {
+	salt := make([]byte, c.method.saltSize())
+	if _, err := io.ReadFull(c.Conn, salt); err != nil {
+		return err
+	}
+	aead, err := c.method.sessionAEAD(salt)
+	if err != nil {
+		return err
+	}
+	reader := newAEADReader(c.Conn, aead)
+	if c.method.is2022 {
+		fixed, err := reader.open(1 + 8 + len(c.requestSalt) + 2)
+		if err != nil {
+			return err
+		}
+		if fixed[0] != headerTypeServer || !bytes.Equal(fixed[9:9+len(c.requestSalt)], c.requestSalt) {
+			return ErrBadHeader
+		}
+		if err := checkTimestamp(fixed[1:9]); err != nil {
+			return err
+		}
+		if reader.buf, err = reader.open(int(binary.BigEndian.Uint16(fixed[9+len(c.requestSalt):]))); err != nil {
+			return err
+		}
+	}
+	c.reader = reader
+	return nil
+}
+
+func checkTimestamp(b []byte) error {
+	diff := time.Since(time.Unix(int64(binary.BigEndian.Uint64(b)), 0))
+	if diff > maxTimeDiff || diff < -maxTimeDiff {
+		return ErrBadTimestamp
+	}
+	return nil
+}
+
+// Accept reads the request header of a session with one of methods, which
+// differ only in their keys, and returns the session and the index of the
+// method. The target address is the first bytes read from the session,
+// followed by the padding for the 2022 ciphers which SkipPadding skips
+func Accept(conn net.Conn, methods []*Method, filter *SaltFilter) (*Conn, int, error) {
+	if len(methods) == 0 {
+		return nil, 0, ErrBadHeader
+	}
+	first := methods[0]
+	headerSize := 2
+	if first.is2022 {
+		headerSize = 1 + 8 + 2
+	}
+	b := make([]byte, first.saltSize()+headerSize+tagSize)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return nil, 0, err
+	}
+	salt, sealed := b[:first.saltSize()], b[first.saltSize():]
+
+	// 依次尝试每个用户的密钥
+	for i, m := range methods {
+		aead, err := m.sessionAEAD(salt)
+		if err != nil {
+			return nil, 0, err
+		}
+		reader := newAEADReader(conn, aead)
+		header, err := aead.Open(nil, reader.nonce, sealed, nil)
+		if err != nil {
+			continue
+		}
+		increment(reader.nonce)
+		if filter != nil && !filter.Check(salt) {
+			return nil, i, ErrReplay
+		}
+
+		length := int(binary.BigEndian.Uint16(header[len(header)-2:]))
+		if m.is2022 {
+			if header[0] != headerTypeClient {
+				return nil, i, ErrBadHeader
+			}
+			if err := checkTimestamp(header[1:9]); err != nil {
+				return nil, i, err
+			}
+		}
+		if reader.buf, err = reader.open(length); err != nil {
+			return nil, i, err
+		}
+		return &Conn{Conn: conn, method: m, requestSalt: salt, reader: reader}, i, nil
+	}
+	return nil, 0, ErrBadHeader
+}
+
+// SkipPadding skips the padding following the target address of a 2022
+// request, it does nothing for the AEAD ciphers
+func (c *Conn) SkipPadding() error {
+	if !c.method.is2022 {
+		return nil
+	}
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(c, length); err != nil {
+		return err
+	}
+	_, err := io.CopyN(io.Discard, c, int64(binary.BigEndian.Uint16(length)))
+	return err
+}
@@ -0,0 +1,96 @@
+package shadowsocks
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// saltTTL2022 covers the allowed timestamp difference of the 2022 headers,
+	// older replays are rejected by their timestamps
+	saltTTL2022 = 2 * maxTimeDiff
+	// saltTTL is how long the salts of the AEAD ciphers are remembered
+	saltTTL = time.Hour
+)
+
+// SaltFilter remembers the salts of the recent sessions, and the packet IDs
+// of the recent 2022 UDP sessions, to reject replays
+type SaltFilter struct {
+	ttl time.Duration
+
+	mu    sync.Mutex
+	salts map[string]time.Time
+	// windows 2022 UDP会话ID对应的包ID窗口
+	windows   map[string]*packetWindow
+	lastClean time.Time
+	now       func() time.Time
+}
+
+type packetWindow struct {
+	window replayWindow
+	last   time.Time
+}
+
+// NewSaltFilter creates the filter for the sessions of m
+func NewSaltFilter(m *Method) *SaltFilter {
+	ttl := saltTTL
+	if m.is2022 {
+		ttl = saltTTL2022
+	}
+	return &SaltFilter{
+		ttl:       ttl,
+		salts:     map[string]time.Time{},
+		windows:   map[string]*packetWindow{},
+		lastClean: time.Now(),
+		now:       time.Now,
+	}
+}
+
+// Check records salt and reports whether it was not seen before
+func (f *SaltFilter) Check(salt []byte) bool {
+	now := f.now()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.clean(now)
+	if seen, exist := f.salts[string(salt)]; exist && now.Sub(seen) <= f.ttl {
+		return false
+	}
+	f.salts[string(salt)] = now
+	return true
+}
+
+// CheckPacket records the packet ID of a 2022 UDP session and reports whether
+// it was not seen before, the packets of a session may come from several
+// client addresses
+func (f *SaltFilter) CheckPacket(sessionID []byte, packetID uint64) bool {
+	now := f.now()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.clean(now)
+	w, exist := f.windows[string(sessionID)]
+	if !exist {
+		w = &packetWindow{}
+		f.windows[string(sessionID)] = w
+	}
+	w.last = now
+	return w.window.Check(packetID)
+}
+
+// clean drops the salts and the idle sessions older than the TTL once per TTL
+func (f *SaltFilter) clean(now time.Time) {
+	if now.Sub(f.lastClean) <= f.ttl {
+		return
+	}
+	for salt, seen := range f.salts {
+		if now.Sub(seen) > f.ttl {
+			delete(f.salts, salt)
+		}
+	}
+	// 空闲超过时间戳有效期的会话，重放的数据包会因时间戳被拒绝
+	for id, w := range f.windows {
+		if now.Sub(w.last) > f.ttl {
+			delete(f.windows, id)
+		}
+	}
+	f.lastClean = now
+}
@@ -0,0 +1,290 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	// separateHeaderSize is the size of the session ID and the packet ID
+	separateHeaderSize = 8 + 8
+	sessionIDSize      = 8
+	// replayWindowSize is how many packet IDs below the largest one received
+	// are accepted once
+	replayWindowSize = 1024
+)
+
+// replayWindow is a sliding window over the packet IDs of a session
+type replayWindow struct {
+	// next 收到的最大包ID加一
+	next uint64
+	seen [replayWindowSize / 64]uint64
+}
+
+// Check records id and reports whether it was not received before and is
+// still in the window
+func (w *replayWindow) Check(id uint64) bool {
+	if id >= w.next {
+		// 窗口前移，清除移出窗口的包ID
+		if id-w.next >= replayWindowSize {
+			w.seen = [replayWindowSize / 64]uint64{}
+		} else {
+			for i := uint64(0); i <= id-w.next; i++ {
+				j := w.next + i
+				w.seen[j%replayWindowSize/64] &^= 1 << (j % 64)
+			}
+		}
+		w.next = id + 1
+	} else if w.next-id > replayWindowSize {
+		return false
+	}
+	index, bit := id%replayWindowSize/64, uint64(1)<<(id%64)
+	if w.seen[index]&bit != 0 {
+		return false
+	}
+	w.seen[index] |= bit
+	return true
+}
+
+// remoteSession is a session of the other side
+type remoteSession struct {
+	aead   cipher.AEAD
+	window replayWindow
+	// last 最后收到数据包的时间
+	last time.Time
+}
+
+// UDPSession packs and unpacks the packets of a UDP association, a packet
+// carries the target address in the SOCKS5 encoding followed by the payload.
+// The 2022 ciphers identify the sessions of both sides by IDs in every packet
+type UDPSession struct {
+	method *Method
+	client bool
+
+	mu        sync.Mutex
+	sessionID []byte
+	packetID  uint64
+	// aead 2022 AES的本端会话子密钥
+	aead cipher.AEAD
+	// remoteID 对端最近的会话ID，收到对端的数据包后确定
+	remoteID []byte
+	// remotes 对端的会话，按包ID拒绝时间戳有效期内的重放
+	remotes map[string]*remoteSession
+	// filter 拒绝重放的数据包，2022的包ID在各关联间共享
+	filter *SaltFilter
+}
+
+// NewUDPSession creates a session of the client or of the server side
+func NewUDPSession(m *Method, client bool) (*UDPSession, error) {
+	s := &UDPSession{method: m, client: client}
+	if !m.is2022 {
+		return s, nil
+	}
+	s.sessionID = make([]byte, sessionIDSize)
+	if _, err := rand.Read(s.sessionID); err != nil {
+		return nil, err
+	}
+	if m.block != nil {
+		var err error
+		if s.aead, err = m.sessionAEAD(s.sessionID); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// SetFilter sets the filter rejecting the replayed packets of all sessions
+// sharing it, by the salts or by the 2022 packet IDs. Without a filter the
+// 2022 packet IDs are checked within the session
+func (s *UDPSession) SetFilter(filter *SaltFilter) {
+	s.filter = filter
+}
+
+// Pack encrypts a packet of payload to or from addr
+func (s *UDPSession) Pack(addr, payload []byte) ([]byte, error) {
+	if !s.method.is2022 {
+		salt := make([]byte, s.method.saltSize())
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		aead, err := s.method.sessionAEAD(salt)
+		if err != nil {
+			return nil, err
+		}
+		plaintext := append(append([]byte(nil), addr...), payload...)
+		return aead.Seal(salt, make([]byte, aead.NonceSize()), plaintext, nil), nil
+	}
+
+	s.mu.Lock()
+	header := make([]byte, separateHeaderSize)
+	copy(header, s.sessionID)
+	binary.BigEndian.PutUint64(header[sessionIDSize:], s.packetID)
+	s.packetID++
+	remoteID := s.remoteID
+	s.mu.Unlock()
+
+	// 主头：类型、时间戳、[客户端会话ID]、填充长度、地址
+	main := make([]byte, 0, 1+8+sessionIDSize+2+len(addr)+len(payload))
+	if s.client {
+		main = append(main, headerTypeClient)
+	} else {
+		main = append(main, headerTypeServer)
+	}
+	main = main[:9]
+	binary.BigEndian.PutUint64(main[1:], uint64(time.Now().Unix()))
+	if !s.client {
+		if remoteID == nil {
+			return nil, ErrBadHeader
+		}
+		main = append(main, remoteID...)
+	}
+	main = append(main, 0, 0)
+	main = append(main, addr...)
+	main = append(main, payload...)
+
+	if s.method.block != nil {
+		packet := make([]byte, separateHeaderSize, separateHeaderSize+len(main)+tagSize)
+		s.method.block.Encrypt(packet, header)
+		return s.aead.Seal(packet, header[4:], main, nil), nil
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	packet := append([]byte(nil), nonce...)
+	return s.method.udpAEAD.Seal(packet, nonce, append(header, main...), nil), nil
+}
+
+// Unpack decrypts a packet, the returned bytes are the address followed by
+// the payload
+func (s *UDPSession) Unpack(packet []byte) ([]byte, error) {
+	m := s.method
+	if !m.is2022 {
+		if len(packet) < m.saltSize()+tagSize {
+			return nil, errShortPacket
+		}
+		salt := packet[:m.saltSize()]
+		aead, err := m.sessionAEAD(salt)
+		if err != nil {
+			return nil, err
+		}
+		plaintext, err := aead.Open(nil, make([]byte, aead.NonceSize()), packet[m.saltSize():], nil)
+		if err != nil {
+			return nil, err
+		}
+		if s.filter != nil && !s.filter.Check(salt) {
+			return nil, ErrReplay
+		}
+		return plaintext, nil
+	}
+
+	var header, main []byte
+	var remoteAEAD cipher.AEAD
+	if m.block != nil {
+		if len(packet) < separateHeaderSize+tagSize {
+			return nil, errShortPacket
+		}
+		header = make([]byte, separateHeaderSize)
+		m.block.Decrypt(header, packet[:separateHeaderSize])
+		s.mu.Lock()
+		if remote, exist := s.remotes[string(header[:sessionIDSize])]; exist {
+			remoteAEAD = remote.aead
+		}
+		s.mu.Unlock()
+		if remoteAEAD == nil {
+			var err error
+			if remoteAEAD, err = m.sessionAEAD(header[:sessionIDSize]); err != nil {
+				return nil, err
+			}
+		}
+		var err error
+		if main, err = remoteAEAD.Open(nil, header[4:], packet[separateHeaderSize:], nil); err != nil {
+			return nil, err
+		}
+	} else {
+		if len(packet) < chacha20poly1305.NonceSizeX+separateHeaderSize+tagSize {
+			return nil, errShortPacket
+		}
+		plaintext, err := m.udpAEAD.Open(nil, packet[:chacha20poly1305.NonceSizeX], packet[chacha20poly1305.NonceSizeX:], nil)
+		if err != nil {
+			return nil, err
+		}
+		header, main = plaintext[:separateHeaderSize], plaintext[separateHeaderSize:]
+	}
+
+	payload, err := s.parseMainHeader(main)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.accept(header, remoteAEAD); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// accept records the packet ID of an authenticated packet in the window of
+// its session, a replayed packet ID is rejected
+func (s *UDPSession) accept(header []byte, remoteAEAD cipher.AEAD) error {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	remote, exist := s.remotes[string(header[:sessionIDSize])]
+	if !exist {
+		// 空闲超过时间戳有效期的会话，重放的数据包会因时间戳被拒绝
+		for id, remote := range s.remotes {
+			if now.Sub(remote.last) > saltTTL2022 {
+				delete(s.remotes, id)
+			}
+		}
+		if s.remotes == nil {
+			s.remotes = map[string]*remoteSession{}
+		}
+		remote = &remoteSession{aead: remoteAEAD}
+		s.remotes[string(header[:sessionIDSize])] = remote
+	}
+	packetID := binary.BigEndian.Uint64(header[sessionIDSize:])
+	if s.filter != nil {
+		if !s.filter.CheckPacket(header[:sessionIDSize], packetID) {
+			return ErrReplay
+		}
+	} else if !remote.window.Check(packetID) {
+		return ErrReplay
+	}
+	remote.last = now
+	s.remoteID = header[:sessionIDSize]
+	return nil
+}
+
+// parseMainHeader checks the main header of a packet from the other side and
+// returns the address and the payload following it
+func (s *UDPSession) parseMainHeader(main []byte) ([]byte, error) {
+	size := 1 + 8 + 2
+	headerType := byte(headerTypeClient)
+	if s.client {
+		size += sessionIDSize
+		headerType = headerTypeServer
+	}
+	if len(main) < size {
+		return nil, errShortPacket
+	}
+	if main[0] != headerType {
+		return nil, ErrBadHeader
+	}
+	if err := checkTimestamp(main[1:9]); err != nil {
+		return nil, err
+	}
+	if s.client && !bytes.Equal(main[9:9+sessionIDSize], s.sessionID) {
+		return nil, ErrBadHeader
+	}
+	padding := int(binary.BigEndian.Uint16(main[size-2:]))
+	if len(main) < size+padding {
+		return nil, errShortPacket
+	}
+	return main[size+padding:], nil
+}
@@ -0,0 +1,275 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testMethods = []string{
+	"aes-128-gcm",
+	"aes-256-gcm",
+	"chacha20-ietf-poly1305",
+	"2022-blake3-aes-128-gcm",
+	"2022-blake3-aes-256-gcm",
+	"2022-blake3-chacha20-poly1305",
+}
+
+// testPassword returns a password of user valid for method
+func testPassword(method, user string) string {
+	if !strings.HasPrefix(method, "2022") {
+		return user
+	}
+	key := bytes.Repeat([]byte(user), 32)[:ciphers[method].keySize]
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func newTestMethod(t *testing.T, method, user string) *Method {
+	m, err := NewMethod(method, testPassword(method, user))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return m
+}
+
+func TestNewMethod(t *testing.T) {
+	if _, err := NewMethod("rc4-md5", "foo"); err == nil {
+		t.Fatal("expect error")
+	}
+	if _, err := NewMethod("2022-blake3-aes-128-gcm", "foo"); err == nil {
+		t.Fatal("expect error")
+	}
+	if _, err := NewMethod("2022-blake3-aes-128-gcm", testPassword("2022-blake3-aes-256-gcm", "a")); err == nil {
+		t.Fatal("expect error")
+	}
+	// EVP_BytesToKey的前16字节是MD5("foo")
+	m := newTestMethod(t, "aes-128-gcm", "foo")
+	if key := hex.EncodeToString(m.key); key != "acbd18db4cc2f85cedef654fccc4a4d8" {
+		t.Fatalf("bad: %s", key)
+	}
+}
+
+func TestConn(t *testing.T) {
+	addr := []byte{1, 127, 0, 0, 1, 0, 80}
+	for _, method := range testMethods {
+		t.Run(method, func(t *testing.T) {
+			methods := []*Method{newTestMethod(t, method, "a"), newTestMethod(t, method, "b")}
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			client.SetDeadline(time.Now().Add(time.Second))
+			server.SetDeadline(time.Now().Add(time.Second))
+
+			large := bytes.Repeat([]byte("x"), 100000)
+			go func() {
+				conn := NewClientConn(client, newTestMethod(t, method, "b"), addr)
+				conn.Write([]byte("ping"))
+				conn.Write(large)
+				out := make([]byte, 4)
+				if _, err := io.ReadFull(conn, out); err != nil || string(out) != "pong" {
+					t.Errorf("bad: %q %v", out, err)
+				}
+				client.Close()
+			}()
+
+			conn, i, err := Accept(server, methods, NewSaltFilter(methods[0]))
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if i != 1 {
+				t.Fatalf("bad: %d", i)
+			}
+			out := make([]byte, len(addr))
+			if _, err := io.ReadFull(conn, out); err != nil || !bytes.Equal(out, addr) {
+				t.Fatalf("bad: %v %v", out, err)
+			}
+			if err := conn.SkipPadding(); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			out = make([]byte, 4+len(large))
+			if _, err := io.ReadFull(conn, out); err != nil || string(out[:4]) != "ping" || !bytes.Equal(out[4:], large) {
+				t.Fatalf("bad: %v", err)
+			}
+			if _, err := conn.Write([]byte("pong")); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			io.Copy(io.Discard, conn)
+		})
+	}
+}
+
+// TestConn_ServerFirst reads before writing, the request is sent without
+// payload
+func TestConn_ServerFirst(t *testing.T) {
+	addr := []byte{1, 127, 0, 0, 1, 0, 25}
+	for _, method := range []string{"aes-128-gcm", "2022-blake3-aes-128-gcm"} {
+		m := newTestMethod(t, method, "a")
+		client, server := net.Pipe()
+		client.SetDeadline(time.Now().Add(time.Second))
+		server.SetDeadline(time.Now().Add(time.Second))
+		go func() {
+			conn, _, err := Accept(server, []*Method{m}, nil)
+			if err != nil {
+				t.Errorf("err: %v", err)
+				return
+			}
+			io.ReadFull(conn, make([]byte, len(addr)))
+			conn.SkipPadding()
+			conn.Write([]byte("220"))
+		}()
+
+		out := make([]byte, 3)
+		if _, err := io.ReadFull(NewClientConn(client, m, addr), out); err != nil || string(out) != "220" {
+			t.Fatalf("%s: bad: %q %v", method, out, err)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+// bufferConn reads from r and records the writes into w
+type bufferConn struct {
+	net.Conn
+	r io.Reader
+	w bytes.Buffer
+}
+
+func (c *bufferConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *bufferConn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+func TestAccept_Replay(t *testing.T) {
+	for _, method := range []string{"aes-256-gcm", "2022-blake3-aes-256-gcm"} {
+		m := newTestMethod(t, method, "a")
+		record := &bufferConn{}
+		NewClientConn(record, m, []byte{1, 1, 1, 1, 1, 0, 53}).Write([]byte("data"))
+		recorded := record.w.Bytes()
+
+		filter := NewSaltFilter(m)
+		if _, _, err := Accept(&bufferConn{r: bytes.NewReader(recorded)}, []*Method{m}, filter); err != nil {
+			t.Fatalf("%s: err: %v", method, err)
+		}
+		if _, _, err := Accept(&bufferConn{r: bytes.NewReader(recorded)}, []*Method{m}, filter); err != ErrReplay {
+			t.Fatalf("%s: bad: %v", method, err)
+		}
+		// 其他用户的密钥无法认证
+		other := newTestMethod(t, method, "b")
+		if _, _, err := Accept(&bufferConn{r: bytes.NewReader(recorded)}, []*Method{other}, nil); err != ErrBadHeader {
+			t.Fatalf("%s: bad: %v", method, err)
+		}
+	}
+}
+
+func TestUDPSession(t *testing.T) {
+	addr := []byte{1, 127, 0, 0, 1, 0, 53}
+	for _, method := range testMethods {
+		t.Run(method, func(t *testing.T) {
+			m := newTestMethod(t, method, "a")
+			client, err := NewUDPSession(m, true)
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			server, err := NewUDPSession(m, false)
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+
+			for i := 0; i < 2; i++ {
+				packet, err := client.Pack(addr, []byte("query"))
+				if err != nil {
+					t.Fatalf("err: %v", err)
+				}
+				out, err := server.Unpack(packet)
+				if err != nil || string(out) != string(addr)+"query" {
+					t.Fatalf("bad: %q %v", out, err)
+				}
+
+				if packet, err = server.Pack(addr, []byte("answer")); err != nil {
+					t.Fatalf("err: %v", err)
+				}
+				if out, err = client.Unpack(packet); err != nil || string(out) != string(addr)+"answer" {
+					t.Fatalf("bad: %q %v", out, err)
+				}
+				// 客户端不接受自己的数据包
+				if m.is2022 {
+					packet, _ = client.Pack(addr, []byte("query"))
+					if _, err := client.Unpack(packet); err == nil {
+						t.Fatal("expect error")
+					}
+				}
+			}
+
+			other, _ := NewUDPSession(newTestMethod(t, method, "b"), false)
+			packet, _ := client.Pack(addr, []byte("query"))
+			if _, err := other.Unpack(packet); err == nil {
+				t.Fatal("expect error")
+			}
+		})
+	}
+}
+
+func TestUDPSession_Replay(t *testing.T) {
+	addr := []byte{1, 127, 0, 0, 1, 0, 53}
+	for _, method := range testMethods {
+		m := newTestMethod(t, method, "a")
+		client, _ := NewUDPSession(m, true)
+		server, _ := NewUDPSession(m, false)
+		server.SetFilter(NewSaltFilter(m))
+
+		var packets [][]byte
+		for i := 0; i < 3; i++ {
+			packet, err := client.Pack(addr, []byte("query"))
+			if err != nil {
+				t.Fatalf("%s: err: %v", method, err)
+			}
+			packets = append(packets, packet)
+		}
+		// 乱序到达的数据包只接受一次
+		for _, i := range []int{1, 0, 2} {
+			if _, err := server.Unpack(packets[i]); err != nil {
+				t.Fatalf("%s: err: %v", method, err)
+			}
+		}
+		for _, packet := range packets {
+			if _, err := server.Unpack(packet); err != ErrReplay {
+				t.Fatalf("%s: bad: %v", method, err)
+			}
+		}
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	w := &replayWindow{}
+	for _, c := range []struct {
+		id uint64
+		ok bool
+	}{
+		{0, true},
+		{0, false},
+		{5, true},
+		{3, true},
+		{3, false},
+		{replayWindowSize + 4, true},
+		// 移出窗口
+		{4, false},
+		{5, false},
+		{6, true},
+		{6, false},
+		{3 * replayWindowSize, true},
+		{2*replayWindowSize + 1, true},
+		{2 * replayWindowSize, false},
+	} {
+		if w.Check(c.id) != c.ok {
+			t.Fatalf("%d: expect %v", c.id, c.ok)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package sniff
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// QUIC versions with known Initial keys
+const (
+	quicVersion1      = 0x00000001
+	quicVersion2      = 0x6b3343cf
+	quicVersionDraft  = 0xff00001d // draft-29
+	quicMinInitialLen = 1200
+)
+
+var (
+	quicSaltV1    = []byte{0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17, 0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a}
+	quicSaltV2    = []byte{0x0d, 0xed, 0xe3, 0xde, 0xf7, 0x00, 0xa6, 0xdb, 0x81, 0x93, 0x81, 0xbe, 0x6e, 0x26, 0x9d, 0xcb, 0xf9, 0xbd, 0x2e, 0xd9}
+	quicSaltDraft = []byte{0xaf, 0xbf, 0xec, 0x28, 0x99, 0x93, 0xd2, 0x4c, 0x9e, 0x97, 0x86, 0xf1, 0x9c, 0x61, 0x11, 0xe0, 0x43, 0x90, 0xa8, 0x99}
+
+	errQUICDecrypt = errors.New("sniff: failed to decrypt quic initial packet")
+)
+
+// QUIC frame types found in a client Initial packet
+const (
+	quicFramePadding         = 0x00
+	quicFramePing            = 0x01
+	quicFrameAck             = 0x02
+	quicFrameAckECN          = 0x03
+	quicFrameCrypto          = 0x06
+	quicFrameConnectionClose = 0x1c
+)
+
+// initialKeys are the client Initial packet protection keys, RFC 9001 section 5.2
+type initialKeys struct {
+	key []byte
+	iv  []byte
+	hp  []byte
+}
+
+func newInitialKeys(version uint32, dcid []byte) *initialKeys {
+	salt, labelPrefix := quicSaltV1, "quic "
+	switch version {
+	case quicVersion2:
+		salt, labelPrefix = quicSaltV2, "quicv2 "
+	case quicVersionDraft:
+		salt = quicSaltDraft
+	}
+	initialSecret := hkdf.Extract(sha256.New, dcid, salt)
+	clientSecret := hkdfExpandLabel(initialSecret, "client in", 32)
+	return &initialKeys{
+		key: hkdfExpandLabel(clientSecret, labelPrefix+"key", 16),
+		iv:  hkdfExpandLabel(clientSecret, labelPrefix+"iv", 12),
+		hp:  hkdfExpandLabel(clientSecret, labelPrefix+"hp", 16),
+	}
+}
+
+// hkdfExpandLabel is HKDF-Expand-Label of TLS 1.3 with an empty context
+func hkdfExpandLabel(secret []byte, label string, length int) []byte {
+	label = "tls13 " + label
+	info := make([]byte, 3, 4+len(label))
+	binary.BigEndian.PutUint16(info, uint16(length))
+	info[2] = byte(len(label))
+	info = append(info, label...)
+	info = append(info, 0)
+
+	out := make([]byte, length)
+	if _, err := hkdf.Expand(crypto.SHA256.New, secret, info).Read(out); err != nil {
+		panic(err)
+	}
+	return out
+}
+
+// QUIC returns the SNI of the ClientHello carried by a QUIC Initial packet,
+// a ClientHello split across several packets is not supported
+func QUIC(b []byte) (string, error) {
+	// 长包头且固定位为1
+	if len(b) < quicMinInitialLen || b[0]&0xc0 != 0xc0 {
+		return "", errNotMatch
+	}
+	version := binary.BigEndian.Uint32(b[1:5])
+	initialType := byte(0)
+	switch version {
+	case quicVersion1, quicVersionDraft:
+	case quicVersion2:
+		initialType = 1
+	default:
+		return "", errNotMatch
+	}
+	if (b[0]&0x30)>>4 != initialType {
+		return "", errNotMatch
+	}
+
+	r := reader(b[5:])
+	dcid, ok := r.vector(1)
+	if !ok || len(dcid) > 20 {
+		return "", errNotMatch
+	}
+	if !r.skipVector(1) {
+		return "", errNotMatch
+	}
+	tokenLen, ok := r.varint()
+	if !ok || tokenLen > uint64(len(r)) || !r.skip(int(tokenLen)) {
+		return "", errNotMatch
+	}
+	length, ok := r.varint()
+	if !ok || length > uint64(len(r)) || length < 20 {
+		return "", errNotMatch
+	}
+	pnOffset := len(b) - len(r)
+	keys := newInitialKeys(version, dcid)
+	payload, err := keys.open(b[:pnOffset+int(length)], pnOffset)
+	if err != nil {
+		return "", err
+	}
+	hello, err := cryptoData(payload)
+	if err != nil {
+		return "", err
+	}
+	domain, err := clientHelloServerName(hello)
+	if err == errShortData {
+		return "", errNoDomain
+	}
+	return domain, err
+}
+
+// open removes the header protection and decrypts the payload of a packet
+func (k *initialKeys) open(packet []byte, pnOffset int) ([]byte, error) {
+	// 复制一份，不修改原始数据
+	packet = append([]byte(nil), packet...)
+
+	hp, err := aes.NewCipher(k.hp)
+	if err != nil {
+		return nil, err
+	}
+	sample := packet[pnOffset+4 : pnOffset+4+aes.BlockSize]
+	mask := make([]byte, aes.BlockSize)
+	hp.Encrypt(mask, sample)
+
+	packet[0] ^= mask[0] & 0x0f
+	pnLen := int(packet[0]&0x03) + 1
+	var pn uint64
+	for i := 0; i < pnLen; i++ {
+		packet[pnOffset+i] ^= mask[1+i]
+		pn = pn<<8 | uint64(packet[pnOffset+i])
+	}
+
+	block, err := aes.NewCipher(k.key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := append([]byte(nil), k.iv...)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	header := packet[:pnOffset+pnLen]
+	payload, err := aead.Open(nil, nonce, packet[pnOffset+pnLen:], header)
+	if err != nil {
+		return nil, errQUICDecrypt
+	}
+	return payload, nil
+}
+
+// cryptoData reassembles the CRYPTO frames of a decrypted Initial payload,
+// returns the contiguous data from offset 0
+func cryptoData(payload []byte) ([]byte, error) {
+	type fragment struct {
+		offset uint64
+		data   []byte
+	}
+	var fragments []fragment
+	r := reader(payload)
+	for len(r) > 0 {
+		frameType, ok := r.varint()
+		if !ok {
+			return nil, errNotMatch
+		}
+		switch frameType {
+		case quicFramePadding, quicFramePing:
+		case quicFrameAck, quicFrameAckECN:
+			// largest acknowledged, ack delay, range count, first range
+			var fields [4]uint64
+			for i := range fields {
+				if fields[i], ok = r.varint(); !ok {
+					return nil, errNotMatch
+				}
+			}
+			n := fields[2] * 2
+			if frameType == quicFrameAckECN {
+				n += 3
+			}
+			for i := uint64(0); i < n; i++ {
+				if _, ok := r.varint(); !ok {
+					return nil, errNotMatch
+				}
+			}
+		case quicFrameCrypto:
+			offset, ok := r.varint()
+			if !ok {
+				return nil, errNotMatch
+			}
+			length, ok := r.varint()
+			if !ok || length > uint64(len(r)) {
+				return nil, errNotMatch
+			}
+			fragments = append(fragments, fragment{offset: offset, data: r[:length]})
+			r = r[length:]
+		case quicFrameConnectionClose:
+			return nil, errNoDomain
+		default:
+			return nil, errNotMatch
+		}
+	}
+
+	// 按偏移拼接，只保留从0开始的连续数据
+	var data []byte
+	for merged := true; merged; {
+		merged = false
+		for _, f := range fragments {
+			end := f.offset + uint64(len(f.data))
+			if f.offset <= uint64(len(data)) && end > uint64(len(data)) {
+				data = append(data, f.data[uint64(len(data))-f.offset:]...)
+				merged = true
+			}
+		}
+	}
+	if len(data) == 0 {
+		return nil, errNoDomain
+	}
+	return data, nil
+}
+
+// varint reads a QUIC variable-length integer, RFC 9000 section 16
+func (r *reader) varint() (uint64, bool) {
+	if len(*r) == 0 {
+		return 0, false
+	}
+	n := 1 << ((*r)[0] >> 6)
+	if len(*r) < n {
+		return 0, false
+	}
+	v := uint64((*r)[0] & 0x3f)
+	for _, c := range (*r)[1:n] {
+		v = v<<8 | uint64(c)
+	}
+	*r = (*r)[n:]
+	return v, true
+}
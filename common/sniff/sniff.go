@@ -0,0 +1,162 @@
+// Package sniff extracts the destination domain from the first bytes a client
+// sends: the SNI of a TLS ClientHello, the Host header of plain HTTP and the
+// SNI of a QUIC Initial packet.
+package sniff
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/ido2021/light-proxy/common"
+)
+
+// DefaultTimeout is how long to wait for the first data of a client
+const DefaultTimeout = 300 * time.Millisecond
+
+var (
+	// errNotMatch the data is not of the sniffed protocol
+	errNotMatch = errors.New("sniff: protocol not recognized")
+	// errShortData the data may match but is incomplete
+	errShortData = errors.New("sniff: need more data")
+	errNoDomain  = errors.New("sniff: no domain found")
+)
+
+// Stream returns the domain carried by the first bytes of a TCP stream
+func Stream(b []byte) (string, error) {
+	domain, err := TLS(b)
+	if err != errNotMatch {
+		return domain, err
+	}
+	return HTTP(b)
+}
+
+// Packet returns the domain carried by a UDP datagram
+func Packet(b []byte) (string, error) {
+	return QUIC(b)
+}
+
+// Conn waits for the first data of conn and fills the sniffed domain into
+// the destination of metadata, nothing is consumed from conn. The sniffed
+// domain replaces the dial target only if override is set, otherwise it is
+// used for routing and the original address is dialed.
+func Conn(conn *common.BufferedConn, metadata *common.Metadata, override bool, timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	// 等待客户端发送第一个数据包，服务端先发数据的协议在超时后跳过
+	if _, err := conn.Peek(1); err != nil {
+		return
+	}
+	size := conn.Reader().Size()
+	for {
+		b, _ := conn.Peek(conn.Buffered())
+		domain, err := Stream(b)
+		if err == nil {
+			fill(metadata, domain, override)
+			return
+		}
+		if err != errShortData || len(b) >= size {
+			return
+		}
+		// 数据不完整，等待更多数据
+		if _, err := conn.Peek(len(b) + 1); err != nil {
+			return
+		}
+	}
+}
+
+// PacketMetadata fills the domain sniffed from a datagram into metadata
+func PacketMetadata(b []byte, metadata *common.Metadata, override bool) {
+	domain, err := Packet(b)
+	if err == nil {
+		fill(metadata, domain, override)
+	}
+}
+
+func fill(metadata *common.Metadata, domain string, override bool) {
+	dest := metadata.DestAddr
+	if dest == nil {
+		return
+	}
+	if override {
+		dest.FQDN = domain
+		dest.IP = nil
+		return
+	}
+	if dest.FQDN == "" {
+		dest.FQDN = domain
+	}
+}
+
+// normalizeDomain lowercases the domain, IP literals and invalid names are rejected
+func normalizeDomain(domain string) (string, error) {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	if domain == "" || len(domain) > 255 || net.ParseIP(domain) != nil {
+		return "", errNoDomain
+	}
+	for i := 0; i < len(domain); i++ {
+		c := domain[i]
+		if c <= ' ' || c >= 0x7f || c == '/' || c == ':' {
+			return "", errNoDomain
+		}
+	}
+	return domain, nil
+}
+
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("POST "), []byte("HEAD "), []byte("PUT "), []byte("DELETE "),
+	[]byte("OPTIONS "), []byte("PATCH "), []byte("TRACE "), []byte("CONNECT "),
+}
+
+// HTTP returns the Host header of a plain HTTP/1.x request
+func HTTP(b []byte) (string, error) {
+	matched := false
+	for _, method := range httpMethods {
+		n := len(method)
+		if len(b) < n {
+			n = len(b)
+		}
+		if bytes.Equal(b[:n], method[:n]) {
+			if n < len(method) {
+				return "", errShortData
+			}
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return "", errNotMatch
+	}
+
+	end := bytes.Index(b, []byte("\r\n\r\n"))
+	complete := end >= 0
+	if complete {
+		b = b[:end]
+	}
+	lines := bytes.Split(b, []byte("\r\n"))
+	// 最后一行可能不完整
+	if !complete {
+		lines = lines[:len(lines)-1]
+	}
+	for _, line := range lines[1:] {
+		name, value, found := bytes.Cut(line, []byte(":"))
+		if !found || !strings.EqualFold(string(name), "host") {
+			continue
+		}
+		host := strings.TrimSpace(string(value))
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return normalizeDomain(host)
+	}
+	if !complete {
+		return "", errShortData
+	}
+	return "", errNoDomain
+}
@@ -0,0 +1,210 @@
+package sniff
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/tls"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ido2021/light-proxy/common"
+)
+
+// clientHello captures the first record sent by a TLS client
+func clientHello(t *testing.T, serverName string) []byte {
+	server, client := net.Pipe()
+	defer server.Close()
+	go func() {
+		defer client.Close()
+		_ = tls.Client(client, &tls.Config{ServerName: serverName}).Handshake()
+	}()
+
+	header := make([]byte, recordHeaderLen)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	fragment := make([]byte, int(header[3])<<8|int(header[4]))
+	if _, err := io.ReadFull(server, fragment); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return append(header, fragment...)
+}
+
+func TestTLS(t *testing.T) {
+	record := clientHello(t, "WWW.Example.com")
+	domain, err := Stream(record)
+	if err != nil || domain != "www.example.com" {
+		t.Fatalf("bad: %s %v", domain, err)
+	}
+
+	for _, n := range []int{1, recordHeaderLen, 50} {
+		if _, err := TLS(record[:n]); err != errShortData {
+			t.Fatalf("%d bytes: expect short data, got %v", n, err)
+		}
+	}
+
+	if _, err := TLS(clientHello(t, "10.0.0.1")); err != errNoDomain {
+		t.Fatalf("expect no domain, got %v", err)
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	cases := []struct {
+		data   string
+		domain string
+		err    error
+	}{
+		{"GET / HTTP/1.1\r\nUser-Agent: curl\r\nHost: Example.com:8080\r\n\r\n", "example.com", nil},
+		{"POST /api HTTP/1.1\r\nhost: api.example.com\r\n", "api.example.com", nil},
+		{"GET / HTTP/1.1\r\nAccept: */*\r\n", "", errShortData},
+		{"GE", "", errShortData},
+		{"GET / HTTP/1.0\r\n\r\n", "", errNoDomain},
+		{"GET / HTTP/1.1\r\nHost: 192.168.1.1\r\n\r\n", "", errNoDomain},
+		{"SSH-2.0-OpenSSH_9.0\r\n", "", errNotMatch},
+	}
+	for i, c := range cases {
+		domain, err := Stream([]byte(c.data))
+		if domain != c.domain || err != c.err {
+			t.Fatalf("case %d: bad: %s %v", i, domain, err)
+		}
+	}
+}
+
+func TestInitialKeys(t *testing.T) {
+	// RFC 9001 Appendix A.1
+	dcid, _ := hex.DecodeString("8394c8f03e515708")
+	keys := newInitialKeys(quicVersion1, dcid)
+	expected := map[string][]byte{}
+	expected["key"], _ = hex.DecodeString("1f369613dd76d5467730efcbe3b1a22d")
+	expected["iv"], _ = hex.DecodeString("fa044b2f42a3fd3b46fb255c")
+	expected["hp"], _ = hex.DecodeString("9f50449e04a0e810283a1e9933adedd2")
+	if !bytes.Equal(keys.key, expected["key"]) || !bytes.Equal(keys.iv, expected["iv"]) || !bytes.Equal(keys.hp, expected["hp"]) {
+		t.Fatalf("bad keys: %x %x %x", keys.key, keys.iv, keys.hp)
+	}
+}
+
+// sealInitial builds a client Initial packet carrying the ClientHello in two
+// out-of-order CRYPTO frames
+func sealInitial(t *testing.T, version uint32, hello []byte) []byte {
+	dcid := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	keys := newInitialKeys(version, dcid)
+
+	half := len(hello) / 2
+	var frames []byte
+	frames = append(frames, quicFramePing)
+	frames = append(frames, quicFrameCrypto)
+	frames = appendVarint(frames, half)
+	frames = appendVarint(frames, len(hello)-half)
+	frames = append(frames, hello[half:]...)
+	frames = append(frames, quicFrameCrypto, 0)
+	frames = appendVarint(frames, half)
+	frames = append(frames, hello[:half]...)
+	frames = append(frames, make([]byte, quicMinInitialLen-len(frames))...)
+
+	first := byte(0xc0)
+	if version == quicVersion2 {
+		first |= 1 << 4
+	}
+	pnLen := 2
+	first |= byte(pnLen - 1)
+	header := []byte{first, byte(version >> 24), byte(version >> 16), byte(version >> 8), byte(version)}
+	header = append(header, byte(len(dcid)))
+	header = append(header, dcid...)
+	header = append(header, 0, 0) // scid, token
+	length := pnLen + len(frames) + 16
+	header = appendVarint(header, length)
+	pnOffset := len(header)
+	header = append(header, 0, 7) // packet number 7
+
+	block, _ := aes.NewCipher(keys.key)
+	aead, _ := cipher.NewGCM(block)
+	nonce := append([]byte(nil), keys.iv...)
+	nonce[len(nonce)-1] ^= 7
+	packet := aead.Seal(header, nonce, frames, header)
+
+	hp, _ := aes.NewCipher(keys.hp)
+	mask := make([]byte, aes.BlockSize)
+	hp.Encrypt(mask, packet[pnOffset+4:pnOffset+4+aes.BlockSize])
+	packet[0] ^= mask[0] & 0x0f
+	for i := 0; i < pnLen; i++ {
+		packet[pnOffset+i] ^= mask[1+i]
+	}
+	return packet
+}
+
+// appendVarint appends a two-byte QUIC variable-length integer
+func appendVarint(b []byte, v int) []byte {
+	return append(b, 0x40|byte(v>>8), byte(v))
+}
+
+func TestQUIC(t *testing.T) {
+	// QUIC中的ClientHello不带记录层头
+	hello := clientHello(t, "quic.example.com")[recordHeaderLen:]
+	for _, version := range []uint32{quicVersion1, quicVersion2, quicVersionDraft} {
+		packet := sealInitial(t, version, hello)
+		domain, err := Packet(packet)
+		if err != nil || domain != "quic.example.com" {
+			t.Fatalf("version %x: bad: %s %v", version, domain, err)
+		}
+
+		packet[len(packet)-1] ^= 0xff
+		if _, err := QUIC(packet); err != errQUICDecrypt {
+			t.Fatalf("version %x: expect decrypt error, got %v", version, err)
+		}
+	}
+
+	if _, err := QUIC(make([]byte, 1300)); err != errNotMatch {
+		t.Fatalf("expect not match, got %v", err)
+	}
+}
+
+func TestConn(t *testing.T) {
+	record := clientHello(t, "www.example.com")
+	cases := []struct {
+		dest     common.AddrSpec
+		override bool
+		expected common.AddrSpec
+	}{
+		{common.AddrSpec{IP: net.ParseIP("1.2.3.4"), Port: 443}, false, common.AddrSpec{FQDN: "www.example.com", IP: net.ParseIP("1.2.3.4"), Port: 443}},
+		{common.AddrSpec{IP: net.ParseIP("1.2.3.4"), Port: 443}, true, common.AddrSpec{FQDN: "www.example.com", Port: 443}},
+		{common.AddrSpec{FQDN: "example.org", Port: 443}, false, common.AddrSpec{FQDN: "example.org", Port: 443}},
+	}
+	for i, c := range cases {
+		server, client := net.Pipe()
+		go func() {
+			// 分两次发送，测试数据不完整时继续等待
+			_, _ = client.Write(record[:10])
+			_, _ = client.Write(record[10:])
+		}()
+
+		conn := common.NewBufferedConn(server)
+		dest := c.dest
+		metadata := &common.Metadata{DestAddr: &dest}
+		Conn(conn, metadata, c.override, time.Second)
+		if dest.FQDN != c.expected.FQDN || !dest.IP.Equal(c.expected.IP) || dest.Port != c.expected.Port {
+			t.Fatalf("case %d: bad: %v", i, dest)
+		}
+
+		// 嗅探不消耗数据
+		b := make([]byte, len(record))
+		if _, err := io.ReadFull(conn, b); err != nil || !bytes.Equal(b, record) {
+			t.Fatalf("case %d: data consumed: %v", i, err)
+		}
+		server.Close()
+		client.Close()
+	}
+
+	// 客户端不发送数据时超时跳过
+	server, client := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	metadata := &common.Metadata{DestAddr: &common.AddrSpec{IP: net.ParseIP("1.2.3.4"), Port: 22}}
+	Conn(common.NewBufferedConn(server), metadata, true, 50*time.Millisecond)
+	if metadata.DestAddr.FQDN != "" {
+		t.Fatal("unexpected domain")
+	}
+}
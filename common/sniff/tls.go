@@ -0,0 +1,163 @@
+package sniff
+
+import (
+	"encoding/binary"
+)
+
+const (
+	recordTypeHandshake     = 0x16
+	handshakeClientHello    = 0x01
+	extensionServerName     = 0x0000
+	serverNameTypeHostName  = 0x00
+	recordHeaderLen         = 5
+	handshakeHeaderLen      = 4
+	maxClientHelloRecordLen = 1<<14 + 256
+)
+
+// TLS returns the SNI of a TLS ClientHello record
+func TLS(b []byte) (string, error) {
+	if len(b) == 0 {
+		return "", errShortData
+	}
+	if b[0] != recordTypeHandshake {
+		return "", errNotMatch
+	}
+	if len(b) < recordHeaderLen {
+		return "", errShortData
+	}
+	// 记录层版本为3.x
+	if b[1] != 3 {
+		return "", errNotMatch
+	}
+	recordLen := int(binary.BigEndian.Uint16(b[3:5]))
+	if recordLen < handshakeHeaderLen || recordLen > maxClientHelloRecordLen {
+		return "", errNotMatch
+	}
+	fragment := b[recordHeaderLen:]
+	if len(fragment) > recordLen {
+		fragment = fragment[:recordLen]
+	}
+	domain, err := clientHelloServerName(fragment)
+	// 记录已完整但握手消息仍不完整，ClientHello跨越多个记录的情况不支持
+	if err == errShortData && len(fragment) == recordLen {
+		return "", errNoDomain
+	}
+	return domain, err
+}
+
+// clientHelloServerName parses a handshake message, which may be truncated,
+// and returns the server name of the ClientHello
+func clientHelloServerName(b []byte) (string, error) {
+	if len(b) < handshakeHeaderLen {
+		return "", errShortData
+	}
+	if b[0] != handshakeClientHello {
+		return "", errNotMatch
+	}
+	msgLen := int(b[1])<<16 | int(b[2])<<8 | int(b[3])
+	b = b[handshakeHeaderLen:]
+	if len(b) > msgLen {
+		b = b[:msgLen]
+	}
+
+	r := reader(b)
+	// legacy_version random
+	if !r.skip(2 + 32) {
+		return "", errShortData
+	}
+	// session_id cipher_suites compression_methods
+	if !r.skipVector(1) || !r.skipVector(2) || !r.skipVector(1) {
+		return "", errShortData
+	}
+	extensions, ok := r.vector(2)
+	if !ok {
+		if len(b) == msgLen {
+			// 没有扩展
+			return "", errNoDomain
+		}
+		return "", errShortData
+	}
+	for len(extensions) > 0 {
+		extType, ok := extensions.uint16()
+		if !ok {
+			return "", errShortData
+		}
+		data, ok := extensions.vector(2)
+		if !ok {
+			return "", errShortData
+		}
+		if extType != extensionServerName {
+			continue
+		}
+		names, ok := data.vector(2)
+		if !ok {
+			return "", errNotMatch
+		}
+		for len(names) > 0 {
+			nameType, ok := names.uint8()
+			if !ok {
+				return "", errNotMatch
+			}
+			name, ok := names.vector(2)
+			if !ok {
+				return "", errNotMatch
+			}
+			if nameType == serverNameTypeHostName {
+				return normalizeDomain(string(name))
+			}
+		}
+		return "", errNoDomain
+	}
+	return "", errNoDomain
+}
+
+// reader reads length-prefixed fields, failing on truncated data
+type reader []byte
+
+func (r *reader) skip(n int) bool {
+	if len(*r) < n {
+		return false
+	}
+	*r = (*r)[n:]
+	return true
+}
+
+func (r *reader) uint8() (uint8, bool) {
+	if len(*r) < 1 {
+		return 0, false
+	}
+	v := (*r)[0]
+	*r = (*r)[1:]
+	return v, true
+}
+
+func (r *reader) uint16() (uint16, bool) {
+	if len(*r) < 2 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint16(*r)
+	*r = (*r)[2:]
+	return v, true
+}
+
+// vector reads a field prefixed by a lenSize bytes length
+func (r *reader) vector(lenSize int) (reader, bool) {
+	if len(*r) < lenSize {
+		return nil, false
+	}
+	n := 0
+	for _, c := range (*r)[:lenSize] {
+		n = n<<8 | int(c)
+	}
+	if len(*r) < lenSize+n {
+		return nil, false
+	}
+	v := (*r)[lenSize : lenSize+n]
+	*r = (*r)[lenSize+n:]
+	return v, true
+}
+
+func (r *reader) skipVector(lenSize int) bool {
+	_, ok := r.vector(lenSize)
+	return ok
+}
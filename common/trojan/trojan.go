@@ -0,0 +1,107 @@
+// Package trojan implements the framing of the Trojan protocol carried over
+// TLS: the request header with the password hash and the UDP packets of an
+// association. Addresses are in the SOCKS5 encoding, which the callers
+// encode and decode with common.AppendAddrSpec and common.ReadAddrSpec.
+package trojan
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+
+	"github.com/ido2021/light-proxy/common"
+)
+
+const (
+	ConnectCommand   = uint8(1)
+	AssociateCommand = uint8(3)
+	// KeySize is the size of the hex encoded SHA224 of the password
+	KeySize = sha256.Size224 * 2
+)
+
+var (
+	crlf = []byte{'\r', '\n'}
+
+	ErrBadCRLF = errors.New("trojan: expect CRLF")
+)
+
+// Key returns the hex encoded SHA224 of password sent in every request
+func Key(password string) []byte {
+	sum := sha256.Sum224([]byte(password))
+	key := make([]byte, KeySize)
+	hex.Encode(key, sum[:])
+	return key
+}
+
+// AppendRequest appends the request header for the target addr
+func AppendRequest(b, key []byte, cmd uint8, addr []byte) []byte {
+	// KEY CRLF CMD ATYP DST.ADDR DST.PORT CRLF
+	b = append(b, key...)
+	b = append(b, crlf...)
+	b = append(b, cmd)
+	b = append(b, addr...)
+	return append(b, crlf...)
+}
+
+// ReadRequest reads the request header following the password hash and
+// returns the command and the target address
+func ReadRequest(r io.Reader) (uint8, []byte, error) {
+	header := make([]byte, 3)
+	// CRLF CMD
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	if header[0] != '\r' || header[1] != '\n' {
+		return 0, nil, ErrBadCRLF
+	}
+	cmd := header[2]
+	addr, err := common.ReadAddr(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := readCRLF(r); err != nil {
+		return 0, nil, err
+	}
+	return cmd, addr, nil
+}
+
+// AppendPacket appends a UDP packet of payload to or from addr
+func AppendPacket(b, addr, payload []byte) []byte {
+	// ATYP DST.ADDR DST.PORT LENGTH CRLF PAYLOAD
+	b = append(b, addr...)
+	b = append(b, byte(len(payload)>>8), byte(len(payload)))
+	b = append(b, crlf...)
+	return append(b, payload...)
+}
+
+// ReadPacket reads a UDP packet written by AppendPacket
+func ReadPacket(r io.Reader) ([]byte, []byte, error) {
+	addr, err := common.ReadAddr(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(r, length); err != nil {
+		return nil, nil, err
+	}
+	if err := readCRLF(r); err != nil {
+		return nil, nil, err
+	}
+	payload := make([]byte, int(length[0])<<8|int(length[1]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+	return addr, payload, nil
+}
+
+func readCRLF(r io.Reader) error {
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+	if b[0] != '\r' || b[1] != '\n' {
+		return ErrBadCRLF
+	}
+	return nil
+}
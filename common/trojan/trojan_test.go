@@ -0,0 +1,56 @@
+package trojan
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ido2021/light-proxy/common"
+)
+
+var (
+	// 127.0.0.1:53 和 example.com:443
+	ipv4Addr   = []byte{common.AtypIPv4, 127, 0, 0, 1, 0, 53}
+	domainAddr = append([]byte{common.AtypDomainName, 11}, append([]byte("example.com"), 1, 187)...)
+)
+
+func TestRequest(t *testing.T) {
+	key := Key("foo")
+	if string(key) != "0808f64e60d58979fcb676c96ec938270dea42445aeefcd3a4e6f8db" {
+		t.Fatalf("bad: %s", key)
+	}
+	request := AppendRequest(nil, key, ConnectCommand, domainAddr)
+	if !bytes.HasPrefix(request, key) {
+		t.Fatalf("bad: %q", request)
+	}
+	cmd, addr, err := ReadRequest(bytes.NewReader(request[KeySize:]))
+	if err != nil || cmd != ConnectCommand || !bytes.Equal(addr, domainAddr) {
+		t.Fatalf("bad: %v %v %v", cmd, addr, err)
+	}
+
+	request[len(request)-1] = 0
+	if _, _, err := ReadRequest(bytes.NewReader(request[KeySize:])); err != ErrBadCRLF {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestPacket(t *testing.T) {
+	buf := &bytes.Buffer{}
+	for _, addr := range [][]byte{ipv4Addr, domainAddr} {
+		buf.Write(AppendPacket(nil, addr, []byte("payload")))
+	}
+	for _, expect := range [][]byte{ipv4Addr, domainAddr} {
+		addr, payload, err := ReadPacket(buf)
+		if err != nil || !bytes.Equal(addr, expect) || string(payload) != "payload" {
+			t.Fatalf("bad: %v %q %v", addr, payload, err)
+		}
+	}
+
+	packet := AppendPacket(nil, ipv4Addr, nil)
+	packet[len(packet)-1] = 0
+	if _, _, err := ReadPacket(bytes.NewReader(packet)); err != ErrBadCRLF {
+		t.Fatalf("bad: %v", err)
+	}
+	if _, _, err := ReadPacket(bytes.NewReader([]byte{9, 0, 0})); err != common.ErrUnrecognizedAddrType {
+		t.Fatalf("bad: %v", err)
+	}
+}
@@ -0,0 +1,364 @@
+package dns
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ido2021/light-proxy/common"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// defaultCacheSize is the default maximum number of cached responses
+	defaultCacheSize = 4096
+	// defaultNegativeTTL caches a negative response without SOA record
+	defaultNegativeTTL = 30
+	// staleTTL is the TTL of stale answers, RFC 8767 section 4
+	staleTTL = 30
+	// prefetchHits is the number of hits making an entry hot
+	prefetchHits = 3
+	// cacheSaveInterval is how often a changed cache is persisted
+	cacheSaveInterval = time.Minute
+)
+
+type cacheKey struct {
+	name  string
+	qtype dnsmessage.Type
+	class dnsmessage.Class
+}
+
+func newCacheKey(q dnsmessage.Question) cacheKey {
+	return cacheKey{name: strings.ToLower(q.Name.String()), qtype: q.Type, class: q.Class}
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	msg     *dnsmessage.Message
+	stored  time.Time
+	expires time.Time
+	hits    int
+	// refreshing 后台刷新中，避免重复刷新
+	refreshing bool
+}
+
+// cache keeps responses until the smallest TTL of their answers expires, or
+// the TTL of the SOA record for negative responses, RFC 2308. The least
+// recently used entry is evicted when the cache is full
+type cache struct {
+	config common.DNSCache
+	size   int
+
+	mu sync.Mutex
+	// entries 指向lru中的元素，最近使用的在前
+	entries map[cacheKey]*list.Element
+	lru     *list.List
+	now     func() time.Time
+	dirty   bool
+	closed  chan struct{}
+}
+
+func newCache(config common.DNSCache) *cache {
+	c := &cache{
+		config:  config,
+		size:    config.Size,
+		entries: map[cacheKey]*list.Element{},
+		lru:     list.New(),
+		now:     time.Now,
+		closed:  make(chan struct{}),
+	}
+	if c.size <= 0 {
+		c.size = defaultCacheSize
+	}
+	if c.config.NegativeTTL == 0 {
+		c.config.NegativeTTL = defaultNegativeTTL
+	}
+	if config.Path != "" {
+		// 缓存文件损坏不影响启动
+		if err := c.load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Println("failed to load dns cache:", err)
+		}
+		go c.saveLoop()
+	}
+	return c
+}
+
+// staleUntil returns until when an entry may be served stale
+func (c *cache) staleUntil(entry *cacheEntry) time.Time {
+	return entry.expires.Add(time.Duration(c.config.ServeStale) * time.Second)
+}
+
+// get returns a copy of the cached response with the TTLs decreased by the
+// time elapsed since it was stored. refresh reports that the caller should
+// refresh the entry in the background, because it expired and is served
+// stale or because it is hot and about to expire
+func (c *cache) get(q dnsmessage.Question) (msg *dnsmessage.Message, refresh bool, ok bool) {
+	key := newCacheKey(q)
+	now := c.now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, exist := c.entries[key]
+	if !exist {
+		return nil, false, false
+	}
+	entry := element.Value.(*cacheEntry)
+
+	if now.Before(entry.expires) {
+		c.lru.MoveToFront(element)
+		entry.hits++
+		ttl := entry.expires.Sub(entry.stored)
+		if c.config.Prefetch && !entry.refreshing && entry.hits >= prefetchHits && entry.expires.Sub(now) < ttl/10 {
+			entry.refreshing = true
+			refresh = true
+		}
+		elapsed := uint32(now.Sub(entry.stored) / time.Second)
+		return copyMessage(entry.msg, elapsed, 0), refresh, true
+	}
+
+	if now.Before(c.staleUntil(entry)) {
+		c.lru.MoveToFront(element)
+		if !entry.refreshing {
+			entry.refreshing = true
+			refresh = true
+		}
+		return copyMessage(entry.msg, 0, staleTTL), refresh, true
+	}
+	c.remove(element)
+	c.dirty = true
+	return nil, false, false
+}
+
+// refreshed clears the refreshing mark after a failed refresh, a successful
+// refresh replaces the entry
+func (c *cache) refreshed(q dnsmessage.Question) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, exist := c.entries[newCacheKey(q)]; exist {
+		element.Value.(*cacheEntry).refreshing = false
+	}
+}
+
+// set caches a successful or NXDOMAIN response and returns it with the TTLs
+// clamped to the configured range
+func (c *cache) set(q dnsmessage.Question, msg *dnsmessage.Message) *dnsmessage.Message {
+	if msg.Truncated {
+		return msg
+	}
+	stored := copyMessage(msg, 0, 0)
+	c.clamp(stored.Answers)
+	c.clamp(stored.Authorities)
+	ttl, ok := c.ttl(stored)
+	if !ok || ttl == 0 {
+		return msg
+	}
+	now := c.now()
+	entry := &cacheEntry{
+		key:     newCacheKey(q),
+		msg:     stored,
+		stored:  now,
+		expires: now.Add(time.Duration(ttl) * time.Second),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, exist := c.entries[entry.key]; exist {
+		// 刷新后仍然是热点
+		entry.hits = old.Value.(*cacheEntry).hits
+		c.remove(old)
+	}
+	for c.lru.Len() >= c.size {
+		c.remove(c.lru.Back())
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.dirty = true
+	return copyMessage(stored, 0, 0)
+}
+
+func (c *cache) clamp(resources []dnsmessage.Resource) {
+	for i := range resources {
+		// OPT记录的TTL字段不是TTL
+		if resources[i].Header.Type == dnsmessage.TypeOPT {
+			continue
+		}
+		if resources[i].Header.TTL < c.config.MinTTL {
+			resources[i].Header.TTL = c.config.MinTTL
+		}
+		if c.config.MaxTTL > 0 && resources[i].Header.TTL > c.config.MaxTTL {
+			resources[i].Header.TTL = c.config.MaxTTL
+		}
+	}
+}
+
+// ttl returns the smallest TTL of the answers, negative responses use the
+// SOA record in the authority section
+func (c *cache) ttl(msg *dnsmessage.Message) (uint32, bool) {
+	if msg.RCode == dnsmessage.RCodeSuccess && len(msg.Answers) > 0 {
+		return minTTL(msg.Answers)
+	}
+	if msg.RCode != dnsmessage.RCodeSuccess && msg.RCode != dnsmessage.RCodeNameError {
+		return 0, false
+	}
+	for _, authority := range msg.Authorities {
+		if soa, ok := authority.Body.(*dnsmessage.SOAResource); ok {
+			ttl := authority.Header.TTL
+			if soa.MinTTL < ttl {
+				ttl = soa.MinTTL
+			}
+			return ttl, true
+		}
+	}
+	ttl := c.config.NegativeTTL
+	if ttl < c.config.MinTTL {
+		ttl = c.config.MinTTL
+	}
+	return ttl, true
+}
+
+func (c *cache) remove(element *list.Element) {
+	delete(c.entries, element.Value.(*cacheEntry).key)
+	c.lru.Remove(element)
+}
+
+func minTTL(resources []dnsmessage.Resource) (uint32, bool) {
+	if len(resources) == 0 {
+		return 0, false
+	}
+	ttl := resources[0].Header.TTL
+	for _, resource := range resources[1:] {
+		if resource.Header.TTL < ttl {
+			ttl = resource.Header.TTL
+		}
+	}
+	return ttl, true
+}
+
+// copyMessage copies msg with the TTLs decreased by elapsed seconds, or set
+// to ttl if it is not 0, the resource bodies are shared
+func copyMessage(msg *dnsmessage.Message, elapsed uint32, ttl uint32) *dnsmessage.Message {
+	copied := *msg
+	copied.Questions = append([]dnsmessage.Question(nil), msg.Questions...)
+	copied.Answers = copyResources(msg.Answers, elapsed, ttl)
+	copied.Authorities = copyResources(msg.Authorities, elapsed, ttl)
+	copied.Additionals = copyResources(msg.Additionals, elapsed, ttl)
+	return &copied
+}
+
+func copyResources(resources []dnsmessage.Resource, elapsed uint32, ttl uint32) []dnsmessage.Resource {
+	if resources == nil {
+		return nil
+	}
+	copied := append([]dnsmessage.Resource(nil), resources...)
+	for i := range copied {
+		// OPT记录的TTL字段不是TTL
+		if copied[i].Header.Type == dnsmessage.TypeOPT {
+			continue
+		}
+		if ttl != 0 {
+			copied[i].Header.TTL = ttl
+		} else if copied[i].Header.TTL > elapsed {
+			copied[i].Header.TTL -= elapsed
+		} else {
+			copied[i].Header.TTL = 0
+		}
+	}
+	return copied
+}
+
+// cacheFileEntry is a persisted response, the message is in wire format
+type cacheFileEntry struct {
+	Msg     []byte    `json:"msg"`
+	Stored  time.Time `json:"stored"`
+	Expires time.Time `json:"expires"`
+	Hits    int       `json:"hits,omitempty"`
+}
+
+func (c *cache) load() error {
+	data, err := os.ReadFile(c.config.Path)
+	if err != nil {
+		return err
+	}
+	var fileEntries []*cacheFileEntry
+	if err := json.Unmarshal(data, &fileEntries); err != nil {
+		return err
+	}
+
+	now := c.now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// 文件中最近使用的在前
+	for _, fileEntry := range fileEntries {
+		if c.lru.Len() >= c.size {
+			break
+		}
+		msg := &dnsmessage.Message{}
+		if err := msg.Unpack(fileEntry.Msg); err != nil || len(msg.Questions) == 0 {
+			continue
+		}
+		entry := &cacheEntry{key: newCacheKey(msg.Questions[0]), msg: msg, stored: fileEntry.Stored, expires: fileEntry.Expires, hits: fileEntry.Hits}
+		if _, exist := c.entries[entry.key]; exist || !now.Before(c.staleUntil(entry)) {
+			continue
+		}
+		c.entries[entry.key] = c.lru.PushBack(entry)
+	}
+	return nil
+}
+
+// save writes the cache to disk if it changed since the last save
+func (c *cache) save() error {
+	c.mu.Lock()
+	if !c.dirty {
+		c.mu.Unlock()
+		return nil
+	}
+	var fileEntries []*cacheFileEntry
+	for element := c.lru.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*cacheEntry)
+		b, err := entry.msg.Pack()
+		if err != nil {
+			continue
+		}
+		fileEntries = append(fileEntries, &cacheFileEntry{Msg: b, Stored: entry.stored, Expires: entry.expires, Hits: entry.hits})
+	}
+	c.dirty = false
+	c.mu.Unlock()
+
+	data, err := json.Marshal(fileEntries)
+	if err != nil {
+		return err
+	}
+	tmp := c.config.Path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.config.Path)
+}
+
+func (c *cache) saveLoop() {
+	t := time.NewTicker(cacheSaveInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := c.save(); err != nil {
+				log.Println(err)
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// Close persists the cache
+func (c *cache) Close() error {
+	if c.config.Path == "" {
+		return nil
+	}
+	close(c.closed)
+	return c.save()
+}
@@ -0,0 +1,185 @@
+package dns
+
+import (
+	"context"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ido2021/light-proxy/common"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func newCacheTestResolver(t *testing.T, s *testServer, config common.DNSCache) (*Resolver, *time.Time) {
+	r, err := NewResolver(common.DNS{
+		Servers: []common.DNSServer{{Tag: "udp", Address: s.serveUDP(t)}},
+		Cache:   config,
+	}, "", testOutAdaptors())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	now := time.Now()
+	r.cache.now = func() time.Time { return now }
+	return r, &now
+}
+
+func exchangeA(t *testing.T, r *Resolver, name string) *dnsmessage.Message {
+	query := &dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 1, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}
+	resp, err := r.Exchange(context.Background(), query)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return resp
+}
+
+// waitQueries waits for the background refresh to reach the server
+func waitQueries(t *testing.T, s *testServer, expected int32) {
+	for i := 0; i < 100; i++ {
+		if atomic.LoadInt32(&s.queries) == expected {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expect %d queries, got %d", expected, atomic.LoadInt32(&s.queries))
+}
+
+func TestCache_TTLClamp(t *testing.T) {
+	s := &testServer{records: map[string][]string{"example.com.": {"192.0.2.1"}}}
+	r, now := newCacheTestResolver(t, s, common.DNSCache{MinTTL: 300})
+	defer r.Close()
+
+	if resp := exchangeA(t, r, "example.com."); resp.Answers[0].Header.TTL != 300 {
+		t.Fatalf("bad ttl: %d", resp.Answers[0].Header.TTL)
+	}
+	*now = now.Add(200 * time.Second)
+	if resp := exchangeA(t, r, "example.com."); resp.Answers[0].Header.TTL != 100 || atomic.LoadInt32(&s.queries) != 1 {
+		t.Fatalf("bad: ttl %d queries %d", resp.Answers[0].Header.TTL, s.queries)
+	}
+
+	r2, _ := newCacheTestResolver(t, s, common.DNSCache{MaxTTL: 10})
+	defer r2.Close()
+	if resp := exchangeA(t, r2, "example.com."); resp.Answers[0].Header.TTL != 10 {
+		t.Fatalf("bad ttl: %d", resp.Answers[0].Header.TTL)
+	}
+}
+
+func TestCache_LRU(t *testing.T) {
+	s := &testServer{records: map[string][]string{
+		"a.example.com.": {"192.0.2.1"},
+		"b.example.com.": {"192.0.2.2"},
+		"c.example.com.": {"192.0.2.3"},
+	}}
+	r, _ := newCacheTestResolver(t, s, common.DNSCache{Size: 2})
+	defer r.Close()
+
+	exchangeA(t, r, "a.example.com.")
+	exchangeA(t, r, "b.example.com.")
+	// a最近使用过，缓存满时淘汰b
+	exchangeA(t, r, "a.example.com.")
+	exchangeA(t, r, "c.example.com.")
+	if queries := atomic.LoadInt32(&s.queries); queries != 3 {
+		t.Fatalf("bad: %d", queries)
+	}
+	exchangeA(t, r, "a.example.com.")
+	exchangeA(t, r, "c.example.com.")
+	if queries := atomic.LoadInt32(&s.queries); queries != 3 {
+		t.Fatalf("bad: %d", queries)
+	}
+	exchangeA(t, r, "b.example.com.")
+	if queries := atomic.LoadInt32(&s.queries); queries != 4 || r.cache.lru.Len() != 2 {
+		t.Fatalf("bad: %d %d", queries, r.cache.lru.Len())
+	}
+}
+
+func TestCache_Negative(t *testing.T) {
+	s := &testServer{}
+	r, now := newCacheTestResolver(t, s, common.DNSCache{NegativeTTL: 60})
+	defer r.Close()
+
+	for i := 0; i < 2; i++ {
+		if resp := exchangeA(t, r, "unknown.example.com."); resp.RCode != dnsmessage.RCodeNameError {
+			t.Fatalf("bad rcode: %v", resp.RCode)
+		}
+	}
+	if atomic.LoadInt32(&s.queries) != 1 {
+		t.Fatalf("bad query count: %d", s.queries)
+	}
+	*now = now.Add(time.Minute)
+	exchangeA(t, r, "unknown.example.com.")
+	if atomic.LoadInt32(&s.queries) != 2 {
+		t.Fatalf("bad query count: %d", s.queries)
+	}
+
+	// SOA记录的最小TTL
+	msg := &dnsmessage.Message{
+		Header: dnsmessage.Header{Response: true, RCode: dnsmessage.RCodeNameError},
+		Authorities: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: 3600},
+			Body:   &dnsmessage.SOAResource{NS: dnsmessage.MustNewName("ns.example.com."), MBox: dnsmessage.MustNewName("admin.example.com."), MinTTL: 120},
+		}},
+	}
+	if ttl, ok := r.cache.ttl(msg); !ok || ttl != 120 {
+		t.Fatalf("bad ttl: %d", ttl)
+	}
+}
+
+func TestCache_ServeStale(t *testing.T) {
+	s := &testServer{records: map[string][]string{"example.com.": {"192.0.2.1"}}}
+	r, now := newCacheTestResolver(t, s, common.DNSCache{ServeStale: 3600})
+	defer r.Close()
+
+	exchangeA(t, r, "example.com.")
+	*now = now.Add(2 * time.Minute)
+	// 过期的应答立即返回，后台刷新
+	if resp := exchangeA(t, r, "example.com."); resp.Answers[0].Header.TTL != staleTTL {
+		t.Fatalf("bad ttl: %d", resp.Answers[0].Header.TTL)
+	}
+	waitQueries(t, s, 2)
+	if resp := exchangeA(t, r, "example.com."); resp.Answers[0].Header.TTL != 60 {
+		t.Fatalf("bad ttl: %d", resp.Answers[0].Header.TTL)
+	}
+
+	*now = now.Add(2 * time.Hour)
+	exchangeA(t, r, "example.com.")
+	if atomic.LoadInt32(&s.queries) != 3 {
+		t.Fatalf("bad query count: %d", s.queries)
+	}
+}
+
+func TestCache_Prefetch(t *testing.T) {
+	s := &testServer{records: map[string][]string{"example.com.": {"192.0.2.1"}}}
+	r, now := newCacheTestResolver(t, s, common.DNSCache{Prefetch: true})
+	defer r.Close()
+
+	exchangeA(t, r, "example.com.")
+	for i := 0; i < prefetchHits-1; i++ {
+		exchangeA(t, r, "example.com.")
+	}
+	*now = now.Add(57 * time.Second)
+	exchangeA(t, r, "example.com.")
+	waitQueries(t, s, 2)
+	if resp := exchangeA(t, r, "example.com."); resp.Answers[0].Header.TTL != 60 {
+		t.Fatalf("bad ttl: %d", resp.Answers[0].Header.TTL)
+	}
+}
+
+func TestCache_Persist(t *testing.T) {
+	s := &testServer{records: map[string][]string{"example.com.": {"192.0.2.1"}}}
+	config := common.DNSCache{Path: filepath.Join(t.TempDir(), "cache.json")}
+	r, _ := newCacheTestResolver(t, s, config)
+	exchangeA(t, r, "example.com.")
+	if err := r.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	r, _ = newCacheTestResolver(t, s, config)
+	defer r.Close()
+	resp := exchangeA(t, r, "example.com.")
+	if len(resp.Answers) != 1 || atomic.LoadInt32(&s.queries) != 1 {
+		t.Fatalf("bad: %v queries %d", resp.Answers, s.queries)
+	}
+}
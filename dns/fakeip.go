@@ -0,0 +1,355 @@
+package dns
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ido2021/light-proxy/common"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// addressFakeIP answers with addresses from the fake-IP pool
+	addressFakeIP = "fakeip"
+
+	defaultFakeIPRange = "198.18.0.0/15"
+	defaultFakeIPSize  = 65536
+	// fakeIPTTL 应答的TTL很短，映射被淘汰后客户端能尽快重新查询
+	fakeIPTTL = 1
+	// fakeIPSaveInterval is how often a changed map is persisted
+	fakeIPSaveInterval = time.Minute
+)
+
+var (
+	errFakeIPNotConfigured = errors.New("fakeip is not configured")
+)
+
+type fakeIPEntry struct {
+	Domain string     `json:"domain"`
+	IPv4   netip.Addr `json:"ipv4,omitempty"`
+	IPv6   netip.Addr `json:"ipv6,omitempty"`
+}
+
+// fakeIPPool hands out the addresses of a prefix in order
+type fakeIPPool struct {
+	prefix netip.Prefix
+	next   netip.Addr
+	size   int
+}
+
+func newFakeIPPool(cidr string) (*fakeIPPool, error) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return nil, err
+	}
+	prefix = prefix.Masked()
+	bits := prefix.Addr().BitLen() - prefix.Bits()
+	size := 1 << 30
+	if bits < 30 {
+		size = 1 << bits
+	}
+	// 不使用网络地址和广播地址
+	if size <= 2 {
+		return nil, fmt.Errorf("fakeip range too small: %s", cidr)
+	}
+	return &fakeIPPool{prefix: prefix, next: prefix.Addr().Next(), size: size - 2}, nil
+}
+
+// allocate returns the next address, wrapping around at the end of the prefix
+func (p *fakeIPPool) allocate() netip.Addr {
+	addr := p.next
+	p.next = addr.Next()
+	if !p.prefix.Contains(p.next.Next()) {
+		p.next = p.prefix.Addr().Next()
+	}
+	return addr
+}
+
+// FakeIP keeps a bidirectional map between domains and fake addresses, the
+// least recently used domain gives its addresses up when the map is full
+type FakeIP struct {
+	mu       sync.Mutex
+	inet4    *fakeIPPool
+	inet6    *fakeIPPool
+	size     int
+	lru      *list.List
+	byDomain map[string]*list.Element
+	byIP     map[netip.Addr]*list.Element
+
+	path   string
+	dirty  bool
+	closed chan struct{}
+}
+
+func NewFakeIP(config common.FakeIP) (*FakeIP, error) {
+	inet4Range := config.Inet4Range
+	if inet4Range == "" {
+		inet4Range = defaultFakeIPRange
+	}
+	inet4, err := newFakeIPPool(inet4Range)
+	if err != nil {
+		return nil, err
+	}
+	if !inet4.prefix.Addr().Is4() {
+		return nil, fmt.Errorf("invalid fakeip inet4Range: %s", inet4Range)
+	}
+	f := &FakeIP{
+		inet4:    inet4,
+		size:     config.Size,
+		lru:      list.New(),
+		byDomain: map[string]*list.Element{},
+		byIP:     map[netip.Addr]*list.Element{},
+		path:     config.Path,
+		closed:   make(chan struct{}),
+	}
+	if f.size <= 0 {
+		f.size = defaultFakeIPSize
+	}
+	if f.size > inet4.size {
+		f.size = inet4.size
+	}
+	if config.Inet6Range != "" {
+		if f.inet6, err = newFakeIPPool(config.Inet6Range); err != nil {
+			return nil, err
+		}
+		if !f.inet6.prefix.Addr().Is6() {
+			return nil, fmt.Errorf("invalid fakeip inet6Range: %s", config.Inet6Range)
+		}
+		if f.size > f.inet6.size {
+			f.size = f.inet6.size
+		}
+	}
+
+	if f.path != "" {
+		if err := f.load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to load fakeip %s: %w", f.path, err)
+		}
+		go f.saveLoop()
+	}
+	return f, nil
+}
+
+// Lookup returns the fake addresses of domain, allocating them on first use
+func (f *FakeIP) Lookup(domain string) (netip.Addr, netip.Addr) {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if elem, exist := f.byDomain[domain]; exist {
+		f.lru.MoveToFront(elem)
+		entry := elem.Value.(*fakeIPEntry)
+		return entry.IPv4, entry.IPv6
+	}
+
+	entry := &fakeIPEntry{Domain: domain}
+	if f.lru.Len() >= f.size {
+		// 复用最久未使用的域名的地址
+		oldest := f.lru.Back()
+		old := oldest.Value.(*fakeIPEntry)
+		f.lru.Remove(oldest)
+		delete(f.byDomain, old.Domain)
+		entry.IPv4, entry.IPv6 = old.IPv4, old.IPv6
+	} else {
+		entry.IPv4 = f.allocate(f.inet4)
+		if f.inet6 != nil {
+			entry.IPv6 = f.allocate(f.inet6)
+		}
+	}
+	f.add(entry)
+	f.dirty = true
+	return entry.IPv4, entry.IPv6
+}
+
+// allocate returns an address of pool which is not in use
+func (f *FakeIP) allocate(pool *fakeIPPool) netip.Addr {
+	for {
+		addr := pool.allocate()
+		if _, used := f.byIP[addr]; !used {
+			return addr
+		}
+	}
+}
+
+func (f *FakeIP) add(entry *fakeIPEntry) {
+	elem := f.lru.PushFront(entry)
+	f.byDomain[entry.Domain] = elem
+	f.byIP[entry.IPv4] = elem
+	if entry.IPv6.IsValid() {
+		f.byIP[entry.IPv6] = elem
+	}
+}
+
+// Contains reports whether ip belongs to the fake-IP ranges
+func (f *FakeIP) Contains(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	return f.inet4.prefix.Contains(addr) || (f.inet6 != nil && f.inet6.prefix.Contains(addr))
+}
+
+// LookupDomain returns the domain a fake address was handed out for
+func (f *FakeIP) LookupDomain(ip net.IP) (string, bool) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return "", false
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	elem, exist := f.byIP[addr.Unmap()]
+	if !exist {
+		return "", false
+	}
+	f.lru.MoveToFront(elem)
+	return elem.Value.(*fakeIPEntry).Domain, true
+}
+
+// fakeIPFile is the persisted map, entries are ordered from the most recently used
+type fakeIPFile struct {
+	Inet4Range string         `json:"inet4Range"`
+	Inet6Range string         `json:"inet6Range,omitempty"`
+	Entries    []*fakeIPEntry `json:"entries"`
+}
+
+func (f *FakeIP) load() error {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	file := &fakeIPFile{}
+	if err := json.Unmarshal(data, file); err != nil {
+		return err
+	}
+	inet6Range := ""
+	if f.inet6 != nil {
+		inet6Range = f.inet6.prefix.String()
+	}
+	// 地址池变化后旧的映射无效
+	if file.Inet4Range != f.inet4.prefix.String() || file.Inet6Range != inet6Range {
+		return nil
+	}
+
+	for i := len(file.Entries) - 1; i >= 0 && f.lru.Len() < f.size; i-- {
+		entry := file.Entries[i]
+		if entry.Domain == "" || !f.inet4.prefix.Contains(entry.IPv4) || f.byIP[entry.IPv4] != nil {
+			continue
+		}
+		if f.inet6 != nil && (!f.inet6.prefix.Contains(entry.IPv6) || f.byIP[entry.IPv6] != nil) {
+			continue
+		}
+		if f.inet6 == nil {
+			entry.IPv6 = netip.Addr{}
+		}
+		f.add(entry)
+		// 从最新分配的地址之后继续分配
+		if i == 0 {
+			f.inet4.next = entry.IPv4
+			f.inet4.allocate()
+			if f.inet6 != nil {
+				f.inet6.next = entry.IPv6
+				f.inet6.allocate()
+			}
+		}
+	}
+	return nil
+}
+
+// save writes the map to disk if it changed since the last save
+func (f *FakeIP) save() error {
+	f.mu.Lock()
+	if !f.dirty {
+		f.mu.Unlock()
+		return nil
+	}
+	file := &fakeIPFile{Inet4Range: f.inet4.prefix.String()}
+	if f.inet6 != nil {
+		file.Inet6Range = f.inet6.prefix.String()
+	}
+	for elem := f.lru.Front(); elem != nil; elem = elem.Next() {
+		entry := *elem.Value.(*fakeIPEntry)
+		file.Entries = append(file.Entries, &entry)
+	}
+	f.dirty = false
+	f.mu.Unlock()
+
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+	tmp := f.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path)
+}
+
+func (f *FakeIP) saveLoop() {
+	t := time.NewTicker(fakeIPSaveInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := f.save(); err != nil {
+				log.Println(err)
+			}
+		case <-f.closed:
+			return
+		}
+	}
+}
+
+// Close persists the map
+func (f *FakeIP) Close() error {
+	if f.path == "" {
+		return nil
+	}
+	close(f.closed)
+	return f.save()
+}
+
+// fakeIPTransport answers A and AAAA queries with fake addresses
+type fakeIPTransport struct {
+	fakeIP *FakeIP
+}
+
+func (t *fakeIPTransport) Exchange(ctx context.Context, query *dnsmessage.Message) (*dnsmessage.Message, error) {
+	resp := &dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 query.ID,
+			Response:           true,
+			RecursionDesired:   query.RecursionDesired,
+			RecursionAvailable: true,
+		},
+		Questions: query.Questions,
+	}
+	// 其他类型返回空应答
+	q := query.Questions[0]
+	if q.Type != dnsmessage.TypeA && q.Type != dnsmessage.TypeAAAA {
+		return resp, nil
+	}
+
+	ipv4, ipv6 := t.fakeIP.Lookup(q.Name.String())
+	header := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET, TTL: fakeIPTTL}
+	if q.Type == dnsmessage.TypeA {
+		resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AResource{A: ipv4.As4()}})
+	} else if ipv6.IsValid() {
+		resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AAAAResource{AAAA: ipv6.As16()}})
+	}
+	return resp, nil
+}
+
+func (t *fakeIPTransport) Close() error {
+	return nil
+}
@@ -0,0 +1,106 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/ido2021/light-proxy/common"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestFakeIP(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fakeip.json")
+	config := common.FakeIP{Inet4Range: "198.18.0.0/30", Inet6Range: "fc00::/64", Path: path}
+	f, err := NewFakeIP(config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	a4, a6 := f.Lookup("A.example.com.")
+	if a4.String() != "198.18.0.1" || a6.String() != "fc00::1" {
+		t.Fatalf("bad: %s %s", a4, a6)
+	}
+	if b4, _ := f.Lookup("b.example.com"); b4.String() != "198.18.0.2" {
+		t.Fatalf("bad: %s", b4)
+	}
+	if again, _ := f.Lookup("a.example.com"); again != a4 {
+		t.Fatalf("bad: %s", again)
+	}
+	if domain, ok := f.LookupDomain(net.ParseIP("fc00::1")); !ok || domain != "a.example.com" {
+		t.Fatalf("bad: %s", domain)
+	}
+
+	// 地址池只有两个地址，淘汰最久未使用的b.example.com
+	if c4, _ := f.Lookup("c.example.com"); c4.String() != "198.18.0.2" {
+		t.Fatalf("bad: %s", c4)
+	}
+	if _, ok := f.LookupDomain(net.ParseIP("198.18.0.2")); !ok {
+		t.Fatal("expect c.example.com")
+	}
+	if !f.Contains(net.ParseIP("198.18.0.3")) || f.Contains(net.ParseIP("198.19.0.1")) {
+		t.Fatal("bad range")
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// 重启后映射仍然有效
+	f, err = NewFakeIP(config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer f.Close()
+	if domain, ok := f.LookupDomain(net.ParseIP("198.18.0.2")); !ok || domain != "c.example.com" {
+		t.Fatalf("bad: %s", domain)
+	}
+	if a4, _ := f.Lookup("a.example.com"); a4.String() != "198.18.0.1" {
+		t.Fatalf("bad: %s", a4)
+	}
+
+	if _, err := NewFakeIP(common.FakeIP{Inet4Range: "fc00::/64"}); err == nil {
+		t.Fatal("expect error")
+	}
+}
+
+func TestResolver_FakeIP(t *testing.T) {
+	s := &testServer{records: map[string][]string{"www.example.com.": {"192.0.2.1"}}}
+	r, err := NewResolver(common.DNS{
+		Servers: []common.DNSServer{
+			{Tag: "fakeip", Address: "fakeip"},
+			{Tag: "udp", Address: s.serveUDP(t)},
+		},
+		Final:  "fakeip",
+		FakeIP: &common.FakeIP{},
+	}, "", testOutAdaptors())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer r.Close()
+
+	// 内部解析使用真实的服务器
+	if addrs := lookup(t, r, "www.example.com"); len(addrs) != 1 || addrs[0] != "192.0.2.1" {
+		t.Fatalf("bad: %v", addrs)
+	}
+
+	query := &dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 1, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName("www.example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}
+	resp, err := r.Exchange(context.Background(), query)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ip := net.IP(resp.Answers[0].Body.(*dnsmessage.AResource).A[:])
+	if !r.FakeIP().Contains(ip) {
+		t.Fatalf("expect fake ip, got %s", ip)
+	}
+	if domain, ok := r.FakeIP().LookupDomain(ip); !ok || domain != "www.example.com" {
+		t.Fatalf("bad: %s", domain)
+	}
+
+	if _, err := NewResolver(common.DNS{Servers: []common.DNSServer{{Tag: "fakeip", Address: "fakeip"}}}, "", testOutAdaptors()); err == nil {
+		t.Fatal("expect error")
+	}
+}
@@ -0,0 +1,236 @@
+package dns
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// hostsTTL is the TTL of the answers from hosts
+	hostsTTL = 60
+	// maxAliasDepth bounds following aliases pointing to other hosts entries
+	maxAliasDepth = 8
+)
+
+type hostsEntry struct {
+	addrs []netip.Addr
+	// alias 不为空时域名是alias的别名
+	alias string
+}
+
+// Hosts maps domains to fixed addresses or to aliases which are resolved
+// instead, *.example.com matches all subdomains of example.com
+type Hosts struct {
+	exact    map[string]*hostsEntry
+	wildcard map[string]*hostsEntry
+}
+
+// NewHosts loads the hosts file at path, in /etc/hosts format, and then the
+// entries of config which override the file. A value of config is a list of
+// addresses or a single domain as alias
+func NewHosts(config map[string][]string, path string) (*Hosts, error) {
+	h := &Hosts{exact: map[string]*hostsEntry{}, wildcard: map[string]*hostsEntry{}}
+	if path != "" {
+		if err := h.load(path); err != nil {
+			return nil, fmt.Errorf("failed to load hosts %s: %w", path, err)
+		}
+	}
+
+	for domain, values := range config {
+		entry := &hostsEntry{}
+		for _, value := range values {
+			addr, err := netip.ParseAddr(value)
+			if err != nil {
+				if len(values) != 1 {
+					return nil, fmt.Errorf("hosts %s: invalid address %s", domain, value)
+				}
+				entry.alias = normalizeHost(value)
+				break
+			}
+			entry.addrs = append(entry.addrs, addr.Unmap())
+		}
+		h.set(domain, entry)
+	}
+	if err := h.checkAliases(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// checkAliases rejects aliases which lead back to an entry already followed,
+// including a wildcard matching its own alias, and chains of more than
+// maxAliasDepth entries which Lookup would not follow to the end
+func (h *Hosts) checkAliases() error {
+	for _, entries := range []map[string]*hostsEntry{h.exact, h.wildcard} {
+		for domain, entry := range entries {
+			followed := map[*hostsEntry]bool{entry: true}
+			for entry.alias != "" {
+				next := h.match(entry.alias)
+				if next == nil {
+					break
+				}
+				if followed[next] {
+					return fmt.Errorf("hosts %s: alias loop at %s", domain, entry.alias)
+				}
+				followed[next] = true
+				if len(followed) > maxAliasDepth {
+					return fmt.Errorf("hosts %s: alias chain longer than %d", domain, maxAliasDepth)
+				}
+				entry = next
+			}
+		}
+	}
+	return nil
+}
+
+func (h *Hosts) load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// 同一域名的多行地址合并
+	loaded := map[string]*hostsEntry{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		// 去掉IPv6地址的zone
+		addr, err := netip.ParseAddr(strings.SplitN(fields[0], "%", 2)[0])
+		if err != nil {
+			continue
+		}
+		for _, domain := range fields[1:] {
+			domain = normalizeHost(domain)
+			entry, exist := loaded[domain]
+			if !exist {
+				entry = &hostsEntry{}
+				loaded[domain] = entry
+				h.set(domain, entry)
+			}
+			entry.addrs = append(entry.addrs, addr.Unmap())
+		}
+	}
+	return scanner.Err()
+}
+
+func (h *Hosts) set(domain string, entry *hostsEntry) {
+	domain = normalizeHost(domain)
+	if strings.HasPrefix(domain, "*.") {
+		h.wildcard[domain[2:]] = entry
+	} else {
+		h.exact[domain] = entry
+	}
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+func (h *Hosts) match(domain string) *hostsEntry {
+	if entry, exist := h.exact[domain]; exist {
+		return entry
+	}
+	// 最长的后缀优先
+	for i := strings.IndexByte(domain, '.'); i >= 0; {
+		if entry, exist := h.wildcard[domain[i+1:]]; exist {
+			return entry
+		}
+		next := strings.IndexByte(domain[i+1:], '.')
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	return nil
+}
+
+// Lookup returns the fixed addresses of domain, or the alias to resolve
+// instead when the aliases end at a domain without addresses. ok is false
+// if domain is not in hosts
+func (h *Hosts) Lookup(domain string) (addrs []netip.Addr, alias string, ok bool) {
+	if h == nil {
+		return nil, "", false
+	}
+	domain = normalizeHost(domain)
+	for depth := 0; depth < maxAliasDepth; depth++ {
+		entry := h.match(domain)
+		if entry == nil {
+			if depth == 0 {
+				return nil, "", false
+			}
+			return nil, domain, true
+		}
+		if entry.alias == "" {
+			return entry.addrs, "", true
+		}
+		domain = entry.alias
+	}
+	return nil, domain, true
+}
+
+// exchangeHosts answers A and AAAA queries for the domains in hosts, aliases
+// are answered with a CNAME followed by the answers of the alias from the
+// servers. Lookup already followed the aliases in hosts, the alias is not
+// looked up in hosts again
+func (r *Resolver) exchangeHosts(ctx context.Context, query *dnsmessage.Message, fake bool) (*dnsmessage.Message, bool, error) {
+	q := query.Questions[0]
+	if q.Type != dnsmessage.TypeA && q.Type != dnsmessage.TypeAAAA {
+		return nil, false, nil
+	}
+	addrs, alias, ok := r.hosts.Lookup(q.Name.String())
+	if !ok {
+		return nil, false, nil
+	}
+
+	resp := &dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 query.ID,
+			Response:           true,
+			RecursionDesired:   query.RecursionDesired,
+			RecursionAvailable: true,
+		},
+		Questions: query.Questions,
+	}
+	if alias == "" {
+		header := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET, TTL: hostsTTL}
+		for _, addr := range addrs {
+			if q.Type == dnsmessage.TypeA && addr.Is4() {
+				resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AResource{A: addr.As4()}})
+			} else if q.Type == dnsmessage.TypeAAAA && addr.Is6() {
+				resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AAAAResource{AAAA: addr.As16()}})
+			}
+		}
+		return resp, true, nil
+	}
+
+	target, err := dnsmessage.NewName(alias + ".")
+	if err != nil {
+		return nil, true, err
+	}
+	aliasQuery := *query
+	aliasQuery.Questions = []dnsmessage.Question{{Name: target, Type: q.Type, Class: q.Class}}
+	aliasResp, err := r.exchangeServers(ctx, &aliasQuery, fake)
+	if err != nil {
+		return nil, true, err
+	}
+	resp.RCode = aliasResp.RCode
+	resp.Answers = append([]dnsmessage.Resource{{
+		Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeCNAME, Class: dnsmessage.ClassINET, TTL: hostsTTL},
+		Body:   &dnsmessage.CNAMEResource{CNAME: target},
+	}}, aliasResp.Answers...)
+	return resp, true, nil
+}
@@ -0,0 +1,137 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ido2021/light-proxy/common"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestHosts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	content := `# comment
+127.0.0.1	localhost
+10.0.0.2 git.corp nas.corp # inline comment
+fd00::2 git.corp
+10.0.0.9 *.svc.corp
+invalid line
+`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	h, err := NewHosts(map[string][]string{
+		"nas.corp":      {"10.0.0.3"},
+		"wiki.corp":     {"git.corp."},
+		"mirror.corp":   {"mirror.example.com"},
+		"*.db.svc.corp": {"10.0.0.10"},
+		"multi.corp":    {"10.0.0.4", "10.0.0.5"},
+	}, path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	cases := []struct {
+		domain string
+		addrs  []string
+		alias  string
+		ok     bool
+	}{
+		{"localhost", []string{"127.0.0.1"}, "", true},
+		{"GIT.corp.", []string{"10.0.0.2", "fd00::2"}, "", true},
+		{"nas.corp", []string{"10.0.0.3"}, "", true},
+		{"wiki.corp", []string{"10.0.0.2", "fd00::2"}, "", true},
+		{"mirror.corp", nil, "mirror.example.com", true},
+		{"a.svc.corp", []string{"10.0.0.9"}, "", true},
+		{"x.a.svc.corp", []string{"10.0.0.9"}, "", true},
+		{"main.db.svc.corp", []string{"10.0.0.10"}, "", true},
+		{"svc.corp", nil, "", false},
+		{"multi.corp", []string{"10.0.0.4", "10.0.0.5"}, "", true},
+		{"example.com", nil, "", false},
+	}
+	for _, c := range cases {
+		addrs, alias, ok := h.Lookup(c.domain)
+		if ok != c.ok || alias != c.alias || len(addrs) != len(c.addrs) {
+			t.Fatalf("%s: bad: %v %s %v", c.domain, addrs, alias, ok)
+		}
+		for i, addr := range addrs {
+			if addr.String() != c.addrs[i] {
+				t.Fatalf("%s: bad: %v", c.domain, addrs)
+			}
+		}
+	}
+
+	for _, config := range []map[string][]string{
+		{"a.corp": {"10.0.0.1", "b.corp"}},
+		{"loop.corp": {"loop.corp"}},
+		{"a.corp": {"b.corp"}, "b.corp": {"a.corp"}},
+		// 通配符匹配自己的别名
+		{"*.corp.example": {"gw.corp.example"}},
+		{"a.corp": {"x.b.corp"}, "*.b.corp": {"c.corp"}, "c.corp": {"a.corp"}},
+	} {
+		if _, err := NewHosts(config, ""); err == nil {
+			t.Fatalf("%v: expect error", config)
+		}
+	}
+	if _, err := NewHosts(map[string][]string{"*.corp.example": {"gw.example"}, "gw.example": {"10.0.0.1"}}, ""); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := NewHosts(nil, filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Fatal("expect error")
+	}
+}
+
+func TestResolver_Hosts(t *testing.T) {
+	s := &testServer{records: map[string][]string{"mirror.example.com.": {"192.0.2.1"}}}
+	r, err := NewResolver(common.DNS{Servers: []common.DNSServer{{Tag: "udp", Address: s.serveUDP(t)}}}, "", testOutAdaptors())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer r.Close()
+	config := map[string][]string{
+		"git.corp":    {"10.0.0.2"},
+		"mirror.corp": {"mirror.example.com"},
+	}
+	// 最长maxAliasDepth个条目的别名链
+	for i := 1; i < maxAliasDepth; i++ {
+		config[fmt.Sprintf("c%d.corp", i)] = []string{fmt.Sprintf("c%d.corp", i+1)}
+	}
+	config[fmt.Sprintf("c%d.corp", maxAliasDepth)] = []string{"10.0.0.9"}
+	hosts, err := NewHosts(config, "")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	r.SetHosts(hosts)
+
+	if addrs := lookup(t, r, "git.corp"); len(addrs) != 1 || addrs[0] != "10.0.0.2" {
+		t.Fatalf("bad: %v", addrs)
+	}
+	if addrs := lookup(t, r, "mirror.corp"); len(addrs) != 1 || addrs[0] != "192.0.2.1" {
+		t.Fatalf("bad: %v", addrs)
+	}
+	if addrs := lookup(t, r, "c1.corp"); len(addrs) != 1 || addrs[0] != "10.0.0.9" {
+		t.Fatalf("bad: %v", addrs)
+	}
+	config["c0.corp"] = []string{"c1.corp"}
+	if _, err := NewHosts(config, ""); err == nil {
+		t.Fatal("expect error")
+	}
+
+	query := &dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 1, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName("mirror.corp."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}
+	resp, err := r.Exchange(context.Background(), query)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(resp.Answers) != 2 || resp.Answers[0].Header.Type != dnsmessage.TypeCNAME || resp.Answers[1].Header.Type != dnsmessage.TypeA {
+		t.Fatalf("bad: %+v", resp.Answers)
+	}
+	if resp.Answers[0].Body.(*dnsmessage.CNAMEResource).CNAME.String() != "mirror.example.com." {
+		t.Fatalf("bad: %+v", resp.Answers[0])
+	}
+}
@@ -0,0 +1,394 @@
+// Package dns resolves domains with configurable upstream servers, which
+// are reached through the outbounds, and caches the answers by their TTL.
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/ido2021/light-proxy/adaptor/outbound"
+	"github.com/ido2021/light-proxy/common"
+	"github.com/ido2021/light-proxy/route"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// queryTimeout bounds a query to a single server
+const queryTimeout = 5 * time.Second
+
+var (
+	errNoServer   = errors.New("dns: no server configured")
+	errNoQuestion = errors.New("dns: query has no question")
+)
+
+type server struct {
+	tag       string
+	transport transport
+	// fake 为true时应答来自fakeip地址池
+	fake bool
+}
+
+// exchange sends the query to the server with a timeout
+func (s *server) exchange(ctx context.Context, query *dnsmessage.Message) (*dnsmessage.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	resp, err := s.transport.Exchange(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("dns server %s: %w", s.tag, err)
+	}
+	return resp, nil
+}
+
+// rule selects the server for the queried domains it matches
+type rule struct {
+	domains route.DomainSet
+	server  *server
+}
+
+type Resolver struct {
+	servers  []*server
+	rules    []*rule
+	final    *server
+	fallback []*server
+	cache    *cache
+	fakeIP   *FakeIP
+	hosts    *Hosts
+}
+
+// NewResolver creates the resolver described by config, geositePath is the
+// geosite of the route used by geosite rules
+func NewResolver(config common.DNS, geositePath string, outAdaptors map[string]*outbound.WrapperOutAdaptor) (*Resolver, error) {
+	if len(config.Servers) == 0 {
+		return nil, errNoServer
+	}
+	r := &Resolver{cache: newCache(config.Cache)}
+	if config.FakeIP != nil {
+		fakeIP, err := NewFakeIP(*config.FakeIP)
+		if err != nil {
+			return nil, err
+		}
+		r.fakeIP = fakeIP
+	}
+	servers := map[string]*server{}
+	for _, serverConfig := range config.Servers {
+		if serverConfig.Tag == "" {
+			r.Close()
+			return nil, errors.New("DNS服务器未配置tag: " + serverConfig.Address)
+		}
+		if _, exist := servers[serverConfig.Tag]; exist {
+			r.Close()
+			return nil, errors.New("重复的DNS服务器tag: " + serverConfig.Tag)
+		}
+		if serverConfig.Address == addressFakeIP {
+			if r.fakeIP == nil {
+				r.Close()
+				return nil, errFakeIPNotConfigured
+			}
+			s := &server{tag: serverConfig.Tag, transport: &fakeIPTransport{fakeIP: r.fakeIP}, fake: true}
+			servers[s.tag] = s
+			r.servers = append(r.servers, s)
+			continue
+		}
+		detour := serverConfig.Detour
+		if detour == "" {
+			detour = outbound.Direct
+		}
+		outAdaptor, exist := outAdaptors[detour]
+		if !exist {
+			r.Close()
+			return nil, errors.New("未配置接出代理：" + detour)
+		}
+		t, err := newTransport(serverConfig.Address, outAdaptor)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		s := &server{tag: serverConfig.Tag, transport: t}
+		servers[s.tag] = s
+		r.servers = append(r.servers, s)
+	}
+
+	lookup := func(tag string) (*server, error) {
+		s, exist := servers[tag]
+		if !exist {
+			return nil, errors.New("未配置DNS服务器：" + tag)
+		}
+		return s, nil
+	}
+	var err error
+	r.final = r.servers[0]
+	if config.Final != "" {
+		if r.final, err = lookup(config.Final); err != nil {
+			r.Close()
+			return nil, err
+		}
+	}
+	for _, tag := range config.Fallback {
+		s, err := lookup(tag)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r.fallback = append(r.fallback, s)
+	}
+
+	var geosite *route.Geosite
+	for _, ruleConfig := range config.Rules {
+		set := &route.RuleSet{
+			Full:    ruleConfig.Domain,
+			Suffix:  ruleConfig.DomainSuffix,
+			Keyword: ruleConfig.DomainKeyword,
+			Regexp:  ruleConfig.DomainRegex,
+		}
+		if len(ruleConfig.Geosite) > 0 {
+			if geosite == nil {
+				if geositePath == "" {
+					r.Close()
+					return nil, errors.New("geosite is not configured")
+				}
+				if geosite, err = route.LoadGeosite(geositePath); err != nil {
+					r.Close()
+					return nil, fmt.Errorf("failed to load geosite %s: %w", geositePath, err)
+				}
+			}
+			merged, err := geosite.Merge(ruleConfig.Geosite)
+			if err != nil {
+				r.Close()
+				return nil, err
+			}
+			set.Full = append(set.Full, merged.Full...)
+			set.Suffix = append(set.Suffix, merged.Suffix...)
+			set.Keyword = append(set.Keyword, merged.Keyword...)
+			set.Regexp = append(set.Regexp, merged.Regexp...)
+		}
+		domains, err := route.NewDomainSet(set)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		s, err := lookup(ruleConfig.Server)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r.rules = append(r.rules, &rule{domains: domains, server: s})
+	}
+	return r, nil
+}
+
+// NewLocalResolver caches the answers of the resolver of outAdaptor itself as
+// configured by cacheConfig
+func NewLocalResolver(outAdaptor *outbound.WrapperOutAdaptor, cacheConfig common.DNSCache) *Resolver {
+	s := &server{tag: addressLocal, transport: &localTransport{outAdaptor: outAdaptor}}
+	return &Resolver{servers: []*server{s}, final: s, cache: newCache(cacheConfig)}
+}
+
+// SetHosts sets the hosts consulted before any server
+func (r *Resolver) SetHosts(hosts *Hosts) {
+	r.hosts = hosts
+}
+
+// Hosts returns the static hosts, nil if none are set
+func (r *Resolver) Hosts() *Hosts {
+	return r.hosts
+}
+
+// FakeIP returns the fake-IP pool, nil if it is not configured
+func (r *Resolver) FakeIP() *FakeIP {
+	return r.fakeIP
+}
+
+// serversFor returns the servers to try in order for domain, fakeip servers
+// are skipped unless fake is true
+func (r *Resolver) serversFor(domain string, fake bool) []*server {
+	var selected *server
+	for _, rule := range r.rules {
+		if (fake || !rule.server.fake) && rule.domains.MatchDomain(domain) {
+			selected = rule.server
+			break
+		}
+	}
+	if selected == nil && (fake || !r.final.fake) {
+		selected = r.final
+	}
+	var servers []*server
+	if selected != nil {
+		servers = append(servers, selected)
+	}
+	for _, s := range r.fallback {
+		if s != selected && !s.fake {
+			servers = append(servers, s)
+		}
+	}
+	// 只配置了fakeip规则时使用第一个真实的服务器
+	if len(servers) == 0 {
+		for _, s := range r.servers {
+			if !s.fake {
+				return []*server{s}
+			}
+		}
+	}
+	return servers
+}
+
+// Exchange answers the query from the cache or the servers selected by the
+// rules, the next server is tried if one fails or answers with an error other
+// than NXDOMAIN. Domains in hosts are answered first, domains routed to a
+// fakeip server get fake addresses
+func (r *Resolver) Exchange(ctx context.Context, query *dnsmessage.Message) (*dnsmessage.Message, error) {
+	return r.exchange(ctx, query, true)
+}
+
+func (r *Resolver) exchange(ctx context.Context, query *dnsmessage.Message, fake bool) (*dnsmessage.Message, error) {
+	if len(query.Questions) == 0 {
+		return nil, errNoQuestion
+	}
+	if resp, ok, err := r.exchangeHosts(ctx, query, fake); ok {
+		return resp, err
+	}
+	return r.exchangeServers(ctx, query, fake)
+}
+
+// exchangeServers answers query from the cache or the servers, without hosts
+func (r *Resolver) exchangeServers(ctx context.Context, query *dnsmessage.Message, fake bool) (*dnsmessage.Message, error) {
+	q := query.Questions[0]
+	servers := r.serversFor(strings.TrimSuffix(q.Name.String(), "."), fake)
+	if len(servers) == 0 {
+		return nil, errNoServer
+	}
+	// 假地址不缓存，也不能用缓存中的真实地址应答
+	if servers[0].fake {
+		return servers[0].exchange(ctx, query)
+	}
+	if resp, refresh, ok := r.cache.get(q); ok {
+		if refresh {
+			go r.refresh(query, servers)
+		}
+		resp.ID = query.ID
+		return resp, nil
+	}
+	return r.query(ctx, query, servers)
+}
+
+// refresh queries the servers again for a stale or hot cache entry
+func (r *Resolver) refresh(query *dnsmessage.Message, servers []*server) {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	if _, err := r.query(ctx, query, servers); err != nil {
+		r.cache.refreshed(query.Questions[0])
+		log.Println(err)
+	}
+}
+
+// query tries the servers in order and caches the first usable response
+func (r *Resolver) query(ctx context.Context, query *dnsmessage.Message, servers []*server) (*dnsmessage.Message, error) {
+	q := query.Questions[0]
+	var lastErr error
+	for _, s := range servers {
+		resp, err := s.exchange(ctx, query)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.RCode != dnsmessage.RCodeSuccess && resp.RCode != dnsmessage.RCodeNameError {
+			lastErr = fmt.Errorf("dns server %s: %v", s.tag, resp.RCode)
+			continue
+		}
+		return r.cache.set(q, resp), nil
+	}
+	return nil, lastErr
+}
+
+// LookupHost returns the real IPv4 and IPv6 addresses of host, hosts are
+// consulted first and fakeip servers are never used
+func (r *Resolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if _, err := netip.ParseAddr(host); err == nil {
+		return []string{host}, nil
+	}
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		addrs []string
+		err   error
+	}
+	results := make(chan result, 2)
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		go func(qtype dnsmessage.Type) {
+			addrs, err := r.lookup(ctx, name, qtype)
+			results <- result{addrs, err}
+		}(qtype)
+	}
+
+	var addrs []string
+	var lookupErr error
+	for i := 0; i < 2; i++ {
+		res := <-results
+		addrs = append(addrs, res.addrs...)
+		if res.err != nil && lookupErr == nil {
+			lookupErr = res.err
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs, nil
+	}
+	if lookupErr == nil {
+		lookupErr = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return nil, lookupErr
+}
+
+func (r *Resolver) lookup(ctx context.Context, name dnsmessage.Name, qtype dnsmessage.Type) ([]string, error) {
+	query := &dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: uint16(rand.Uint32()), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	resp, err := r.exchange(ctx, query, false)
+	if err != nil {
+		return nil, err
+	}
+	host := strings.TrimSuffix(name.String(), ".")
+	if resp.RCode == dnsmessage.RCodeNameError {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	var addrs []string
+	for _, answer := range resp.Answers {
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			addrs = append(addrs, netip.AddrFrom4(body.A).String())
+		case *dnsmessage.AAAAResource:
+			addrs = append(addrs, netip.AddrFrom16(body.AAAA).String())
+		}
+	}
+	return addrs, nil
+}
+
+// Close releases the connections to the servers and persists the cache and
+// the fake-IP map
+func (r *Resolver) Close() error {
+	// 全部关闭，返回第一个错误
+	var firstErr error
+	for _, s := range r.servers {
+		if err := s.transport.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if err := r.cache.Close(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	if r.fakeIP != nil {
+		if err := r.fakeIP.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
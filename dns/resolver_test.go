@@ -0,0 +1,267 @@
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ido2021/light-proxy/adaptor/outbound"
+	"github.com/ido2021/light-proxy/common"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// testServer answers A and AAAA queries from records, unknown names get NXDOMAIN
+type testServer struct {
+	records map[string][]string
+	// rcode 不为0时所有查询都返回该错误
+	rcode   dnsmessage.RCode
+	queries int32
+}
+
+func (s *testServer) answer(b []byte) []byte {
+	atomic.AddInt32(&s.queries, 1)
+	var query dnsmessage.Message
+	if err := query.Unpack(b); err != nil {
+		return nil
+	}
+	resp := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: query.ID, Response: true, RecursionAvailable: true, RCode: s.rcode},
+		Questions: query.Questions,
+	}
+	q := query.Questions[0]
+	addrs, exist := s.records[q.Name.String()]
+	if !exist && s.rcode == 0 {
+		resp.RCode = dnsmessage.RCodeNameError
+	}
+	for _, saddr := range addrs {
+		addr := netip.MustParseAddr(saddr)
+		header := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 60}
+		if q.Type == dnsmessage.TypeA && addr.Is4() {
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AResource{A: addr.As4()}})
+		} else if q.Type == dnsmessage.TypeAAAA && addr.Is6() {
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AAAAResource{AAAA: addr.As16()}})
+		}
+	}
+	out, _ := resp.Pack()
+	return out
+}
+
+func (s *testServer) serveUDP(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, maxMessageSize)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(s.answer(buf[:n]), from)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func (s *testServer) serveTCP(t *testing.T, tlsConfig *tls.Config) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				header := make([]byte, 2)
+				for {
+					if _, err := io.ReadFull(conn, header); err != nil {
+						return
+					}
+					b := make([]byte, binary.BigEndian.Uint16(header))
+					if _, err := io.ReadFull(conn, b); err != nil {
+						return
+					}
+					out := s.answer(b)
+					conn.Write(append([]byte{byte(len(out) >> 8), byte(len(out))}, out...))
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func (s *testServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b, _ := io.ReadAll(r.Body)
+	w.Header().Set("Content-Type", "application/dns-message")
+	w.Write(s.answer(b))
+}
+
+func testOutAdaptors() map[string]*outbound.WrapperOutAdaptor {
+	return map[string]*outbound.WrapperOutAdaptor{
+		outbound.Direct: outbound.NewWrapperOutAdaptor(&outbound.DirectOutAdaptor{}),
+		outbound.Block:  outbound.NewWrapperOutAdaptor(&outbound.BlockOutAdaptor{}),
+	}
+}
+
+func lookup(t *testing.T, r *Resolver, host string) []string {
+	addrs, err := r.LookupHost(context.Background(), host)
+	if err != nil {
+		t.Fatalf("lookup %s: %v", host, err)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+func TestResolver_Transports(t *testing.T) {
+	s := &testServer{records: map[string][]string{"example.com.": {"192.0.2.1", "2001:db8::1"}}}
+
+	https := httptest.NewTLSServer(s)
+	defer https.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(https.Certificate())
+
+	servers := []common.DNSServer{
+		{Tag: "udp", Address: s.serveUDP(t)},
+		{Tag: "tcp", Address: "tcp://" + s.serveTCP(t, nil)},
+		{Tag: "tls", Address: "tls://" + s.serveTCP(t, https.TLS)},
+		{Tag: "https", Address: https.URL + "/dns-query"},
+	}
+	for _, serverConfig := range servers {
+		r, err := NewResolver(common.DNS{Servers: []common.DNSServer{serverConfig}}, "", testOutAdaptors())
+		if err != nil {
+			t.Fatalf("%s: %v", serverConfig.Tag, err)
+		}
+		switch transport := r.final.transport.(type) {
+		case *streamTransport:
+			if transport.tlsConfig != nil {
+				transport.tlsConfig.RootCAs = roots
+			}
+		case *httpsTransport:
+			transport.client.Transport.(*http.Transport).TLSClientConfig.RootCAs = roots
+		}
+
+		// 连接复用
+		for i := 0; i < 2; i++ {
+			r.cache = newCache(common.DNSCache{})
+			addrs := lookup(t, r, "example.com")
+			if len(addrs) != 2 || addrs[0] != "192.0.2.1" || addrs[1] != "2001:db8::1" {
+				t.Fatalf("%s: bad: %v", serverConfig.Tag, addrs)
+			}
+		}
+
+		_, err = r.LookupHost(context.Background(), "unknown.example.com")
+		if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+			t.Fatalf("%s: expect not found, got %v", serverConfig.Tag, err)
+		}
+		r.Close()
+	}
+}
+
+func TestResolver_RulesAndFallback(t *testing.T) {
+	cn := &testServer{records: map[string][]string{"www.example.cn.": {"192.0.2.2"}}}
+	global := &testServer{records: map[string][]string{"www.example.com.": {"192.0.2.3"}}}
+	broken := &testServer{rcode: dnsmessage.RCodeServerFailure}
+
+	r, err := NewResolver(common.DNS{
+		Servers: []common.DNSServer{
+			{Tag: "broken", Address: broken.serveUDP(t)},
+			{Tag: "cn", Address: cn.serveUDP(t)},
+			{Tag: "global", Address: "tcp://" + global.serveTCP(t, nil)},
+		},
+		Rules:    []common.DNSRule{{DomainSuffix: []string{"cn"}, Server: "cn"}},
+		Final:    "broken",
+		Fallback: []string{"global"},
+	}, "", testOutAdaptors())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer r.Close()
+
+	if addrs := lookup(t, r, "www.example.cn"); len(addrs) != 1 || addrs[0] != "192.0.2.2" {
+		t.Fatalf("bad: %v", addrs)
+	}
+	if atomic.LoadInt32(&global.queries) != 0 {
+		t.Fatal("fallback should not be used")
+	}
+
+	if addrs := lookup(t, r, "www.example.com"); len(addrs) != 1 || addrs[0] != "192.0.2.3" {
+		t.Fatalf("bad: %v", addrs)
+	}
+	if atomic.LoadInt32(&broken.queries) != 2 || atomic.LoadInt32(&global.queries) != 2 {
+		t.Fatalf("bad query count: %d %d", broken.queries, global.queries)
+	}
+
+	invalid := []common.DNS{
+		{Servers: []common.DNSServer{{Address: "8.8.8.8"}}},
+		{Servers: []common.DNSServer{{Tag: "a", Address: "tls://dns.google", Detour: "proxy"}}},
+		{Servers: []common.DNSServer{{Tag: "a", Address: "udp://dns.google"}}},
+		{Servers: []common.DNSServer{{Tag: "a", Address: "quic://dns.google"}}},
+		{Servers: []common.DNSServer{{Tag: "a", Address: "8.8.8.8"}}, Final: "b"},
+		{Servers: []common.DNSServer{{Tag: "a", Address: "8.8.8.8"}}, Rules: []common.DNSRule{{Domain: []string{"a.com"}, Server: "b"}}},
+		{Servers: []common.DNSServer{{Tag: "a", Address: "8.8.8.8"}}, Rules: []common.DNSRule{{Geosite: []string{"cn"}, Server: "a"}}},
+	}
+	for i, config := range invalid {
+		if _, err := NewResolver(config, "", testOutAdaptors()); err == nil {
+			t.Fatalf("case %d: expect error", i)
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	s := &testServer{records: map[string][]string{"example.com.": {"192.0.2.1"}}}
+	r, err := NewResolver(common.DNS{Servers: []common.DNSServer{{Tag: "udp", Address: s.serveUDP(t)}}}, "", testOutAdaptors())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer r.Close()
+	now := time.Now()
+	r.cache.now = func() time.Time { return now }
+
+	name := dnsmessage.MustNewName("example.com.")
+	query := &dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 1, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}
+	if _, err := r.Exchange(context.Background(), query); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	now = now.Add(45 * time.Second)
+	query.ID = 2
+	resp, err := r.Exchange(context.Background(), query)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if resp.ID != 2 || resp.Answers[0].Header.TTL != 15 || atomic.LoadInt32(&s.queries) != 1 {
+		t.Fatalf("bad: id %d ttl %d queries %d", resp.ID, resp.Answers[0].Header.TTL, s.queries)
+	}
+
+	// TTL过期后重新查询
+	now = now.Add(15 * time.Second)
+	if _, err := r.Exchange(context.Background(), query); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if atomic.LoadInt32(&s.queries) != 2 {
+		t.Fatalf("bad query count: %d", s.queries)
+	}
+}
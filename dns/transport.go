@@ -0,0 +1,376 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ido2021/light-proxy/adaptor/outbound"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// maxMessageSize is the maximum size of a DNS message
+	maxMessageSize = 65535
+	// maxIdleConns is the number of idle connections kept by a TCP or TLS server
+	maxIdleConns = 2
+	// localTTL is the TTL of the answers from a resolver which reports none
+	localTTL = 600
+)
+
+// addressLocal uses the resolver of the detour outbound
+const addressLocal = "local"
+
+var (
+	errUnexpectedStatus = errors.New("dns: unexpected http status")
+)
+
+// transport sends queries to one DNS server
+type transport interface {
+	Exchange(ctx context.Context, query *dnsmessage.Message) (*dnsmessage.Message, error)
+	Close() error
+}
+
+// newTransport parses the server address, the connections to the server are
+// made through outAdaptor
+func newTransport(address string, outAdaptor *outbound.WrapperOutAdaptor) (transport, error) {
+	if address == addressLocal {
+		return &localTransport{outAdaptor: outAdaptor}, nil
+	}
+	if !strings.Contains(address, "://") {
+		address = "udp://" + address
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "udp":
+		addr, err := netip.ParseAddrPort(hostPort(u.Host, "53"))
+		if err != nil {
+			return nil, fmt.Errorf("udp dns server must be an ip address: %s", address)
+		}
+		return &udpTransport{
+			addr:       addr,
+			outAdaptor: outAdaptor,
+			tcp:        newStreamTransport(addr.String(), outAdaptor, nil),
+		}, nil
+	case "tcp":
+		return newStreamTransport(hostPort(u.Host, "53"), outAdaptor, nil), nil
+	case "tls":
+		return newStreamTransport(hostPort(u.Host, "853"), outAdaptor, &tls.Config{ServerName: u.Hostname()}), nil
+	case "https":
+		return newHTTPSTransport(u.String(), outAdaptor), nil
+	default:
+		return nil, fmt.Errorf("unsupported dns server: %s", address)
+	}
+}
+
+// hostPort appends the default port if host has none
+func hostPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// setDeadline applies the deadline of ctx to conn
+func setDeadline(ctx context.Context, conn interface{ SetDeadline(time.Time) error }) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+}
+
+// udpTransport sends queries over UDP, truncated responses are retried over TCP
+type udpTransport struct {
+	addr       netip.AddrPort
+	outAdaptor *outbound.WrapperOutAdaptor
+	tcp        *streamTransport
+}
+
+func (t *udpTransport) Exchange(ctx context.Context, query *dnsmessage.Message) (*dnsmessage.Message, error) {
+	b, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	network := "udp4"
+	if t.addr.Addr().Is6() {
+		network = "udp6"
+	}
+	conn, err := t.outAdaptor.ListenPacket(ctx, network, "")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	setDeadline(ctx, conn)
+
+	if _, err := conn.WriteTo(b, net.UDPAddrFromAddrPort(t.addr)); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return nil, err
+		}
+		resp := &dnsmessage.Message{}
+		// 忽略无法解析或不匹配的响应
+		if err := resp.Unpack(buf[:n]); err != nil || !resp.Response || resp.ID != query.ID {
+			continue
+		}
+		if resp.Truncated {
+			return t.tcp.Exchange(ctx, query)
+		}
+		return resp, nil
+	}
+}
+
+func (t *udpTransport) Close() error {
+	return t.tcp.Close()
+}
+
+// streamTransport sends queries over TCP or TLS, each message is prefixed
+// with its length
+type streamTransport struct {
+	addr       string
+	outAdaptor *outbound.WrapperOutAdaptor
+	// tlsConfig 不为空时使用DNS over TLS
+	tlsConfig *tls.Config
+
+	mu   sync.Mutex
+	idle []net.Conn
+}
+
+func newStreamTransport(addr string, outAdaptor *outbound.WrapperOutAdaptor, tlsConfig *tls.Config) *streamTransport {
+	return &streamTransport{addr: addr, outAdaptor: outAdaptor, tlsConfig: tlsConfig}
+}
+
+func (t *streamTransport) Exchange(ctx context.Context, query *dnsmessage.Message) (*dnsmessage.Message, error) {
+	b, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	msg := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(msg, uint16(len(b)))
+	copy(msg[2:], b)
+
+	// 空闲连接可能已被服务器关闭，失败后使用新连接重试
+	if conn := t.getIdle(); conn != nil {
+		resp, err := t.roundTrip(ctx, conn, msg, query.ID)
+		if err == nil {
+			return resp, nil
+		}
+	}
+	conn, err := t.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return t.roundTrip(ctx, conn, msg, query.ID)
+}
+
+func (t *streamTransport) dial(ctx context.Context) (net.Conn, error) {
+	conn, err := t.outAdaptor.Dial(ctx, "tcp", t.addr)
+	if err != nil {
+		return nil, err
+	}
+	if t.tlsConfig == nil {
+		return conn, nil
+	}
+	tlsConn := tls.Client(conn, t.tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// roundTrip sends msg on conn and reads the response, conn is kept for reuse
+// on success and closed otherwise
+func (t *streamTransport) roundTrip(ctx context.Context, conn net.Conn, msg []byte, id uint16) (*dnsmessage.Message, error) {
+	setDeadline(ctx, conn)
+	resp, err := func() (*dnsmessage.Message, error) {
+		if _, err := conn.Write(msg); err != nil {
+			return nil, err
+		}
+		for {
+			header := make([]byte, 2)
+			if _, err := io.ReadFull(conn, header); err != nil {
+				return nil, err
+			}
+			b := make([]byte, binary.BigEndian.Uint16(header))
+			if _, err := io.ReadFull(conn, b); err != nil {
+				return nil, err
+			}
+			resp := &dnsmessage.Message{}
+			if err := resp.Unpack(b); err != nil {
+				return nil, err
+			}
+			if resp.ID == id {
+				return resp, nil
+			}
+		}
+	}()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	t.putIdle(conn)
+	return resp, nil
+}
+
+func (t *streamTransport) getIdle() net.Conn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.idle) == 0 {
+		return nil
+	}
+	conn := t.idle[len(t.idle)-1]
+	t.idle = t.idle[:len(t.idle)-1]
+	return conn
+}
+
+func (t *streamTransport) putIdle(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.idle) >= maxIdleConns {
+		conn.Close()
+		return
+	}
+	t.idle = append(t.idle, conn)
+}
+
+func (t *streamTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, conn := range t.idle {
+		conn.Close()
+	}
+	t.idle = nil
+	return nil
+}
+
+// httpsTransport sends queries with DNS over HTTPS, RFC 8484
+type httpsTransport struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPSTransport(url string, outAdaptor *outbound.WrapperOutAdaptor) *httpsTransport {
+	return &httpsTransport{
+		url: url,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext:         outAdaptor.Dial,
+				TLSClientConfig:     &tls.Config{},
+				ForceAttemptHTTP2:   true,
+				MaxIdleConns:        maxIdleConns,
+				IdleConnTimeout:     90 * time.Second,
+				TLSHandshakeTimeout: 10 * time.Second,
+			},
+		},
+	}
+}
+
+func (t *httpsTransport) Exchange(ctx context.Context, query *dnsmessage.Message) (*dnsmessage.Message, error) {
+	// ID为0便于HTTP缓存
+	q := *query
+	q.ID = 0
+	b, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/dns-message")
+	request.Header.Set("Accept", "application/dns-message")
+
+	response, err := t.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s", errUnexpectedStatus, response.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(response.Body, maxMessageSize))
+	if err != nil {
+		return nil, err
+	}
+	resp := &dnsmessage.Message{}
+	if err := resp.Unpack(body); err != nil {
+		return nil, err
+	}
+	resp.ID = query.ID
+	return resp, nil
+}
+
+func (t *httpsTransport) Close() error {
+	t.client.CloseIdleConnections()
+	return nil
+}
+
+// localTransport answers A and AAAA queries with the resolver of the outbound
+type localTransport struct {
+	outAdaptor *outbound.WrapperOutAdaptor
+}
+
+func (t *localTransport) Exchange(ctx context.Context, query *dnsmessage.Message) (*dnsmessage.Message, error) {
+	resp := &dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 query.ID,
+			Response:           true,
+			RecursionDesired:   query.RecursionDesired,
+			RecursionAvailable: true,
+		},
+		Questions: query.Questions,
+	}
+	q := query.Questions[0]
+	if q.Type != dnsmessage.TypeA && q.Type != dnsmessage.TypeAAAA {
+		resp.RCode = dnsmessage.RCodeNotImplemented
+		return resp, nil
+	}
+
+	// 使用接出代理自身的解析器，避免经过WrapperOutAdaptor再回到这里
+	addrs, err := t.outAdaptor.OutAdaptor.LookupHost(ctx, strings.TrimSuffix(q.Name.String(), "."))
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			resp.RCode = dnsmessage.RCodeNameError
+			return resp, nil
+		}
+		return nil, err
+	}
+	for _, saddr := range addrs {
+		addr, err := netip.ParseAddr(saddr)
+		if err != nil {
+			continue
+		}
+		addr = addr.Unmap()
+		header := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET, TTL: localTTL}
+		if q.Type == dnsmessage.TypeA && addr.Is4() {
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AResource{A: addr.As4()}})
+		} else if q.Type == dnsmessage.TypeAAAA && addr.Is6() {
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AAAAResource{AAAA: addr.As16()}})
+		}
+	}
+	return resp, nil
+}
+
+func (t *localTransport) Close() error {
+	return nil
+}
@@ -3,15 +3,16 @@ module github.com/ido2021/light-proxy
 go 1.18
 
 require (
-	github.com/rs/dnscache v0.0.0-20230804202142-fc85eb664529
+	github.com/oschwald/maxminddb-golang v1.10.0
+	golang.org/x/crypto v0.6.0
+	golang.org/x/net v0.7.0
 	golang.zx2c4.com/wireguard v0.0.0-20230704135630-469159ecf7d1
+	lukechampine.com/blake3 v1.1.7
 )
 
 require (
 	github.com/google/btree v1.0.1 // indirect
-	golang.org/x/crypto v0.6.0 // indirect
-	golang.org/x/net v0.7.0 // indirect
-	golang.org/x/sync v0.1.0 // indirect
+	github.com/klauspost/cpuid/v2 v2.0.12 // indirect
 	golang.org/x/sys v0.5.1-0.20230222185716-a3b23cc77e89 // indirect
 	golang.org/x/time v0.0.0-20191024005414-555d28b269f0 // indirect
 	golang.zx2c4.com/wintun v0.0.0-20230126152724-0fa3db229ce2 // indirect
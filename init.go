@@ -1,6 +1,13 @@
 package light_proxy
 
 import (
+	_ "github.com/ido2021/light-proxy/adaptor/inbound/dns"
 	_ "github.com/ido2021/light-proxy/adaptor/inbound/mixed"
+	_ "github.com/ido2021/light-proxy/adaptor/inbound/shadowsocks"
+	_ "github.com/ido2021/light-proxy/adaptor/inbound/trojan"
+	_ "github.com/ido2021/light-proxy/adaptor/outbound/http"
+	_ "github.com/ido2021/light-proxy/adaptor/outbound/shadowsocks"
+	_ "github.com/ido2021/light-proxy/adaptor/outbound/socks5"
+	_ "github.com/ido2021/light-proxy/adaptor/outbound/trojan"
 	_ "github.com/ido2021/light-proxy/adaptor/outbound/wireguard"
 )
@@ -0,0 +1,143 @@
+package route
+
+import (
+	"regexp"
+	"strings"
+)
+
+// domainNode is a node of DomainTrie, children are keyed by label
+type domainNode struct {
+	children map[string]*domainNode
+	// full matches the domain itself
+	full bool
+	// suffix matches the domain and all of its subdomains
+	suffix bool
+	// subdomain matches only the subdomains
+	subdomain bool
+}
+
+// DomainTrie stores domains by reversed labels so that a lookup only costs
+// O(labels), e.g. www.example.com is stored as com -> example -> www
+type DomainTrie struct {
+	root domainNode
+	size int
+}
+
+func NewDomainTrie() *DomainTrie {
+	return &DomainTrie{}
+}
+
+// AddFull adds a domain which only matches itself
+func (t *DomainTrie) AddFull(domain string) {
+	t.insert(normalizeDomain(domain)).full = true
+}
+
+// AddSuffix adds a domain suffix on label boundaries: example.com matches
+// example.com and its subdomains, .example.com matches only the subdomains
+func (t *DomainTrie) AddSuffix(suffix string) {
+	if strings.HasPrefix(suffix, ".") {
+		t.insert(normalizeDomain(suffix[1:])).subdomain = true
+		return
+	}
+	t.insert(normalizeDomain(suffix)).suffix = true
+}
+
+func (t *DomainTrie) insert(domain string) *domainNode {
+	t.size++
+	node := &t.root
+	labels := strings.Split(domain, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		if node.children == nil {
+			node.children = map[string]*domainNode{}
+		}
+		child, exist := node.children[labels[i]]
+		if !exist {
+			child = &domainNode{}
+			node.children[labels[i]] = child
+		}
+		node = child
+	}
+	return node
+}
+
+func (t *DomainTrie) Match(domain string) bool {
+	if t.size == 0 || domain == "" {
+		return false
+	}
+	domain = normalizeDomain(domain)
+	node := &t.root
+	end := len(domain)
+	for end > 0 {
+		start := strings.LastIndexByte(domain[:end], '.') + 1
+		node = node.children[domain[start:end]]
+		if node == nil {
+			return false
+		}
+		if start == 0 {
+			return node.full || node.suffix
+		}
+		if node.suffix || node.subdomain {
+			return true
+		}
+		end = start - 1
+	}
+	return false
+}
+
+func (t *DomainTrie) Size() int {
+	return t.size
+}
+
+// normalizeDomain lower-cases the domain and trims the trailing dot
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(domain), ".")
+}
+
+// domainMatcher matches the destination FQDN
+type domainMatcher struct {
+	trie     *DomainTrie
+	keywords []string
+	regexes  []*regexp.Regexp
+}
+
+func newDomainMatcher() *domainMatcher {
+	return &domainMatcher{trie: NewDomainTrie()}
+}
+
+func (m *domainMatcher) AddKeyword(keyword string) {
+	m.keywords = append(m.keywords, strings.ToLower(keyword))
+}
+
+func (m *domainMatcher) AddRegex(expr string) error {
+	regex, err := regexp.Compile(expr)
+	if err != nil {
+		return err
+	}
+	m.regexes = append(m.regexes, regex)
+	return nil
+}
+
+func (m *domainMatcher) Empty() bool {
+	return m.trie.Size() == 0 && len(m.keywords) == 0 && len(m.regexes) == 0
+}
+
+func (m *domainMatcher) MatchDomain(domain string) bool {
+	if domain == "" {
+		return false
+	}
+	if m.trie.Match(domain) {
+		return true
+	}
+	lower := normalizeDomain(domain)
+	for _, keyword := range m.keywords {
+		if strings.Contains(lower, keyword) {
+			return true
+		}
+	}
+	for _, regex := range m.regexes {
+		if regex.MatchString(lower) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package route
+
+import (
+	"testing"
+)
+
+func TestDomainTrie(t *testing.T) {
+	trie := NewDomainTrie()
+	trie.AddFull("full.example.org")
+	trie.AddSuffix("example.com")
+	trie.AddSuffix(".sub.example.net")
+	trie.AddSuffix("CN")
+
+	cases := map[string]bool{
+		"full.example.org":     true,
+		"www.full.example.org": false,
+		"example.org":          false,
+		"example.com":          true,
+		"www.example.com":      true,
+		"WWW.Example.COM.":     true,
+		"ample.com":            false,
+		"anexample.com":        false,
+		"sub.example.net":      false,
+		"a.sub.example.net":    true,
+		"example.net":          false,
+		"baidu.cn":             true,
+		"cn":                   true,
+		"cnn.com":              false,
+		"":                     false,
+	}
+	for domain, expected := range cases {
+		if trie.Match(domain) != expected {
+			t.Fatalf("%s: expect %v", domain, expected)
+		}
+	}
+}
+
+func TestDomainMatcher(t *testing.T) {
+	m := newDomainMatcher()
+	m.AddKeyword("google")
+	if err := m.AddRegex(`^ad[0-9]+\.`); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := m.AddRegex(`(`); err == nil {
+		t.Fatalf("expect error")
+	}
+
+	cases := map[string]bool{
+		"www.google.com": true,
+		"googleapis.cn":  true,
+		"ad12.site.com":  true,
+		"bad12.site.com": false,
+		"example.com":    false,
+	}
+	for domain, expected := range cases {
+		if m.MatchDomain(domain) != expected {
+			t.Fatalf("%s: expect %v", domain, expected)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package route
+
+import (
+	"errors"
+	"github.com/ido2021/light-proxy/common"
+	"github.com/oschwald/maxminddb-golang"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// privateGeoIP is the special country code matching non-public addresses
+const privateGeoIP = "private"
+
+var privateCidrs = []string{
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15",
+	"224.0.0.0/4", "240.0.0.0/4",
+	"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+}
+
+var (
+	geoIPNotConfigured = errors.New("geoip database is not configured")
+	geoIPClosed        = errors.New("geoip database is closed")
+)
+
+type geoIPRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+// GeoIP looks up country codes in a MaxMind mmdb database. The database is
+// opened on first use and opened again when the file is replaced
+type GeoIP struct {
+	path string
+
+	mu      sync.RWMutex
+	reader  *maxminddb.Reader
+	modTime time.Time
+}
+
+func NewGeoIP(path string) *GeoIP {
+	return &GeoIP{path: path}
+}
+
+// Country returns the lower-cased ISO country code of ip
+func (g *GeoIP) Country(ip net.IP) (string, error) {
+	if err := g.open(); err != nil {
+		return "", err
+	}
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	// open之后可能被Close
+	if g.reader == nil {
+		return "", geoIPClosed
+	}
+	var record geoIPRecord
+	if err := g.reader.Lookup(ip, &record); err != nil {
+		return "", err
+	}
+	code := record.Country.ISOCode
+	if code == "" {
+		code = record.RegisteredCountry.ISOCode
+	}
+	return strings.ToLower(code), nil
+}
+
+// open loads the database if it is not loaded yet
+func (g *GeoIP) open() error {
+	g.mu.RLock()
+	loaded := g.reader != nil
+	g.mu.RUnlock()
+	if loaded {
+		return nil
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.reader != nil {
+		return nil
+	}
+	return g.load()
+}
+
+// load opens the database file, must be called with mu held
+func (g *GeoIP) load() error {
+	info, err := os.Stat(g.path)
+	if err != nil {
+		return err
+	}
+	reader, err := maxminddb.Open(g.path)
+	if err != nil {
+		return err
+	}
+	if g.reader != nil {
+		_ = g.reader.Close()
+	}
+	g.reader = reader
+	g.modTime = info.ModTime()
+	return nil
+}
+
+// reload opens the database again if it was loaded and the file changed
+func (g *GeoIP) reload() (bool, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.reader == nil {
+		return false, nil
+	}
+	info, err := os.Stat(g.path)
+	if err != nil {
+		return false, err
+	}
+	if info.ModTime().Equal(g.modTime) {
+		return false, nil
+	}
+	return true, g.load()
+}
+
+func (g *GeoIP) Close() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.reader == nil {
+		return nil
+	}
+	err := g.reader.Close()
+	g.reader = nil
+	return err
+}
+
+// geoIPMatcher matches the destination IP against country codes
+type geoIPMatcher struct {
+	geoIP     *GeoIP
+	countries map[string]struct{}
+	private   *IPCidrSet
+}
+
+func newGeoIPMatcher(geoIP *GeoIP, codes []string) (*geoIPMatcher, error) {
+	m := &geoIPMatcher{geoIP: geoIP, countries: map[string]struct{}{}}
+	for _, code := range codes {
+		code = strings.ToLower(code)
+		if code != privateGeoIP {
+			m.countries[code] = struct{}{}
+			continue
+		}
+		m.private = NewIPCidrSet()
+		for _, cidr := range privateCidrs {
+			_ = m.private.Add(cidr)
+		}
+	}
+	if len(m.countries) > 0 && geoIP == nil {
+		return nil, geoIPNotConfigured
+	}
+	return m, nil
+}
+
+func (m *geoIPMatcher) Match(metadata *common.Metadata) bool {
+	if metadata.DestAddr == nil || len(metadata.DestAddr.IP) == 0 {
+		return false
+	}
+	ip := metadata.DestAddr.IP
+	if m.private != nil && m.private.Contains(ip) {
+		return true
+	}
+	if len(m.countries) == 0 {
+		return false
+	}
+	country, err := m.geoIP.Country(ip)
+	if err != nil {
+		return false
+	}
+	_, exist := m.countries[country]
+	return exist
+}
@@ -0,0 +1,275 @@
+package route
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Domain types of the v2ray geosite format
+const (
+	geositePlain  = 0
+	geositeRegex  = 1
+	geositeDomain = 2
+	geositeFull   = 3
+)
+
+var (
+	invalidGeosite = errors.New("invalid geosite data")
+)
+
+type geositeEntry struct {
+	kind  uint64
+	value string
+	attrs []string
+}
+
+// Geosite holds domain categories loaded from a v2ray geosite.dat or from a
+// directory of v2ray domain lists, where each file is a category
+type Geosite struct {
+	categories map[string][]geositeEntry
+}
+
+func LoadGeosite(path string) (*Geosite, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return loadGeositeDir(path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseGeosite(data)
+}
+
+// RuleSet returns the domains of a category such as google or google@cn,
+// each @attr keeps only the domains with that attribute
+func (g *Geosite) RuleSet(code string) (*RuleSet, error) {
+	parts := strings.Split(strings.ToLower(code), "@")
+	domains, exist := g.categories[parts[0]]
+	if !exist {
+		return nil, fmt.Errorf("geosite category not found: %s", parts[0])
+	}
+	attrs := parts[1:]
+
+	set := &RuleSet{}
+	for _, domain := range domains {
+		if !hasAttrs(domain.attrs, attrs) {
+			continue
+		}
+		switch domain.kind {
+		case geositePlain:
+			set.Keyword = append(set.Keyword, domain.value)
+		case geositeRegex:
+			set.Regexp = append(set.Regexp, domain.value)
+		case geositeDomain:
+			set.Suffix = append(set.Suffix, domain.value)
+		case geositeFull:
+			set.Full = append(set.Full, domain.value)
+		}
+	}
+	return set, nil
+}
+
+// Merge returns the domains of all the categories
+func (g *Geosite) Merge(codes []string) (*RuleSet, error) {
+	merged := &RuleSet{}
+	for _, code := range codes {
+		set, err := g.RuleSet(code)
+		if err != nil {
+			return nil, err
+		}
+		merged.Full = append(merged.Full, set.Full...)
+		merged.Suffix = append(merged.Suffix, set.Suffix...)
+		merged.Keyword = append(merged.Keyword, set.Keyword...)
+		merged.Regexp = append(merged.Regexp, set.Regexp...)
+	}
+	return merged, nil
+}
+
+func hasAttrs(attrs []string, required []string) bool {
+	for _, r := range required {
+		found := false
+		for _, attr := range attrs {
+			if attr == r {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// parseGeosite decodes the protobuf encoded GeoSiteList:
+// GeoSiteList{entry=1}, GeoSite{country_code=1, domain=2},
+// Domain{type=1, value=2, attribute=3}, Attribute{key=1}
+func parseGeosite(data []byte) (*Geosite, error) {
+	g := &Geosite{categories: map[string][]geositeEntry{}}
+	err := walkProto(data, func(field int, value []byte, _ uint64) error {
+		if field != 1 {
+			return nil
+		}
+		var code string
+		var domains []geositeEntry
+		err := walkProto(value, func(field int, value []byte, _ uint64) error {
+			switch field {
+			case 1:
+				code = strings.ToLower(string(value))
+			case 2:
+				domain, err := parseGeositeDomain(value)
+				if err != nil {
+					return err
+				}
+				domains = append(domains, domain)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		g.categories[code] = append(g.categories[code], domains...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func parseGeositeDomain(data []byte) (geositeEntry, error) {
+	var domain geositeEntry
+	err := walkProto(data, func(field int, value []byte, varint uint64) error {
+		switch field {
+		case 1:
+			domain.kind = varint
+		case 2:
+			domain.value = string(value)
+		case 3:
+			return walkProto(value, func(field int, value []byte, _ uint64) error {
+				if field == 1 {
+					domain.attrs = append(domain.attrs, strings.ToLower(string(value)))
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	return domain, err
+}
+
+// walkProto calls fn with every field of a protobuf message, value is set for
+// length-delimited fields and varint for varint fields
+func walkProto(data []byte, fn func(field int, value []byte, varint uint64) error) error {
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return invalidGeosite
+		}
+		data = data[n:]
+
+		var value []byte
+		var varint uint64
+		switch tag & 7 {
+		case 0:
+			varint, n = binary.Uvarint(data)
+			if n <= 0 {
+				return invalidGeosite
+			}
+			data = data[n:]
+		case 1:
+			if len(data) < 8 {
+				return invalidGeosite
+			}
+			data = data[8:]
+		case 2:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || size > uint64(len(data)-n) {
+				return invalidGeosite
+			}
+			value = data[n : n+int(size)]
+			data = data[n+int(size):]
+		case 5:
+			if len(data) < 4 {
+				return invalidGeosite
+			}
+			data = data[4:]
+		default:
+			return invalidGeosite
+		}
+
+		if err := fn(int(tag>>3), value, varint); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadGeositeDir loads a directory of v2ray domain lists with attributes
+func loadGeositeDir(dir string) (*Geosite, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	g := &Geosite{categories: map[string][]geositeEntry{}}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		var domains []geositeEntry
+		path := filepath.Join(dir, entry.Name())
+		if err := parseGeositeList(path, &domains, map[string]struct{}{}); err != nil {
+			return nil, err
+		}
+		g.categories[strings.ToLower(entry.Name())] = domains
+	}
+	return g, nil
+}
+
+func parseGeositeList(path string, domains *[]geositeEntry, included map[string]struct{}) error {
+	if _, exist := included[path]; exist {
+		return nil
+	}
+	included[path] = struct{}{}
+
+	return readLines(path, func(line string) error {
+		fields := strings.Fields(line)
+		domain := geositeEntry{kind: geositeDomain}
+		for _, field := range fields[1:] {
+			if strings.HasPrefix(field, "@") {
+				domain.attrs = append(domain.attrs, strings.ToLower(field[1:]))
+			}
+		}
+
+		kind, value, found := strings.Cut(fields[0], ":")
+		if !found {
+			domain.value = fields[0]
+			*domains = append(*domains, domain)
+			return nil
+		}
+		domain.value = value
+		switch kind {
+		case "domain":
+		case "full":
+			domain.kind = geositeFull
+		case "keyword":
+			domain.kind = geositePlain
+		case "regexp":
+			domain.kind = geositeRegex
+		case "include":
+			return parseGeositeList(filepath.Join(filepath.Dir(path), value), domains, included)
+		default:
+			return fmt.Errorf("unknown domain type %s in %s", kind, path)
+		}
+		*domains = append(*domains, domain)
+		return nil
+	})
+}
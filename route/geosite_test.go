@@ -0,0 +1,114 @@
+package route
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ido2021/light-proxy/adaptor/outbound"
+	"github.com/ido2021/light-proxy/common"
+)
+
+func appendUvarint(b []byte, v uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return append(b, buf[:binary.PutUvarint(buf, v)]...)
+}
+
+func appendProtoBytes(b []byte, field int, value []byte) []byte {
+	b = appendUvarint(b, uint64(field<<3|2))
+	b = appendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+func appendProtoVarint(b []byte, field int, value uint64) []byte {
+	b = appendUvarint(b, uint64(field<<3))
+	return appendUvarint(b, value)
+}
+
+func geositeDomainProto(kind uint64, value string, attrs ...string) []byte {
+	b := appendProtoVarint(nil, 1, kind)
+	b = appendProtoBytes(b, 2, []byte(value))
+	for _, attr := range attrs {
+		b = appendProtoBytes(b, 3, appendProtoVarint(appendProtoBytes(nil, 1, []byte(attr)), 2, 1))
+	}
+	return b
+}
+
+func TestParseGeosite(t *testing.T) {
+	site := appendProtoBytes(nil, 1, []byte("GOOGLE"))
+	site = appendProtoBytes(site, 2, geositeDomainProto(geositeDomain, "google.com"))
+	site = appendProtoBytes(site, 2, geositeDomainProto(geositeDomain, "google.cn", "cn"))
+	site = appendProtoBytes(site, 2, geositeDomainProto(geositeFull, "www.gstatic.com"))
+	site = appendProtoBytes(site, 2, geositeDomainProto(geositePlain, "googleapis"))
+	site = appendProtoBytes(site, 2, geositeDomainProto(geositeRegex, `^ggpht\.com$`))
+	data := appendProtoBytes(nil, 1, site)
+
+	g, err := parseGeosite(data)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	set, err := g.RuleSet("google")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := &RuleSet{
+		Full:    []string{"www.gstatic.com"},
+		Suffix:  []string{"google.com", "google.cn"},
+		Keyword: []string{"googleapis"},
+		Regexp:  []string{`^ggpht\.com$`},
+	}
+	if !reflect.DeepEqual(set, expected) {
+		t.Fatalf("bad: %+v", set)
+	}
+
+	set, err = g.RuleSet("google@cn")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(set, &RuleSet{Suffix: []string{"google.cn"}}) {
+		t.Fatalf("bad: %+v", set)
+	}
+
+	if _, err := g.RuleSet("unknown"); err == nil {
+		t.Fatalf("expect error")
+	}
+	if _, err := parseGeosite(data[:len(data)-2]); err != invalidGeosite {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestRouter_GeositeDir(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "category-ads-all"), []byte("include:ads\nfull:ads.example.com\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "ads"), []byte("doubleclick.net\nadservice.google.cn @cn\n"), 0644)
+
+	outAdaptors := map[string]*outbound.WrapperOutAdaptor{
+		outbound.Direct: outbound.NewWrapperOutAdaptor(&outbound.DirectOutAdaptor{}),
+		outbound.Block:  outbound.NewWrapperOutAdaptor(&outbound.BlockOutAdaptor{}),
+	}
+	router, err := NewRouter(common.Route{
+		GeositePath: dir,
+		Rules: []common.Rule{
+			{Geosite: []string{"ads@cn"}, Outbound: outbound.Direct},
+			{Geosite: []string{"category-ads-all"}, Outbound: outbound.Block},
+		},
+	}, outAdaptors)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	cases := map[string]string{
+		"adservice.google.cn": outbound.Direct,
+		"ad.doubleclick.net":  outbound.Block,
+		"ads.example.com":     outbound.Block,
+		"example.com":         outbound.Direct,
+	}
+	for domain, expected := range cases {
+		metadata := &common.Metadata{DestAddr: &common.AddrSpec{FQDN: domain, Port: 443}}
+		if router.Route(metadata) != outAdaptors[expected] {
+			t.Fatalf("%s: expect %s", domain, expected)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package route
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// trieNode is a node of a binary prefix trie, each level consumes one bit
+type trieNode struct {
+	children [2]*trieNode
+	// end marks the last bit of an inserted prefix
+	end bool
+}
+
+// ipTrie stores CIDR prefixes of a single address family
+type ipTrie struct {
+	root trieNode
+}
+
+func (t *ipTrie) Insert(prefix netip.Prefix) {
+	addr := prefix.Addr().AsSlice()
+	node := &t.root
+	for i := 0; i < prefix.Bits(); i++ {
+		if node.end {
+			// 已被更短的前缀覆盖
+			return
+		}
+		bit := addr[i/8] >> (7 - i%8) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = &trieNode{}
+		}
+		node = node.children[bit]
+	}
+	node.end = true
+	node.children = [2]*trieNode{}
+}
+
+func (t *ipTrie) Contains(addr netip.Addr) bool {
+	bytes := addr.AsSlice()
+	node := &t.root
+	for i := 0; i < len(bytes)*8; i++ {
+		if node.end {
+			return true
+		}
+		node = node.children[bytes[i/8]>>(7-i%8)&1]
+		if node == nil {
+			return false
+		}
+	}
+	return node.end
+}
+
+// IPCidrSet matches addresses against a set of CIDR prefixes
+type IPCidrSet struct {
+	v4 ipTrie
+	v6 ipTrie
+}
+
+func NewIPCidrSet() *IPCidrSet {
+	return &IPCidrSet{}
+}
+
+// Add inserts a CIDR prefix, a single address is inserted as a host prefix
+func (s *IPCidrSet) Add(cidr string) error {
+	var prefix netip.Prefix
+	if strings.Contains(cidr, "/") {
+		p, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return err
+		}
+		prefix = p
+	} else {
+		addr, err := netip.ParseAddr(cidr)
+		if err != nil {
+			return err
+		}
+		prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+
+	prefix = prefix.Masked()
+	// Contains按IPv4匹配映射地址，映射前缀转换为IPv4前缀，掩码后不足/96的前缀不再是映射地址
+	if prefix.Addr().Is4In6() {
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+	if prefix.Addr().Is4() {
+		s.v4.Insert(prefix)
+	} else {
+		s.v6.Insert(prefix)
+	}
+	return nil
+}
+
+func (s *IPCidrSet) Contains(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	if addr.Is4() {
+		return s.v4.Contains(addr)
+	}
+	return s.v6.Contains(addr)
+}
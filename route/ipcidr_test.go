@@ -0,0 +1,62 @@
+package route
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIPCidrSet(t *testing.T) {
+	set := NewIPCidrSet()
+	for _, cidr := range []string{"10.0.0.0/8", "192.168.1.1", "fd00::/8", "172.16.0.0/12", "172.16.1.0/24", "::ffff:100.64.0.0/106", "::ffff:1.1.1.1"} {
+		if err := set.Add(cidr); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	cases := map[string]bool{
+		"10.1.2.3":        true,
+		"11.0.0.1":        false,
+		"192.168.1.1":     true,
+		"192.168.1.2":     false,
+		"172.31.0.1":      true,
+		"172.16.1.9":      true,
+		"172.32.0.1":      false,
+		"fd12::1":         true,
+		"fe80::1":         false,
+		"::ffff:10.0.0.1": true,
+		"100.100.0.1":     true,
+		"100.128.0.1":     false,
+		"1.1.1.1":         true,
+		"::ffff:1.1.1.1":  true,
+	}
+	for ip, expected := range cases {
+		if set.Contains(net.ParseIP(ip)) != expected {
+			t.Fatalf("%s: expect %v", ip, expected)
+		}
+	}
+
+	if err := set.Add("10.0.0.0/33"); err == nil {
+		t.Fatalf("expect error")
+	}
+}
+
+func TestPortSet(t *testing.T) {
+	set := NewPortSet()
+	set.Add(443)
+	if err := set.AddRange("8000-8080"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	cases := map[int]bool{443: true, 80: false, 8000: true, 8080: true, 8081: false}
+	for port, expected := range cases {
+		if set.Contains(port) != expected {
+			t.Fatalf("%d: expect %v", port, expected)
+		}
+	}
+
+	for _, r := range []string{"8080", "2000-1000", "1-70000"} {
+		if err := set.AddRange(r); err == nil {
+			t.Fatalf("%s: expect error", r)
+		}
+	}
+}
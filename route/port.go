@@ -0,0 +1,63 @@
+package route
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type portRange struct {
+	start uint16
+	end   uint16
+}
+
+// PortSet matches ports against single ports and port ranges
+type PortSet struct {
+	ports  map[uint16]struct{}
+	ranges []portRange
+}
+
+func NewPortSet() *PortSet {
+	return &PortSet{ports: map[uint16]struct{}{}}
+}
+
+func (s *PortSet) Add(port uint16) {
+	s.ports[port] = struct{}{}
+}
+
+// AddRange inserts a port range in the form of start-end
+func (s *PortSet) AddRange(r string) error {
+	start, end, found := strings.Cut(r, "-")
+	if !found {
+		return fmt.Errorf("invalid port range: %s", r)
+	}
+	startPort, err := strconv.ParseUint(strings.TrimSpace(start), 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port range: %s", r)
+	}
+	endPort, err := strconv.ParseUint(strings.TrimSpace(end), 10, 16)
+	if err != nil || endPort < startPort {
+		return fmt.Errorf("invalid port range: %s", r)
+	}
+	s.ranges = append(s.ranges, portRange{start: uint16(startPort), end: uint16(endPort)})
+	return nil
+}
+
+func (s *PortSet) Contains(port int) bool {
+	if port < 0 || port > 0xffff {
+		return false
+	}
+	if _, exist := s.ports[uint16(port)]; exist {
+		return true
+	}
+	for _, r := range s.ranges {
+		if uint16(port) >= r.start && uint16(port) <= r.end {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *PortSet) Empty() bool {
+	return len(s.ports) == 0 && len(s.ranges) == 0
+}
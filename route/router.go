@@ -1,79 +1,218 @@
 package route
 
 import (
+	"context"
 	"errors"
 	"github.com/ido2021/light-proxy/adaptor/outbound"
 	"github.com/ido2021/light-proxy/common"
-	"strings"
+	"log"
+	"net"
+	"time"
 )
 
-type Rule struct {
-	domains        map[string]struct{}
-	domainSuffixes []string
-	domainPath     string
-	outAdaptor     *outbound.WrapperOutAdaptor
+// resolveTimeout bounds resolving a destination for rules that need an IP
+const resolveTimeout = 5 * time.Second
+
+// Resolver resolves a destination for rules that need an IP
+type Resolver interface {
+	Resolve(ctx context.Context, host string) (net.IP, error)
 }
 
-func (r *Rule) Match(metadata *common.Metadata) bool {
-	dn := metadata.DestAddr.FQDN
-	_, exist := r.domains[dn]
-	if exist {
-		return true
-	}
-	for _, suffix := range r.domainSuffixes {
-		if strings.HasSuffix(dn, suffix) {
-			return true
-		}
-	}
-	return false
+// FakeIPStore maps the fake addresses handed out by the DNS back to domains
+type FakeIPStore interface {
+	Contains(ip net.IP) bool
+	LookupDomain(ip net.IP) (string, bool)
 }
 
 type Router struct {
 	rules []*Rule
 	final *outbound.WrapperOutAdaptor
+	// block 拒绝无法还原域名的假地址
+	block    *outbound.WrapperOutAdaptor
+	ruleSets []*ruleSetMatcher
+	geoIP    *GeoIP
+	resolver Resolver
+	fakeIP   FakeIPStore
+	closed   chan struct{}
 }
 
 func NewRouter(route common.Route, outAdaptors map[string]*outbound.WrapperOutAdaptor) (*Router, error) {
+	ctx := &ruleContext{outAdaptors: outAdaptors, geositePath: route.GeositePath}
+	if route.GeoIPPath != "" {
+		ctx.geoIP = NewGeoIP(route.GeoIPPath)
+	}
+
 	var rules []*Rule
 	for _, ruleConfig := range route.Rules {
-		outAdaptor, exist := outAdaptors[ruleConfig.Outbound]
-		if exist {
-			return nil, errors.New("未配置接出代理：" + ruleConfig.Outbound)
-		}
-
-		domains := map[string]struct{}{}
-		for _, domain := range ruleConfig.Domain {
-			domains[domain] = struct{}{}
-		}
-
-		rule := &Rule{
-			domains:        domains,
-			domainSuffixes: ruleConfig.DomainSuffix,
-			outAdaptor:     outAdaptor,
+		rule, err := newRule(ctx, ruleConfig)
+		if err != nil {
+			return nil, err
 		}
 		rules = append(rules, rule)
 	}
 
+	// 未配置final时默认使用proxy，没有proxy则直连
 	final := route.Final
 	if final == "" {
 		final = outbound.Proxy
+		if _, exist := outAdaptors[final]; !exist {
+			final = outbound.Direct
+		}
 	}
 	outAdaptor, exist := outAdaptors[final]
 	if !exist {
-		return nil, errors.New("未配置接出代理：" + route.Final)
+		return nil, errors.New("未配置接出代理：" + final)
+	}
+
+	router := &Router{
+		rules:    rules,
+		final:    outAdaptor,
+		block:    outAdaptors[outbound.Block],
+		ruleSets: ctx.ruleSets,
+		geoIP:    ctx.geoIP,
+		closed:   make(chan struct{}),
+	}
+	if router.block == nil {
+		router.block = outbound.NewWrapperOutAdaptor(&outbound.BlockOutAdaptor{})
 	}
+	// 规则需要IP时使用直连解析域名
+	if direct, exist := outAdaptors[outbound.Direct]; exist {
+		router.resolver = direct
+	}
+	if len(router.ruleSets) > 0 || router.geoIP != nil {
+		go router.watchRuleSets()
+	}
+	return router, nil
+}
+
+// watchRuleSets periodically reloads the rule-set files changed on disk
+func (r *Router) watchRuleSets() {
+	t := time.NewTicker(ruleSetCheckInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			r.reloadRuleSets()
+		case <-r.closed:
+			return
+		}
+	}
+}
+
+func (r *Router) reloadRuleSets() {
+	for _, ruleSet := range r.ruleSets {
+		reloaded, err := ruleSet.reload()
+		if err != nil {
+			// 加载失败时继续使用旧的规则
+			log.Println(err)
+			continue
+		}
+		if reloaded {
+			log.Println("规则集已重新加载：", ruleSet.path)
+		}
+	}
+	if r.geoIP != nil {
+		reloaded, err := r.geoIP.reload()
+		if err != nil {
+			log.Println(err)
+		} else if reloaded {
+			log.Println("GeoIP数据库已重新加载：", r.geoIP.path)
+		}
+	}
+}
 
-	return &Router{
-		rules: rules,
-		final: outAdaptor,
-	}, nil
+// SetFakeIP restores the domains of the connections to fake addresses
+func (r *Router) SetFakeIP(fakeIP FakeIPStore) {
+	r.fakeIP = fakeIP
 }
 
 func (r *Router) Route(metadata *common.Metadata) *outbound.WrapperOutAdaptor {
+	if !r.restoreFakeIP(metadata) {
+		return r.block
+	}
+	var resolved *common.Metadata
+	for _, rule := range r.rules {
+		m := metadata
+		if rule.needIP && needResolve(metadata) {
+			if resolved == nil {
+				resolved = r.resolve(metadata)
+			}
+			m = resolved
+		}
+		if rule.Match(m) {
+			return rule.outAdaptor
+		}
+	}
+	return r.final
+}
+
+// RouteDomain routes a destination given as domain by the rules which do not
+// need an IP, the domain is never resolved. The DNS inbound uses it to decide
+// whether a query is blocked
+func (r *Router) RouteDomain(metadata *common.Metadata) *outbound.WrapperOutAdaptor {
 	for _, rule := range r.rules {
+		if rule.needIP {
+			continue
+		}
 		if rule.Match(metadata) {
 			return rule.outAdaptor
 		}
 	}
 	return r.final
 }
+
+// restoreFakeIP replaces a fake destination IP with the domain it stands for,
+// the outbound then resolves the real address. It returns false for a fake
+// address whose domain is unknown, e.g. evicted from the pool
+func (r *Router) restoreFakeIP(metadata *common.Metadata) bool {
+	if r.fakeIP == nil || metadata.DestAddr == nil || len(metadata.DestAddr.IP) == 0 {
+		return true
+	}
+	dest := metadata.DestAddr
+	if !r.fakeIP.Contains(dest.IP) {
+		return true
+	}
+	if domain, ok := r.fakeIP.LookupDomain(dest.IP); ok && dest.FQDN == "" {
+		dest.FQDN = domain
+	}
+	if dest.FQDN == "" {
+		log.Println("未知的fakeip地址：", dest.IP)
+		return false
+	}
+	metadata.FakeAddr = &common.AddrSpec{IP: dest.IP, Port: dest.Port}
+	dest.IP = nil
+	return true
+}
+
+func needResolve(metadata *common.Metadata) bool {
+	return metadata.DestAddr != nil && len(metadata.DestAddr.IP) == 0 && metadata.DestAddr.FQDN != ""
+}
+
+// resolve returns a copy of metadata with the destination IP filled in, the
+// original is left untouched so that the outbound still resolves on its own
+func (r *Router) resolve(metadata *common.Metadata) *common.Metadata {
+	resolved := *metadata
+	dest := *metadata.DestAddr
+	resolved.DestAddr = &dest
+	if r.resolver == nil {
+		return &resolved
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	ip, err := r.resolver.Resolve(ctx, dest.FQDN)
+	if err != nil {
+		log.Println(err)
+		return &resolved
+	}
+	dest.IP = ip
+	return &resolved
+}
+
+func (r *Router) Close() error {
+	close(r.closed)
+	if r.geoIP != nil {
+		return r.geoIP.Close()
+	}
+	return nil
+}
@@ -0,0 +1,290 @@
+package route
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/ido2021/light-proxy/adaptor/outbound"
+	"github.com/ido2021/light-proxy/common"
+)
+
+func newTestRouter(t *testing.T, rules ...common.Rule) (*Router, map[string]*outbound.WrapperOutAdaptor) {
+	outAdaptors := map[string]*outbound.WrapperOutAdaptor{
+		outbound.Direct: outbound.NewWrapperOutAdaptor(&outbound.DirectOutAdaptor{}),
+		outbound.Block:  outbound.NewWrapperOutAdaptor(&outbound.BlockOutAdaptor{}),
+		outbound.Proxy:  outbound.NewWrapperOutAdaptor(&outbound.DirectOutAdaptor{}),
+	}
+	router, err := NewRouter(common.Route{Rules: rules}, outAdaptors)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	router.resolver = staticResolver{"nas.lan": net.ParseIP("192.168.1.2"), "www.example.com": net.ParseIP("93.184.216.34")}
+	return router, outAdaptors
+}
+
+type staticResolver map[string]net.IP
+
+func (r staticResolver) Resolve(ctx context.Context, host string) (net.IP, error) {
+	ip, exist := r[host]
+	if !exist {
+		return nil, errors.New("no such host: " + host)
+	}
+	return ip, nil
+}
+
+func TestRouter_Rules(t *testing.T) {
+	router, outAdaptors := newTestRouter(t,
+		common.Rule{IPCidr: []string{"10.0.0.0/8"}, Port: []uint16{22}, Outbound: outbound.Block},
+		common.Rule{IPCidr: []string{"10.0.0.0/8"}, DomainSuffix: []string{".lan"}, Outbound: outbound.Direct},
+		common.Rule{SourceIPCidr: []string{"192.168.2.0/24"}, PortRange: []string{"8000-9000"}, Outbound: outbound.Direct},
+		common.Rule{SourcePort: []uint16{5353}, Outbound: outbound.Block},
+	)
+
+	client := &common.AddrSpec{IP: net.ParseIP("192.168.1.10"), Port: 40000}
+	cases := []struct {
+		metadata *common.Metadata
+		expected string
+	}{
+		{&common.Metadata{RemoteAddr: client, DestAddr: &common.AddrSpec{IP: net.ParseIP("10.0.0.1"), Port: 22}}, outbound.Block},
+		{&common.Metadata{RemoteAddr: client, DestAddr: &common.AddrSpec{IP: net.ParseIP("10.0.0.1"), Port: 443}}, outbound.Direct},
+		{&common.Metadata{RemoteAddr: client, DestAddr: &common.AddrSpec{FQDN: "nas.lan", Port: 443}}, outbound.Direct},
+		{&common.Metadata{RemoteAddr: client, DestAddr: &common.AddrSpec{IP: net.ParseIP("1.1.1.1"), Port: 8080}}, outbound.Proxy},
+		{&common.Metadata{
+			RemoteAddr: &common.AddrSpec{IP: net.ParseIP("192.168.2.3"), Port: 40000},
+			DestAddr:   &common.AddrSpec{IP: net.ParseIP("1.1.1.1"), Port: 8080},
+		}, outbound.Direct},
+		{&common.Metadata{
+			RemoteAddr: &common.AddrSpec{IP: net.ParseIP("192.168.1.3"), Port: 5353},
+			DestAddr:   &common.AddrSpec{IP: net.ParseIP("1.1.1.1"), Port: 53},
+		}, outbound.Block},
+	}
+	for i, c := range cases {
+		if router.Route(c.metadata) != outAdaptors[c.expected] {
+			t.Fatalf("case %d: expect %s", i, c.expected)
+		}
+	}
+}
+
+func TestRouter_InvalidRule(t *testing.T) {
+	outAdaptors := map[string]*outbound.WrapperOutAdaptor{
+		outbound.Direct: outbound.NewWrapperOutAdaptor(&outbound.DirectOutAdaptor{}),
+	}
+	rules := []common.Rule{
+		{Domain: []string{"example.com"}, Outbound: "unknown"},
+		{Outbound: outbound.Direct},
+		{IPCidr: []string{"not an ip"}, Outbound: outbound.Direct},
+	}
+	for i, rule := range rules {
+		if _, err := NewRouter(common.Route{Rules: []common.Rule{rule}}, outAdaptors); err == nil {
+			t.Fatalf("case %d: expect error", i)
+		}
+	}
+}
+
+func TestRouter_GeoIPPrivate(t *testing.T) {
+	router, outAdaptors := newTestRouter(t,
+		common.Rule{GeoIP: []string{"private"}, Outbound: outbound.Direct},
+	)
+
+	cases := []struct {
+		dest     *common.AddrSpec
+		expected string
+	}{
+		{&common.AddrSpec{IP: net.ParseIP("192.168.1.1"), Port: 80}, outbound.Direct},
+		{&common.AddrSpec{IP: net.ParseIP("fe80::1"), Port: 80}, outbound.Direct},
+		{&common.AddrSpec{IP: net.ParseIP("8.8.8.8"), Port: 80}, outbound.Proxy},
+		// 域名先解析再匹配
+		{&common.AddrSpec{FQDN: "nas.lan", Port: 80}, outbound.Direct},
+		{&common.AddrSpec{FQDN: "www.example.com", Port: 80}, outbound.Proxy},
+		{&common.AddrSpec{FQDN: "unknown.lan", Port: 80}, outbound.Proxy},
+	}
+	for i, c := range cases {
+		metadata := &common.Metadata{DestAddr: c.dest}
+		if router.Route(metadata) != outAdaptors[c.expected] {
+			t.Fatalf("case %d: expect %s", i, c.expected)
+		}
+		if c.dest.FQDN != "" && c.dest.IP != nil {
+			t.Fatalf("case %d: destination should not be modified", i)
+		}
+	}
+
+	outAdaptors = map[string]*outbound.WrapperOutAdaptor{
+		outbound.Direct: outbound.NewWrapperOutAdaptor(&outbound.DirectOutAdaptor{}),
+	}
+	rules := []common.Rule{{GeoIP: []string{"cn"}, Outbound: outbound.Direct}}
+	if _, err := NewRouter(common.Route{Rules: rules}, outAdaptors); err != geoIPNotConfigured {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestRouter_LogicalRule(t *testing.T) {
+	router, outAdaptors := newTestRouter(t,
+		common.Rule{
+			Type: "logical",
+			Mode: "and",
+			Rules: []common.Rule{
+				{DomainSuffix: []string{"corp"}},
+				{SourceIPCidr: []string{"10.1.0.0/16"}},
+			},
+			Outbound: outbound.Direct,
+		},
+		common.Rule{
+			Type: "logical",
+			Mode: "or",
+			Rules: []common.Rule{
+				{Port: []uint16{25}},
+				{DomainKeyword: []string{"tracker"}, Invert: true},
+			},
+			Invert:   true,
+			Outbound: outbound.Block,
+		},
+	)
+
+	cases := []struct {
+		source   string
+		domain   string
+		port     int
+		expected string
+	}{
+		{"10.1.2.3", "git.corp", 443, outbound.Direct},
+		// 不在源子网内，继续匹配下一条规则：not (port 25 or not tracker)
+		{"10.2.2.3", "git.corp", 443, outbound.Proxy},
+		{"10.2.2.3", "tracker.example.com", 443, outbound.Block},
+		{"10.2.2.3", "tracker.example.com", 25, outbound.Proxy},
+	}
+	for i, c := range cases {
+		metadata := &common.Metadata{
+			RemoteAddr: &common.AddrSpec{IP: net.ParseIP(c.source), Port: 40000},
+			DestAddr:   &common.AddrSpec{FQDN: c.domain, Port: c.port},
+		}
+		if router.Route(metadata) != outAdaptors[c.expected] {
+			t.Fatalf("case %d: expect %s", i, c.expected)
+		}
+	}
+
+	invalid := []common.Rule{
+		{Type: "logical", Mode: "xor", Rules: []common.Rule{{Port: []uint16{25}}}, Outbound: outbound.Direct},
+		{Type: "logical", Mode: "and", Outbound: outbound.Direct},
+		{Type: "unknown", Outbound: outbound.Direct},
+	}
+	for i, rule := range invalid {
+		if _, err := NewRouter(common.Route{Rules: []common.Rule{rule}}, outAdaptors); err == nil {
+			t.Fatalf("case %d: expect error", i)
+		}
+	}
+}
+
+func TestRouter_InboundUser(t *testing.T) {
+	router, outAdaptors := newTestRouter(t,
+		common.Rule{Inbound: []string{"lan"}, User: []string{"alice", "bob"}, Outbound: outbound.Direct},
+		common.Rule{User: []string{"guest"}, Outbound: outbound.Block},
+		common.Rule{Inbound: []string{"public"}, Outbound: outbound.Block},
+	)
+
+	cases := []struct {
+		inbound  string
+		user     string
+		expected string
+	}{
+		{"lan", "alice", outbound.Direct},
+		{"lan", "", outbound.Proxy},
+		{"lan", "guest", outbound.Block},
+		{"", "bob", outbound.Proxy},
+		{"public", "bob", outbound.Block},
+	}
+	for i, c := range cases {
+		metadata := &common.Metadata{
+			Inbound:  c.inbound,
+			User:     c.user,
+			DestAddr: &common.AddrSpec{IP: net.ParseIP("1.1.1.1"), Port: 443},
+		}
+		if router.Route(metadata) != outAdaptors[c.expected] {
+			t.Fatalf("case %d: expect %s", i, c.expected)
+		}
+	}
+}
+
+// failResolver fails the test if a domain is resolved
+type failResolver struct {
+	t *testing.T
+}
+
+func (r failResolver) Resolve(ctx context.Context, host string) (net.IP, error) {
+	r.t.Fatalf("unexpected resolve: %s", host)
+	return nil, nil
+}
+
+func TestRouter_RouteDomain(t *testing.T) {
+	router, outAdaptors := newTestRouter(t,
+		common.Rule{GeoIP: []string{"private"}, Outbound: outbound.Direct},
+		common.Rule{Invert: true, IPCidr: []string{"10.0.0.0/8"}, Outbound: outbound.Direct},
+		common.Rule{DomainSuffix: []string{"ads.example.com"}, Outbound: outbound.Block},
+	)
+	router.resolver = failResolver{t}
+
+	for domain, expected := range map[string]string{
+		"x.ads.example.com": outbound.Block,
+		"nas.lan":           outbound.Proxy,
+	} {
+		metadata := &common.Metadata{DestAddr: &common.AddrSpec{FQDN: domain}}
+		if router.RouteDomain(metadata) != outAdaptors[expected] {
+			t.Fatalf("%s: expect %s", domain, expected)
+		}
+	}
+}
+
+// staticFakeIP treats 198.18.0.0/15 as fake addresses
+type staticFakeIP map[string]string
+
+func (f staticFakeIP) Contains(ip net.IP) bool {
+	_, fakeNet, _ := net.ParseCIDR("198.18.0.0/15")
+	return fakeNet.Contains(ip)
+}
+
+func (f staticFakeIP) LookupDomain(ip net.IP) (string, bool) {
+	domain, exist := f[ip.String()]
+	return domain, exist
+}
+
+func TestRouter_FakeIP(t *testing.T) {
+	router, outAdaptors := newTestRouter(t,
+		common.Rule{DomainSuffix: []string{"example.com"}, Outbound: outbound.Block},
+	)
+	router.SetFakeIP(staticFakeIP{"198.18.0.1": "www.example.com"})
+
+	metadata := &common.Metadata{DestAddr: &common.AddrSpec{IP: net.ParseIP("198.18.0.1"), Port: 443}}
+	if router.Route(metadata) != outAdaptors[outbound.Block] {
+		t.Fatal("expect block")
+	}
+	if metadata.DestAddr.FQDN != "www.example.com" || metadata.DestAddr.IP != nil {
+		t.Fatalf("bad: %+v", metadata.DestAddr)
+	}
+	if metadata.FakeAddr == nil || metadata.FakeAddr.Address() != "198.18.0.1:443" {
+		t.Fatalf("bad: %+v", metadata.FakeAddr)
+	}
+
+	// 真实地址保持不变
+	metadata = &common.Metadata{DestAddr: &common.AddrSpec{IP: net.ParseIP("1.1.1.1"), Port: 443}}
+	if router.Route(metadata) != outAdaptors[outbound.Proxy] || metadata.DestAddr.IP.String() != "1.1.1.1" || metadata.FakeAddr != nil {
+		t.Fatalf("bad: %+v", metadata.DestAddr)
+	}
+
+	// 未知的假地址被拒绝，不会直接连接假地址
+	metadata = &common.Metadata{DestAddr: &common.AddrSpec{IP: net.ParseIP("198.18.0.2"), Port: 443}}
+	if router.Route(metadata) != outAdaptors[outbound.Block] {
+		t.Fatal("expect block")
+	}
+	// 没有配置block时同样拒绝
+	router2, err := NewRouter(common.Route{}, map[string]*outbound.WrapperOutAdaptor{
+		outbound.Direct: outbound.NewWrapperOutAdaptor(&outbound.DirectOutAdaptor{}),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	router2.SetFakeIP(staticFakeIP{})
+	if _, err := router2.Route(metadata).Dial(context.Background(), "tcp", "198.18.0.2:443"); err != outbound.ErrBlocked {
+		t.Fatalf("bad: %v", err)
+	}
+}
@@ -0,0 +1,336 @@
+package route
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ido2021/light-proxy/adaptor/outbound"
+	"github.com/ido2021/light-proxy/common"
+)
+
+// Rule types and logical modes
+const (
+	ruleTypeDefault = ""
+	ruleTypeLogical = "logical"
+
+	logicalAnd = "and"
+	logicalOr  = "or"
+)
+
+var (
+	emptyRule            = errors.New("rule has no condition")
+	geositeNotConfigured = errors.New("geosite is not configured")
+)
+
+// matcher matches one kind of condition against the metadata
+type matcher interface {
+	Match(metadata *common.Metadata) bool
+}
+
+type Rule struct {
+	// logical规则的子规则及模式
+	mode     string
+	subRules []*Rule
+	// 同一组内的条件为或关系，组之间为与关系
+	destAddr   []matcher
+	sourceAddr []matcher
+	destPort   []matcher
+	sourcePort []matcher
+	inbound    []matcher
+	user       []matcher
+	// needIP 规则需要目标IP，目标只有域名时先解析
+	needIP bool
+	// invert 取反匹配结果
+	invert     bool
+	outAdaptor *outbound.WrapperOutAdaptor
+}
+
+// ruleContext holds the resources shared by the rules of a router
+type ruleContext struct {
+	outAdaptors map[string]*outbound.WrapperOutAdaptor
+	geoIP       *GeoIP
+	geositePath string
+	geosite     *Geosite
+	// ruleSets 从文件加载的规则集，文件变化时重新加载
+	ruleSets []*ruleSetMatcher
+}
+
+func newRule(ctx *ruleContext, config common.Rule) (*Rule, error) {
+	outAdaptor, exist := ctx.outAdaptors[config.Outbound]
+	if !exist {
+		return nil, errors.New("未配置接出代理：" + config.Outbound)
+	}
+	rule, err := buildRule(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	rule.outAdaptor = outAdaptor
+	return rule, nil
+}
+
+// buildRule builds the conditions of a rule, sub-rules of a logical rule
+// have no outbound
+func buildRule(ctx *ruleContext, config common.Rule) (*Rule, error) {
+	switch config.Type {
+	case ruleTypeDefault:
+		return buildDefaultRule(ctx, config)
+	case ruleTypeLogical:
+		return buildLogicalRule(ctx, config)
+	default:
+		return nil, fmt.Errorf("unknown rule type: %s", config.Type)
+	}
+}
+
+func buildLogicalRule(ctx *ruleContext, config common.Rule) (*Rule, error) {
+	if config.Mode != logicalAnd && config.Mode != logicalOr {
+		return nil, fmt.Errorf("unknown logical mode: %s", config.Mode)
+	}
+	if len(config.Rules) == 0 {
+		return nil, emptyRule
+	}
+	rule := &Rule{mode: config.Mode, invert: config.Invert}
+	for _, subConfig := range config.Rules {
+		subRule, err := buildRule(ctx, subConfig)
+		if err != nil {
+			return nil, err
+		}
+		rule.subRules = append(rule.subRules, subRule)
+		rule.needIP = rule.needIP || subRule.needIP
+	}
+	return rule, nil
+}
+
+func buildDefaultRule(ctx *ruleContext, config common.Rule) (*Rule, error) {
+	rule := &Rule{invert: config.Invert}
+
+	domains, err := compileDomains(&RuleSet{
+		Full:    config.Domain,
+		Suffix:  config.DomainSuffix,
+		Keyword: config.DomainKeyword,
+		Regexp:  config.DomainRegex,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !domains.Empty() {
+		rule.destAddr = append(rule.destAddr, domains)
+	}
+	if len(config.Geosite) > 0 {
+		m, err := ctx.newGeositeMatcher(config.Geosite)
+		if err != nil {
+			return nil, err
+		}
+		rule.destAddr = append(rule.destAddr, m)
+	}
+	if config.DomainPath != "" {
+		m, err := newRuleSetMatcher(config.DomainPath, false)
+		if err != nil {
+			return nil, err
+		}
+		rule.destAddr = append(rule.destAddr, m)
+		ctx.ruleSets = append(ctx.ruleSets, m)
+	}
+
+	if len(config.IPCidr) > 0 {
+		m, err := newIPCidrMatcher(config.IPCidr, false)
+		if err != nil {
+			return nil, err
+		}
+		rule.destAddr = append(rule.destAddr, m)
+		rule.needIP = true
+	}
+	if config.IPCidrPath != "" {
+		m, err := newRuleSetMatcher(config.IPCidrPath, true)
+		if err != nil {
+			return nil, err
+		}
+		rule.destAddr = append(rule.destAddr, m)
+		ctx.ruleSets = append(ctx.ruleSets, m)
+		rule.needIP = true
+	}
+	if len(config.GeoIP) > 0 {
+		m, err := newGeoIPMatcher(ctx.geoIP, config.GeoIP)
+		if err != nil {
+			return nil, err
+		}
+		rule.destAddr = append(rule.destAddr, m)
+		rule.needIP = true
+	}
+	if len(config.SourceIPCidr) > 0 {
+		m, err := newIPCidrMatcher(config.SourceIPCidr, true)
+		if err != nil {
+			return nil, err
+		}
+		rule.sourceAddr = append(rule.sourceAddr, m)
+	}
+
+	if len(config.Port) > 0 || len(config.PortRange) > 0 {
+		ports := NewPortSet()
+		for _, port := range config.Port {
+			ports.Add(port)
+		}
+		for _, r := range config.PortRange {
+			if err := ports.AddRange(r); err != nil {
+				return nil, err
+			}
+		}
+		rule.destPort = append(rule.destPort, &portMatcher{ports: ports})
+	}
+	if len(config.SourcePort) > 0 {
+		ports := NewPortSet()
+		for _, port := range config.SourcePort {
+			ports.Add(port)
+		}
+		rule.sourcePort = append(rule.sourcePort, &portMatcher{ports: ports, source: true})
+	}
+
+	if len(config.Inbound) > 0 {
+		rule.inbound = append(rule.inbound, newTagMatcher(config.Inbound, false))
+	}
+	if len(config.User) > 0 {
+		rule.user = append(rule.user, newTagMatcher(config.User, true))
+	}
+
+	if len(rule.destAddr) == 0 && len(rule.sourceAddr) == 0 && len(rule.destPort) == 0 && len(rule.sourcePort) == 0 &&
+		len(rule.inbound) == 0 && len(rule.user) == 0 {
+		return nil, emptyRule
+	}
+	return rule, nil
+}
+
+// newGeositeMatcher compiles the categories into a single domain matcher,
+// the geosite file is loaded on first use
+func (ctx *ruleContext) newGeositeMatcher(codes []string) (*domainMatcher, error) {
+	if ctx.geosite == nil {
+		if ctx.geositePath == "" {
+			return nil, geositeNotConfigured
+		}
+		geosite, err := LoadGeosite(ctx.geositePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load geosite %s: %w", ctx.geositePath, err)
+		}
+		ctx.geosite = geosite
+	}
+
+	merged, err := ctx.geosite.Merge(codes)
+	if err != nil {
+		return nil, err
+	}
+	return compileDomains(merged)
+}
+
+func (r *Rule) Match(metadata *common.Metadata) bool {
+	return r.match(metadata) != r.invert
+}
+
+func (r *Rule) match(metadata *common.Metadata) bool {
+	switch r.mode {
+	case logicalAnd:
+		for _, subRule := range r.subRules {
+			if !subRule.Match(metadata) {
+				return false
+			}
+		}
+		return true
+	case logicalOr:
+		for _, subRule := range r.subRules {
+			if subRule.Match(metadata) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, group := range [][]matcher{r.destAddr, r.sourceAddr, r.destPort, r.sourcePort, r.inbound, r.user} {
+		if len(group) > 0 && !matchAny(group, metadata) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchAny(matchers []matcher, metadata *common.Metadata) bool {
+	for _, m := range matchers {
+		if m.Match(metadata) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *domainMatcher) Match(metadata *common.Metadata) bool {
+	if metadata.DestAddr == nil {
+		return false
+	}
+	return m.MatchDomain(metadata.DestAddr.FQDN)
+}
+
+// ipCidrMatcher matches the destination or source IP
+type ipCidrMatcher struct {
+	cidrs  *IPCidrSet
+	source bool
+}
+
+func newIPCidrMatcher(cidrs []string, source bool) (*ipCidrMatcher, error) {
+	set := NewIPCidrSet()
+	for _, cidr := range cidrs {
+		if err := set.Add(cidr); err != nil {
+			return nil, fmt.Errorf("invalid cidr %s: %w", cidr, err)
+		}
+	}
+	return &ipCidrMatcher{cidrs: set, source: source}, nil
+}
+
+func (m *ipCidrMatcher) Match(metadata *common.Metadata) bool {
+	addr := metadata.DestAddr
+	if m.source {
+		addr = metadata.RemoteAddr
+	}
+	if addr == nil || len(addr.IP) == 0 {
+		return false
+	}
+	return m.cidrs.Contains(addr.IP)
+}
+
+// portMatcher matches the destination or source port
+type portMatcher struct {
+	ports  *PortSet
+	source bool
+}
+
+func (m *portMatcher) Match(metadata *common.Metadata) bool {
+	addr := metadata.DestAddr
+	if m.source {
+		addr = metadata.RemoteAddr
+	}
+	if addr == nil {
+		return false
+	}
+	return m.ports.Contains(addr.Port)
+}
+
+// tagMatcher matches the inbound tag or the authenticated user
+type tagMatcher struct {
+	values map[string]struct{}
+	user   bool
+}
+
+func newTagMatcher(values []string, user bool) *tagMatcher {
+	m := &tagMatcher{values: map[string]struct{}{}, user: user}
+	for _, value := range values {
+		m.values[value] = struct{}{}
+	}
+	return m
+}
+
+func (m *tagMatcher) Match(metadata *common.Metadata) bool {
+	value := metadata.Inbound
+	if m.user {
+		value = metadata.User
+	}
+	// 匿名访问或未设置tag的入站不匹配
+	if value == "" {
+		return false
+	}
+	_, ok := m.values[value]
+	return ok
+}
@@ -0,0 +1,261 @@
+package route
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/ido2021/light-proxy/common"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ruleSetMagic starts a compiled binary rule-set file
+var ruleSetMagic = []byte("LPRS\x01")
+
+// ruleSetCheckInterval is how often rule-set files are checked for changes
+var ruleSetCheckInterval = 10 * time.Second
+
+var (
+	invalidRuleSet = errors.New("invalid compiled rule set")
+)
+
+// RuleSet is the content of a rule-set file
+type RuleSet struct {
+	Full    []string
+	Suffix  []string
+	Keyword []string
+	Regexp  []string
+	IPCidr  []string
+}
+
+// ParseDomainList parses a plain domain list as used by v2ray domain lists:
+// domain:, full:, keyword: and regexp: prefixes, lines without a prefix are
+// domain suffixes. include: loads another list from the same directory
+func ParseDomainList(path string) (*RuleSet, error) {
+	set := &RuleSet{}
+	err := parseDomainList(path, set, map[string]struct{}{})
+	return set, err
+}
+
+func parseDomainList(path string, set *RuleSet, included map[string]struct{}) error {
+	if _, exist := included[path]; exist {
+		return nil
+	}
+	included[path] = struct{}{}
+
+	return readLines(path, func(line string) error {
+		// 忽略属性，例如 example.com @cn
+		line = strings.Fields(line)[0]
+		kind, value, found := strings.Cut(line, ":")
+		if !found {
+			set.Suffix = append(set.Suffix, line)
+			return nil
+		}
+		switch kind {
+		case "domain":
+			set.Suffix = append(set.Suffix, value)
+		case "full":
+			set.Full = append(set.Full, value)
+		case "keyword":
+			set.Keyword = append(set.Keyword, value)
+		case "regexp":
+			set.Regexp = append(set.Regexp, value)
+		case "include":
+			return parseDomainList(filepath.Join(filepath.Dir(path), value), set, included)
+		default:
+			return fmt.Errorf("unknown domain type %s in %s", kind, path)
+		}
+		return nil
+	})
+}
+
+// ParseIPCidrList parses a plain list with one CIDR per line
+func ParseIPCidrList(path string) (*RuleSet, error) {
+	set := &RuleSet{}
+	err := readLines(path, func(line string) error {
+		set.IPCidr = append(set.IPCidr, line)
+		return nil
+	})
+	return set, err
+}
+
+// readLines calls fn with every non-empty line, # starts a comment
+func readLines(path string, fn func(line string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if err := fn(line); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// WriteRuleSet writes the compiled binary form of set
+func WriteRuleSet(w io.Writer, set *RuleSet) error {
+	buf := bytes.NewBuffer(append([]byte{}, ruleSetMagic...))
+	varint := make([]byte, binary.MaxVarintLen64)
+	for _, section := range [][]string{set.Full, set.Suffix, set.Keyword, set.Regexp, set.IPCidr} {
+		buf.Write(varint[:binary.PutUvarint(varint, uint64(len(section)))])
+		for _, item := range section {
+			buf.Write(varint[:binary.PutUvarint(varint, uint64(len(item)))])
+			buf.WriteString(item)
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// ReadRuleSet reads the compiled binary form of a rule set
+func ReadRuleSet(data []byte) (*RuleSet, error) {
+	if !bytes.HasPrefix(data, ruleSetMagic) {
+		return nil, invalidRuleSet
+	}
+	r := bytes.NewReader(data[len(ruleSetMagic):])
+
+	set := &RuleSet{}
+	for _, section := range []*[]string{&set.Full, &set.Suffix, &set.Keyword, &set.Regexp, &set.IPCidr} {
+		count, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, invalidRuleSet
+		}
+		for i := uint64(0); i < count; i++ {
+			size, err := binary.ReadUvarint(r)
+			if err != nil || size > uint64(r.Len()) {
+				return nil, invalidRuleSet
+			}
+			item := make([]byte, size)
+			if _, err := io.ReadFull(r, item); err != nil {
+				return nil, invalidRuleSet
+			}
+			*section = append(*section, string(item))
+		}
+	}
+	return set, nil
+}
+
+// LoadRuleSet loads a rule-set file in either compiled or plain-list form,
+// plain lists are parsed as domain lists unless ipCidr is set
+func LoadRuleSet(path string, ipCidr bool) (*RuleSet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(data, ruleSetMagic) {
+		return ReadRuleSet(data)
+	}
+	if ipCidr {
+		return ParseIPCidrList(path)
+	}
+	return ParseDomainList(path)
+}
+
+// ruleSetMatcher matches against a rule-set file and reloads it when the
+// file changes on disk
+type ruleSetMatcher struct {
+	path    string
+	ipCidr  bool
+	matcher atomic.Value
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+}
+
+func newRuleSetMatcher(path string, ipCidr bool) (*ruleSetMatcher, error) {
+	m := &ruleSetMatcher{path: path, ipCidr: ipCidr}
+	if _, err := m.reload(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *ruleSetMatcher) Match(metadata *common.Metadata) bool {
+	return m.matcher.Load().(matcher).Match(metadata)
+}
+
+// reload loads the file again if it was modified, reports whether it was
+func (m *ruleSetMatcher) reload() (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	info, err := os.Stat(m.path)
+	if err != nil {
+		return false, err
+	}
+	if info.ModTime().Equal(m.modTime) && info.Size() == m.size {
+		return false, nil
+	}
+
+	set, err := LoadRuleSet(m.path, m.ipCidr)
+	if err != nil {
+		return false, fmt.Errorf("failed to load rule set %s: %w", m.path, err)
+	}
+	compiled, err := compileRuleSet(set, m.ipCidr)
+	if err != nil {
+		return false, fmt.Errorf("failed to load rule set %s: %w", m.path, err)
+	}
+	m.matcher.Store(compiled)
+	m.modTime = info.ModTime()
+	m.size = info.Size()
+	return true, nil
+}
+
+// compileRuleSet builds the domain or the CIDR matcher of set
+func compileRuleSet(set *RuleSet, ipCidr bool) (matcher, error) {
+	if ipCidr {
+		return newIPCidrMatcher(set.IPCidr, false)
+	}
+	return compileDomains(set)
+}
+
+// DomainSet matches a domain against full, suffix, keyword and regexp rules
+type DomainSet interface {
+	MatchDomain(domain string) bool
+}
+
+// NewDomainSet compiles the domain rules of set for matching outside of
+// routing rules, e.g. DNS rules
+func NewDomainSet(set *RuleSet) (DomainSet, error) {
+	return compileDomains(set)
+}
+
+// compileDomains builds the domain matcher of set
+func compileDomains(set *RuleSet) (*domainMatcher, error) {
+	domains := newDomainMatcher()
+	for _, domain := range set.Full {
+		domains.trie.AddFull(domain)
+	}
+	for _, suffix := range set.Suffix {
+		domains.trie.AddSuffix(suffix)
+	}
+	for _, keyword := range set.Keyword {
+		domains.AddKeyword(keyword)
+	}
+	for _, expr := range set.Regexp {
+		if err := domains.AddRegex(expr); err != nil {
+			return nil, fmt.Errorf("invalid domain regex %s: %w", expr, err)
+		}
+	}
+	return domains, nil
+}
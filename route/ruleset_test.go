@@ -0,0 +1,97 @@
+package route
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ido2021/light-proxy/adaptor/outbound"
+	"github.com/ido2021/light-proxy/common"
+)
+
+func TestParseDomainList(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "google"), []byte(`# comment
+google.com
+domain:youtube.com @ads
+full:www.gstatic.com
+keyword:googleapis
+regexp:^ggpht[0-9]+\.com$
+include:extra
+`), 0644)
+	os.WriteFile(filepath.Join(dir, "extra"), []byte("domain:goo.gl\ninclude:google\n"), 0644)
+
+	set, err := ParseDomainList(filepath.Join(dir, "google"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := &RuleSet{
+		Full:    []string{"www.gstatic.com"},
+		Suffix:  []string{"google.com", "youtube.com", "goo.gl"},
+		Keyword: []string{"googleapis"},
+		Regexp:  []string{`^ggpht[0-9]+\.com$`},
+	}
+	if !reflect.DeepEqual(set, expected) {
+		t.Fatalf("bad: %+v", set)
+	}
+}
+
+func TestRuleSet_Binary(t *testing.T) {
+	set := &RuleSet{
+		Full:   []string{"www.gstatic.com"},
+		Suffix: []string{"google.com", "youtube.com"},
+		IPCidr: []string{"10.0.0.0/8"},
+	}
+	var buf bytes.Buffer
+	if err := WriteRuleSet(&buf, set); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	decoded, err := ReadRuleSet(buf.Bytes())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, set) {
+		t.Fatalf("bad: %+v", decoded)
+	}
+
+	if _, err := ReadRuleSet(buf.Bytes()[:buf.Len()-3]); err != invalidRuleSet {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestRouter_RuleSetReload(t *testing.T) {
+	dir := t.TempDir()
+	domainPath := filepath.Join(dir, "domains")
+	ipPath := filepath.Join(dir, "cidrs")
+	os.WriteFile(domainPath, []byte("example.com\n"), 0644)
+	var buf bytes.Buffer
+	WriteRuleSet(&buf, &RuleSet{IPCidr: []string{"10.0.0.0/8"}})
+	os.WriteFile(ipPath, buf.Bytes(), 0644)
+
+	router, outAdaptors := newTestRouter(t,
+		common.Rule{DomainPath: domainPath, IPCidrPath: ipPath, Outbound: outbound.Direct},
+	)
+	defer router.Close()
+
+	example := &common.Metadata{DestAddr: &common.AddrSpec{FQDN: "www.example.com", Port: 443}}
+	private := &common.Metadata{DestAddr: &common.AddrSpec{IP: net.ParseIP("10.1.1.1"), Port: 443}}
+	other := &common.Metadata{DestAddr: &common.AddrSpec{FQDN: "example.org", Port: 443}}
+	if router.Route(example) != outAdaptors[outbound.Direct] || router.Route(private) != outAdaptors[outbound.Direct] {
+		t.Fatalf("expect direct")
+	}
+	if router.Route(other) != outAdaptors[outbound.Proxy] {
+		t.Fatalf("expect proxy")
+	}
+
+	os.WriteFile(domainPath, []byte("example.org\n"), 0644)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(domainPath, future, future)
+	router.reloadRuleSets()
+	if router.Route(example) != outAdaptors[outbound.Proxy] || router.Route(other) != outAdaptors[outbound.Direct] {
+		t.Fatalf("expect reloaded rule set")
+	}
+}
@@ -3,9 +3,11 @@ package light_proxy
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/ido2021/light-proxy/adaptor/inbound"
 	"github.com/ido2021/light-proxy/adaptor/outbound"
 	"github.com/ido2021/light-proxy/common"
+	"github.com/ido2021/light-proxy/dns"
 	"github.com/ido2021/light-proxy/route"
 	"log"
 	"os"
@@ -22,6 +24,9 @@ type Server struct {
 	closed          chan struct{}
 	router          *route.Router
 	outAdaptors     map[string]*outbound.WrapperOutAdaptor
+	resolver        *dns.Resolver
+	// resolvers 包括resolver在内的所有解析器
+	resolvers []*dns.Resolver
 }
 
 // New creates a new Server and potentially returns an error
@@ -42,60 +47,180 @@ func New(confPath string) (*Server, error) {
 		if factory == nil {
 			return nil, errors.New("不支持的协议: " + l.Type)
 		}
-		adaptor, err := factory(l.Config)
+		// 本地解析器只能应答A和AAAA，其他类型的查询需要上游服务器
+		if inbound.Protocol(l.Type) == inbound.DNS && len(config.DNS.Servers) == 0 {
+			return nil, errors.New("dns入站需要配置dns.servers: " + l.Tag)
+		}
+		adaptor, err := factory(l.Tag, l.Config)
 		if err != nil {
 			return nil, err
 		}
 		adaptors = append(adaptors, adaptor)
 	}
 
-	// 默认接出
-	outAdaptors := map[string]*outbound.WrapperOutAdaptor{
-		outbound.Direct: outbound.NewWrapperOutAdaptor(&outbound.DirectOutAdaptor{}),
-		outbound.Block:  outbound.NewWrapperOutAdaptor(&outbound.BlockOutAdaptor{}),
+	outAdaptors, err := newOutAdaptors(config)
+	if err != nil {
+		return nil, err
 	}
 
-	factory := outbound.GetOutAdaptorFactory(config.Outbound.Type)
-	if factory != nil {
-		outAdaptor, err := factory(config.Outbound.Config)
-		if err != nil {
-			return nil, err
-		}
-		outAdaptors[outbound.Proxy] = outbound.NewWrapperOutAdaptor(outAdaptor)
+	resolver, resolvers, err := newResolver(config, outAdaptors)
+	if err != nil {
+		closeOutAdaptors(outAdaptors)
+		return nil, err
 	}
 
 	router, err := route.NewRouter(config.Route, outAdaptors)
 	if err != nil {
+		closeResolvers(resolvers)
+		closeOutAdaptors(outAdaptors)
 		return nil, err
 	}
+	if resolver.FakeIP() != nil {
+		router.SetFakeIP(resolver.FakeIP())
+	}
+	for _, adaptor := range adaptors {
+		if dnsAdaptor, ok := adaptor.(inbound.DNSInAdaptor); ok {
+			dnsAdaptor.SetResolver(resolver)
+		}
+	}
 	server := &Server{
 		config:          config,
 		inboundAdaptors: adaptors,
 		outAdaptors:     outAdaptors,
 		router:          router,
+		resolver:        resolver,
+		resolvers:       resolvers,
 		closed:          make(chan struct{}),
 	}
 
 	return server, nil
 }
 
+// newOutAdaptors creates the default outbounds and every configured outbound
+// keyed by its tag
+func newOutAdaptors(config *common.Config) (map[string]*outbound.WrapperOutAdaptor, error) {
+	// 默认接出
+	outAdaptors := map[string]*outbound.WrapperOutAdaptor{
+		outbound.Direct: outbound.NewWrapperOutAdaptor(&outbound.DirectOutAdaptor{}),
+		outbound.Block:  outbound.NewWrapperOutAdaptor(&outbound.BlockOutAdaptor{}),
+	}
+
+	outbounds := config.Outbounds
+	if config.Outbound != nil {
+		// 兼容旧的单个outbound配置
+		legacy := *config.Outbound
+		if legacy.Tag == "" {
+			legacy.Tag = outbound.Proxy
+		}
+		outbounds = append([]common.Outbound{legacy}, outbounds...)
+	}
+
+	for _, o := range outbounds {
+		if o.Tag == "" {
+			closeOutAdaptors(outAdaptors)
+			return nil, errors.New("接出代理未配置tag: " + o.Type)
+		}
+		if _, exist := outAdaptors[o.Tag]; exist {
+			closeOutAdaptors(outAdaptors)
+			return nil, errors.New("重复的接出代理tag: " + o.Tag)
+		}
+		factory := outbound.GetOutAdaptorFactory(o.Type)
+		if factory == nil {
+			closeOutAdaptors(outAdaptors)
+			return nil, errors.New("不支持的接出协议: " + o.Type)
+		}
+		strategy, err := outbound.ParseDomainStrategy(o.DomainStrategy)
+		if err != nil {
+			closeOutAdaptors(outAdaptors)
+			return nil, fmt.Errorf("接出代理%s配置错误: %w", o.Tag, err)
+		}
+		outAdaptor, err := factory(o.Config)
+		if err != nil {
+			closeOutAdaptors(outAdaptors)
+			return nil, fmt.Errorf("创建接出代理%s失败: %w", o.Tag, err)
+		}
+		wrapper := outbound.NewWrapperOutAdaptor(outAdaptor)
+		wrapper.SetDomainStrategy(strategy)
+		outAdaptors[o.Tag] = wrapper
+	}
+	return outAdaptors, nil
+}
+
+// newResolver sets the resolver of every outbound to the configured DNS
+// servers, without servers each outbound caches the answers of its own resolver
+// and the resolver of direct is returned. Every resolver consults the hosts
+// first, all created resolvers are returned to be closed
+func newResolver(config *common.Config, outAdaptors map[string]*outbound.WrapperOutAdaptor) (*dns.Resolver, []*dns.Resolver, error) {
+	hosts, err := dns.NewHosts(config.DNS.Hosts, config.DNS.HostsPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(config.DNS.Servers) == 0 {
+		var direct *dns.Resolver
+		var resolvers []*dns.Resolver
+		for tag, outAdaptor := range outAdaptors {
+			cacheConfig := config.DNS.Cache
+			if cacheConfig.Path != "" {
+				// 各接出代理的应答不同，分别持久化
+				cacheConfig.Path += "." + tag
+			}
+			resolver := dns.NewLocalResolver(outAdaptor, cacheConfig)
+			resolver.SetHosts(hosts)
+			outAdaptor.SetResolver(resolver)
+			resolvers = append(resolvers, resolver)
+			if tag == outbound.Direct {
+				direct = resolver
+			}
+		}
+		return direct, resolvers, nil
+	}
+
+	resolver, err := dns.NewResolver(config.DNS, config.Route.GeositePath, outAdaptors)
+	if err != nil {
+		return nil, nil, err
+	}
+	resolver.SetHosts(hosts)
+	for _, outAdaptor := range outAdaptors {
+		outAdaptor.SetResolver(resolver)
+	}
+	return resolver, []*dns.Resolver{resolver}, nil
+}
+
+func closeResolvers(resolvers []*dns.Resolver) {
+	for _, resolver := range resolvers {
+		err := resolver.Close()
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func closeOutAdaptors(outAdaptors map[string]*outbound.WrapperOutAdaptor) {
+	for _, adaptor := range outAdaptors {
+		err := adaptor.Close()
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
 // Start is used to create a listener and serve on it
 func (s *Server) Start() error {
 	if s.running {
 		return nil
 	}
 	for _, adaptor := range s.inboundAdaptors {
-		go func() {
+		go func(adaptor inbound.InAdaptor) {
 			err := adaptor.Start(s.router)
 			log.Println(err)
-		}()
+		}(adaptor)
 	}
 	s.waitOnExit()
 	return nil
 }
 
 func (s *Server) waitOnExit() {
-	signals := make(chan os.Signal)
+	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 	select {
 	case sig := <-signals:
@@ -117,12 +242,9 @@ func (s *Server) Stop() error {
 				log.Println(err)
 			}
 		}
-		for _, adaptor := range s.outAdaptors {
-			err := adaptor.Close()
-			if err != nil {
-				log.Println(err)
-			}
-		}
+		_ = s.router.Close()
+		closeResolvers(s.resolvers)
+		closeOutAdaptors(s.outAdaptors)
 	}
 	return nil
 }
@@ -0,0 +1,103 @@
+package light_proxy
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ido2021/light-proxy/adaptor/outbound"
+	"github.com/ido2021/light-proxy/common"
+)
+
+func init() {
+	outbound.RegisterOutAdaptorFactory("test-direct", func(config json.RawMessage) (outbound.OutAdaptor, error) {
+		return &outbound.DirectOutAdaptor{}, nil
+	})
+}
+
+func TestNewOutAdaptors(t *testing.T) {
+	config := &common.Config{
+		Outbound: &common.Outbound{Type: "test-direct"},
+		Outbounds: []common.Outbound{
+			{Tag: "wg1", Type: "test-direct"},
+			{Tag: "wg2", Type: "test-direct"},
+		},
+	}
+	outAdaptors, err := newOutAdaptors(config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, tag := range []string{outbound.Direct, outbound.Block, outbound.Proxy, "wg1", "wg2"} {
+		if _, exist := outAdaptors[tag]; !exist {
+			t.Fatalf("missing outbound: %s", tag)
+		}
+	}
+}
+
+func TestNewOutAdaptors_Invalid(t *testing.T) {
+	configs := map[string]*common.Config{
+		"duplicate": {Outbounds: []common.Outbound{
+			{Tag: "wg", Type: "test-direct"},
+			{Tag: "wg", Type: "test-direct"},
+		}},
+		"reserved": {Outbounds: []common.Outbound{{Tag: outbound.Direct, Type: "test-direct"}}},
+		"no tag":   {Outbounds: []common.Outbound{{Type: "test-direct"}}},
+		"unknown":  {Outbounds: []common.Outbound{{Tag: "wg", Type: "unknown"}}},
+		"strategy": {Outbounds: []common.Outbound{{Tag: "wg", Type: "test-direct", DomainStrategy: "ipv5_only"}}},
+	}
+	for name, config := range configs {
+		if _, err := newOutAdaptors(config); err == nil {
+			t.Fatalf("%s: expect error", name)
+		}
+	}
+}
+
+func TestNew_DNSInbound(t *testing.T) {
+	confPath := filepath.Join(t.TempDir(), "config.json")
+	inbounds := `"inbounds": [{"tag": "dns-in", "type": "dns", "config": {"address": "127.0.0.1:0"}}]`
+	if err := os.WriteFile(confPath, []byte(`{`+inbounds+`}`), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := New(confPath); err == nil {
+		t.Fatal("expect error")
+	}
+
+	config := `{` + inbounds + `, "dns": {"servers": [{"tag": "udp", "address": "udp://127.0.0.1:53"}]}}`
+	if err := os.WriteFile(confPath, []byte(config), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	server, err := New(confPath)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_ = server.router.Close()
+	closeResolvers(server.resolvers)
+	closeOutAdaptors(server.outAdaptors)
+}
+
+func TestNewResolver_Local(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	config := &common.Config{DNS: common.DNS{Cache: common.DNSCache{Path: path}}}
+	outAdaptors, err := newOutAdaptors(config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer closeOutAdaptors(outAdaptors)
+	resolver, resolvers, err := newResolver(config, outAdaptors)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(resolvers) != len(outAdaptors) {
+		t.Fatalf("bad: %d", len(resolvers))
+	}
+	if _, err := resolver.LookupHost(context.Background(), "localhost"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	closeResolvers(resolvers)
+	// direct的缓存写入按tag区分的文件
+	if _, err := os.Stat(path + "." + outbound.Direct); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}